@@ -9,6 +9,10 @@ angular.module('ngFilter', []).filter('reqFilter', function () {
                 return function (item) {
                     return item.URI.indexOf(pattern) != -1;
                 };
+            } else if (filterType == "Route") {
+                return function (item) {
+                    return (item.Route || "").indexOf(pattern) != -1;
+                };
             } else if (filterType == "RequestHeader") {
                 return function (item) {
                     for (var i = 0; i < item.Headers.length; ++i) {
@@ -68,22 +72,79 @@ angular.module('ngFilter', []).filter('reqFilter', function () {
         return result;
     };
 });
+// procTitle describes the local process of an end, eg. java/123 in container 0123456789ab.
+function procTitle(p) {
+    if (!p) return "";
+    return " " + p.comm + "/" + p.pid + (p.container ? " in container " + p.container.substring(0, 12) : "");
+}
+// fromRecord converts the event record of schema netgraph.event/v1 to the model of the page.
+function fromRecord(r) {
+    var d = r.data;
+    var e = {
+        Type: r.kind, UID: r.id, Time: new Date(r.time),
+        StreamSeq: d.stream, ID: d.transaction, ClientAddr: d.client, ServerAddr: d.server,
+        ClientName: d.clientName, ServerName: d.serverName,
+        ClientProcess: procTitle(d.clientProcess), ServerProcess: procTitle(d.serverProcess)
+    };
+    if (r.kind == "HTTPRequest" || r.kind == "HTTPResponse") {
+        e.Start = new Date(d.start);
+        e.Method = d.method;
+        e.URI = d.uri;
+        e.Route = d.route;
+        e.Version = d.version;
+        e.Code = d.code;
+        e.Reason = d.reason;
+        e.Headers = d.headers.map(function (h) { return {Name: h.name, Value: h.value}; });
+        e.Body = d.bodyEncoding == "base64" ? Base64.decode(d.body) : (d.body || "");
+        e.BodyTruncated = d.bodyTruncated || false;
+        e.BodyOriginalSize = d.bodyOriginalSize;
+        e.BodySHA256 = d.bodySha256;
+        e.Timing = d.timing || {};
+    } else if (r.kind == "ParseError") {
+        e.Stream = (d.srcName ? d.srcName + "(" + d.src + ")" : d.src) + " -> " +
+            (d.dstName ? d.dstName + "(" + d.dst + ")" : d.dst);
+        e.Stage = d.stage;
+        e.Error = d.error;
+        e.Snippet = d.snippet;
+    } else if (r.kind == "Finding") {
+        e.Category = d.category;
+        e.Rule = d.rule;
+        e.Severity = d.severity;
+        e.Detail = d.detail;
+    }
+    return e;
+}
 var app = angular.module('netgraph', ['angular-websocket', 'ngFilter'])
 app.factory('netdata', function ($websocket) {
     var dataStream = $websocket("ws://" + location.host + "/data");
     var streams = {};
     var reqs = [];
+    var parseErrors = [];
+    var findings = [];
     dataStream.onMessage(function (message) {
-        var e = JSON.parse(message.data);
+        var r = JSON.parse(message.data);
+        if (r.schema != "netgraph.event/v1") {
+            console.error("unsupported event schema " + r.schema);
+            return;
+        }
+        var e = fromRecord(r);
+        if (e.Type == "ParseError") {
+            parseErrors.push(e);
+            return;
+        }
+        if (e.Type == "Finding") {
+            findings.push(e);
+            return;
+        }
         if (!(e.StreamSeq in streams)) {
             streams[e.StreamSeq] = [];
         }
         var stream = streams[e.StreamSeq];
         if (e.Type == "HTTPRequest") {
-            e.Start = new Date(e.Start)
-            if (e.Body) {
-                e.Body = Base64.decode(e.Body)
-            }
+            e.Timing = {
+                Handshake: e.Timing.handshake || null,
+                Send: e.Timing.send || 0
+            };
             stream.push(e);
             reqs.push(e);
             //add Host
@@ -95,10 +156,6 @@ app.factory('netdata', function ($websocket) {
                 }
             }
         } else if (e.Type == "HTTPResponse") {
-            if (e.Body) {
-                e.Body = Base64.decode(e.Body)
-            }
-
             for (var i = stream.length - 1; i >= 0; --i) {
                 var req = stream[i]
                 if (req.ID === e.ID) {
@@ -106,8 +163,16 @@ app.factory('netdata', function ($websocket) {
                         console.error("duplicate response in stream #" + e.StreamSeq + " URI:" + req.URI
                             + "\nold:", req.Response, "\nnew:", e)
                     } else {
+                        var t = e.Timing;
                         req.Response = e;
-                        req.Duration = new Date(e.End) - req.Start;
+                        req.Duration = t.total || 0;
+                        req.TTFB = t.wait || 0;
+                        req.Timing = {
+                            Handshake: req.Timing.Handshake,
+                            Send: req.Timing.Send,
+                            Wait: req.TTFB,
+                            Receive: t.receive || 0
+                        };
                     }
 
                     break
@@ -118,6 +183,8 @@ app.factory('netdata', function ($websocket) {
     var data = {
         reqs: reqs,
         streams: streams,
+        parseErrors: parseErrors,
+        findings: findings,
         sync: function () {
             dataStream.send("sync");
         }
@@ -126,6 +193,10 @@ app.factory('netdata', function ($websocket) {
 })
 app.controller('HttpListCtrl', function ($scope, netdata) {
     $scope.reqs = netdata.reqs;
+    $scope.parseErrors = netdata.parseErrors;
+    $scope.showParseErrors = false;
+    $scope.findings = netdata.findings;
+    $scope.showFindings = false;
     $scope.showDetail = function ($event, req) {
         $scope.selectedReq = req;
         var tr = $event.currentTarget;
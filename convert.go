@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bingoohuang/gg/pkg/flagparse"
+	"github.com/ga0/netgraph/pkg/httpstream"
+)
+
+// ConvertArg arguments of the convert subcommand.
+type ConvertArg struct {
+	Inputs       []string `flag:"i" val:"" required:"true" usage:"Pcap/pcapng files, globs or directories to convert, eg -i 'dumps/*.pcap'"`
+	Outs         []string `flag:"o" val:"" required:"true" usage:"Outputs, a filename like all.har to convert all the inputs into it, or a suffix like .har to convert each input into {input}.har"`
+	OutDir       string   `flag:"o.dir" val:"" usage:"Directory of the outputs of suffixes, empty for the directory of each input"`
+	OnlyRequests bool     `flag:"i.request" val:"false" usage:"Only convert HTTP requests"`
+	InputMethod  string   `flag:"i.method" val:"" usage:"Only convert HTTP methods, empty for ANY, multiple separated by comma, eg POST"`
+	Bpf          string   `flag:"bpf" val:"" usage:"Only convert packets matching the BPF subset of host/port/net/portrange/tcp/udp/ip/ip6 with and/or/not, eg 'tcp port 8080'"`
+	Filter       string   `flag:"filter" val:"" usage:"Only convert HTTP transactions matching the filter expression"`
+	Routes       []string `flag:"route" val:"" usage:"Route patterns to group URIs, eg /users/{id}, or OpenAPI files in JSON or YAML"`
+	ConnEvents   bool     `flag:"conn" val:"false" usage:"Emit TCP connection lifecycle events"`
+	Security     bool     `flag:"security" val:"false" usage:"Flag HTTP request smuggling and protocol ambiguities as findings"`
+	Redact       string   `flag:"redact" val:"" usage:"Redact sensitive data by the rules of the JSON file"`
+	Names        []string `flag:"name" val:"" usage:"Name of addresses as addr=name, addr is IP, IP:port or CIDR"`
+	NamesFile    string   `flag:"names" val:"" usage:"Name addresses by the file of lines 'addr name'"`
+	Hosts        string   `flag:"hosts" val:"" usage:"Name IPs by their hostnames in the hosts file, eg /etc/hosts"`
+	Report       string   `flag:"report" val:"" usage:"Print the traffic summary report of all the inputs, and write it to the JSON file, - for no JSON"`
+	MemTotal     int      `flag:"mem.total" val:"1024" usage:"MiB buffered by all the TCP streams, the oldest streams are dropped over it, 0 for unlimited"`
+	MemStream    int      `flag:"mem.stream" val:"64" usage:"MiB buffered by a TCP stream, bodies are truncated and headers dropped over it, 0 for unlimited"`
+	BodyRequest  int      `flag:"body.request" val:"0" usage:"KiB of a request body captured, the rest is truncated, 0 for unlimited"`
+	BodyResponse int      `flag:"body.response" val:"0" usage:"KiB of a response body captured, the rest is truncated, 0 for unlimited"`
+	BodyDir      string   `flag:"body.dir" val:"" usage:"Save the whole bodies over the limits to the directory by their SHA-256, not with -redact"`
+	BodyDirSize  int      `flag:"body.dir.size" val:"1024" usage:"MiB of the bodies saved to -body.dir, the oldest ones are removed over it, 0 for unlimited"`
+	Shards       int      `flag:"shards" val:"1" usage:"Assemble TCP streams by n goroutines sharded by the flow hash, 0 for the number of CPUs"`
+	Verbose      bool     `flag:"verbose" val:"false" usage:"Show the logs of parsing"`
+}
+
+// Usage shows the usage of the convert subcommand.
+func (c ConvertArg) Usage() string {
+	return `
+Usage: netgraph convert -i input... -o output... [options]
+
+Convert pcap/pcapng files to http, json, ndjson, har, csv, otlp, dot outputs, eg.
+  netgraph convert -i dump.pcap -o dump.har
+  netgraph convert -i dumps -i 'more/*.pcapng' -o .har -o .csv -o.dir out
+
+Options:
+  -i          pcap/pcapng files, globs or directories, repeatable
+  -o          output filename to convert all inputs into, or suffix like .har to convert each input separately
+  -o.dir      directory of the outputs of suffixes, default the directory of each input
+  -i.request  only convert HTTP requests
+  -i.method   only convert HTTP methods, eg POST,GET
+  -bpf        only convert packets matching the BPF, eg 'tcp port 8080', of host, net, port, portrange,
+              tcp, udp, ip, ip6, with and, or, not
+  -filter     only convert HTTP transactions matching the filter expression
+  -route      route patterns to group URIs, eg /users/{id}, or OpenAPI files in JSON or YAML, repeatable
+  -conn       emit TCP connection lifecycle events
+  -security   flag HTTP request smuggling and protocol ambiguities as findings
+  -redact     redact sensitive data by the rules of the JSON file, not with .pcap outputs or -body.dir
+  -name       name of addresses as addr=name, addr is IP, IP:port or CIDR, repeatable
+  -names      name addresses by the file of lines 'addr name'
+  -hosts      name IPs by their hostnames in the hosts file, eg /etc/hosts
+  -report     print the traffic summary report of all the inputs, and write it to the JSON file, - for no JSON
+  -mem.total  MiB buffered by all the TCP streams, the oldest streams are dropped over it, 0 for unlimited
+  -mem.stream MiB buffered by a TCP stream, bodies are truncated and headers dropped over it, 0 for unlimited
+  -body.request  KiB of a request body captured, the rest is truncated, 0 for unlimited
+  -body.response KiB of a response body captured, the rest is truncated, 0 for unlimited
+  -body.dir      save the whole bodies over the limits to the directory by their SHA-256, not with -redact
+  -body.dir.size MiB of the bodies saved to -body.dir, the oldest ones are removed over it, 0 for unlimited
+  -shards     assemble TCP streams by n goroutines sharded by the flow hash, 0 for the number of CPUs
+  -verbose    show the logs of parsing
+
+The exit code is 1 if there are parse errors, 2 if any input can not be converted.
+`
+}
+
+// quietWriter only writes the error and warning logs.
+type quietWriter struct{ w io.Writer }
+
+func (q quietWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("E! ")) || bytes.Contains(p, []byte("W! ")) {
+		return q.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// sharedHandler is pushed the events of all the convert jobs, and waited once at the end. The streams of each job
+// are numbered on from the ones of the previous jobs, whose pipelines number them from 0 too, so that
+// the transactions of different jobs are not paired.
+type sharedHandler struct {
+	httpstream.EventHandler
+	base, next uint // the first stream number of the job, and of the next job
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (h *sharedHandler) PushEvent(e httpstream.Event) {
+	switch v := e.(type) {
+	case httpstream.RequestEvent:
+		v.StreamSeq = h.renumber(v.StreamSeq)
+		e = v
+	case httpstream.ResponseEvent:
+		v.StreamSeq = h.renumber(v.StreamSeq)
+		e = v
+	}
+	h.EventHandler.PushEvent(e)
+}
+
+func (h *sharedHandler) renumber(seq uint) uint {
+	seq += h.base
+	if seq >= h.next {
+		h.next = seq + 1
+	}
+	return seq
+}
+
+// Wait implements the function of interface EventHandler, which ends the job.
+func (h *sharedHandler) Wait() { h.base = h.next }
+
+// convertJob converts the inputs into the outputs.
+type convertJob struct {
+	inputs []string
+	outs   []string
+}
+
+// convert runs the convert subcommand, and returns the exit code.
+func convert(args []string) int {
+	var c ConvertArg
+	flagparse.ParseArgs(&c, args)
+
+	if !c.Verbose {
+		log.SetOutput(quietWriter{w: os.Stderr})
+	}
+
+	jobs, err := c.jobs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for _, job := range jobs {
+		for _, out := range job.outs {
+			if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+		}
+	}
+
+	a := Arg{Outs: c.Outs, InputRequest: c.OnlyRequests, InputMethod: c.InputMethod, Filter: c.Filter, Routes: c.Routes,
+		Names: c.Names, NamesFile: c.NamesFile, Hosts: c.Hosts, ConnEvents: c.ConnEvents, Security: c.Security,
+		Redact: c.Redact, Report: c.Report, EventSize: 1024, SnapLen: 65535, Shards: c.Shards,
+		MemTotal: c.MemTotal, MemStream: c.MemStream, BodyRequest: c.BodyRequest, BodyResponse: c.BodyResponse,
+		BodyDir: c.BodyDir, BodyDirSize: c.BodyDirSize}
+	opt := a.Options()
+	opt.Offline = true
+
+	var report httpstream.EventHandler
+	if c.Report != "" {
+		report = a.reportHandler()
+		a.sharedReport = &sharedHandler{EventHandler: report}
+	}
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "INPUT\tPACKETS\tREQUESTS\tRESPONSES\tCONNECTIONS\tPARSE ERRORS\tDROPPED\tFINDINGS\tELAPSED\t")
+
+	var total httpstream.FeedStats
+	failed := 0
+	for _, job := range jobs {
+		a.Outs = job.outs
+		opt.OutputPcap = httpstream.SuffixPcap.Find(job.outs)
+
+		ech := make(chan httpstream.Event, a.EventSize)
+		p, err := httpstream.NewPipeline(ech, opt)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		done := make(chan struct{})
+		hs := a.createHandlers()
+		go func() {
+			hs.Run(ech)
+			close(done)
+		}()
+
+		for _, input := range job.inputs {
+			source, err := httpstream.NewPacketSource(input, c.Bpf, 0)
+			if err != nil {
+				failed++
+				fmt.Fprintf(w, "%s\t%v\t\t\t\t\t\t\t\t\n", input, err)
+				continue
+			}
+
+			s := p.Feed(source)
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t\n", input, s.Packets, s.Requests, s.Responses,
+				s.Connections, s.ParseErrors, s.Dropped, s.Findings, s.Elapsed.Round(time.Millisecond))
+			total.Add(s)
+		}
+
+		p.Close()
+		<-done
+	}
+
+	fmt.Fprintf(w, "TOTAL\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\t\n", total.Packets, total.Requests, total.Responses,
+		total.Connections, total.ParseErrors, total.Dropped, total.Findings, total.Elapsed.Round(time.Millisecond))
+	_ = w.Flush()
+
+	if report != nil {
+		report.Wait()
+	}
+
+	switch {
+	case failed > 0:
+		return 2
+	case total.ParseErrors > 0:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// jobs groups the inputs and outputs, the outputs should be all filenames or all suffixes.
+func (c ConvertArg) jobs() ([]convertJob, error) {
+	inputs, err := expandInputs(c.Inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	suffixes := 0
+	for _, o := range c.Outs {
+		if strings.HasPrefix(o, ".") && !strings.ContainsAny(o, `/\`) {
+			suffixes++
+		}
+	}
+
+	switch suffixes {
+	case 0:
+		return []convertJob{{inputs: inputs, outs: c.Outs}}, nil
+	case len(c.Outs):
+	default:
+		return nil, fmt.Errorf("outputs %v should be all filenames or all suffixes", c.Outs)
+	}
+
+	jobs := make([]convertJob, len(inputs))
+	for i, input := range inputs {
+		dir, base := filepath.Split(input)
+		if c.OutDir != "" {
+			dir = c.OutDir
+		}
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+
+		jobs[i] = convertJob{inputs: []string{input}}
+		for _, suffix := range c.Outs {
+			jobs[i].outs = append(jobs[i].outs, filepath.Join(dir, base+suffix))
+		}
+	}
+	return jobs, nil
+}
+
+// pcapExts are the extensions of the files to convert in the input directories.
+var pcapExts = []string{".pcap", ".pcapng", ".cap"}
+
+// expandInputs expands the globs and directories of inputs to the files.
+func expandInputs(inputs []string) (files []string, err error) {
+	for _, input := range inputs {
+		if stat, err := os.Stat(input); err == nil && stat.IsDir() {
+			for _, ext := range pcapExts {
+				matches, _ := filepath.Glob(filepath.Join(input, "*"+ext))
+				files = append(files, matches...)
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, fmt.Errorf("bad input %s, error: %w", input, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("input %s not found", input)
+		}
+		files = append(files, matches...)
+	}
+
+	sort.Strings(files)
+	unique := files[:0]
+	for i, f := range files {
+		if i == 0 || f != files[i-1] {
+			unique = append(unique, f)
+		}
+	}
+	files = unique
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no pcap files found in %v", inputs)
+	}
+	return files, nil
+}
@@ -6,4 +6,5 @@ require (
 	github.com/bingoohuang/gg v0.0.0-20210520022316-a866c79d56aa
 	github.com/google/gopacket v1.1.19
 	golang.org/x/net v0.0.0-20210510120150-4163338589ed
+	golang.org/x/sys v0.0.0-20210423082822-04245dca01da
 )
@@ -2,10 +2,14 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/bingoohuang/gg/pkg/flagparse"
 	"github.com/ga0/netgraph/pkg/httpstream"
-	"github.com/google/gopacket"
 )
 
 // Arg arguments.
@@ -13,26 +17,189 @@ type Arg struct {
 	Input        string   `flag:"i" val:"any" usage:"Device to capture, or pcap filename to open"`
 	InputRequest bool     `flag:"i.request" val:"true" usage:"Only capture HTTP requests"`
 	InputMethod  string   `flag:"i.method" val:"" usage:"Only capture HTTP methods, empty for ANY, multiple separated by comma, eg POST"`
-	Bpf          string   `flag:"bpf" val:"tcp and dst port 80" usage:"Set berkeley packet filter"`
-	Outs         []string `flag:"o" val:"" usage:"Outputs HTTP request/response, :\n stdout to print to stdout,\n stdlog to log,\nxx.http to create replay-able http file, \nxx.pcap to write captured packets as a pcap file, \nxx.json to create replay-able json file"`
+	Bpf          string   `flag:"bpf" val:"tcp and dst port 80" usage:"Set berkeley packet filter, host/port/net/portrange/tcp/udp/ip/ip6 with and/or/not for pcap files"`
+	Capture      string   `flag:"capture" val:"pcap" usage:"Capture backend of devices, pcap, or afpacket for AF_PACKET memory-mapped rings on Linux"`
+	BlockSize    int      `flag:"afpacket.block.size" val:"1048576" usage:"Bytes of a block of the AF_PACKET ring, a multiple of the page size"`
+	Blocks       int      `flag:"afpacket.blocks" val:"64" usage:"Blocks of the AF_PACKET ring of a socket"`
+	Fanout       int      `flag:"afpacket.fanout" val:"1" usage:"AF_PACKET sockets sharing the packets by flow hash, each with its ring and goroutine"`
+	Netns        string   `flag:"netns" val:"" usage:"Capture in the network namespace of the file, eg /proc/1234/ns/net or /var/run/netns/blue, Linux only"`
+	Pid          int      `flag:"pid" val:"0" usage:"Capture in the network namespace of the process, eg of a container, 0 for the current one, Linux only"`
+	Outs         []string `flag:"o" val:"" usage:"Outputs HTTP request/response, :\n stdout to print to stdout,\n stdlog to log,\nxx.http to create replay-able http file, \nxx.pcap to write captured packets as a pcap file, not with -redact, \nxx.json to create replay-able json file, \nxx.har to create HTTP Archive (HAR) file, \nxx.ndjson to write all events as JSON lines for analytics, \nxx.csv to write an HTTP transaction a row, \nxx.otlp to write HTTP transactions as OTLP JSON lines of spans, \nxx.dot to write the dependency graph as Graphviz DOT"`
+	Otlp         string   `flag:"otlp" val:"" usage:"Export HTTP transactions as OpenTelemetry spans to the OTLP/HTTP endpoint, eg http://localhost:4318, or the OTLP/gRPC endpoint, eg grpc://localhost:4317"`
 	ReplayAddr   string   `flag:"replay" val:"" usage:"Replay HTTP requests to the address, eg 127.0.0.1:5004"`
 	ReplayMethod string   `flag:"replay.method" val:"" usage:"Replay if HTTP request method matches, empty for ANY, eg POST,GET"`
 	WebPort      int      `flag:"p"  val:"0" usage:"Web server port. 0 for no web server"`
 	EventSize    int      `flag:"event.size" val:"1024" usage:"Event channel size"`
 	SnapLen      int      `flag:"snap.len" val:"65535" usage:"Snap length (max bytes per packet to capture)"`
+	MemTotal     int      `flag:"mem.total" val:"1024" usage:"MiB buffered by all the TCP streams, the oldest streams are dropped over it, 0 for unlimited"`
+	MemStream    int      `flag:"mem.stream" val:"64" usage:"MiB buffered by a TCP stream, bodies are truncated and headers dropped over it, 0 for unlimited"`
+	BodyRequest  int      `flag:"body.request" val:"0" usage:"KiB of a request body captured, the rest is truncated, 0 for unlimited"`
+	BodyResponse int      `flag:"body.response" val:"0" usage:"KiB of a response body captured, the rest is truncated, 0 for unlimited"`
+	BodyDir      string   `flag:"body.dir" val:"" usage:"Save the whole bodies over the limits to the directory by their SHA-256, downloadable from the web server at /body/<sha256>, not with -redact"`
+	BodyDirSize  int      `flag:"body.dir.size" val:"1024" usage:"MiB of the bodies saved to -body.dir, the oldest ones are removed over it, 0 for unlimited"`
+	Shards       int      `flag:"shards" val:"1" usage:"Assemble TCP streams by n goroutines sharded by the flow hash, 0 for the number of CPUs"`
 	SaveEvent    bool     `flag:"s" val:"false" usage:"Save HTTP event in server"`
+	ConnEvents   bool     `flag:"conn" val:"false" usage:"Emit TCP connection lifecycle events (open, close, reset, timeout)"`
+	Security     bool     `flag:"security" val:"false" usage:"Flag HTTP request smuggling and protocol ambiguities as findings"`
+	Audit        string   `flag:"audit" val:"" usage:"Audit HTTP transactions and write the report to the JSON file, eg audit.json"`
+	AuditRules   string   `flag:"audit.rules" val:"" usage:"Audit rules, empty for ALL, multiple separated by comma, eg basic-auth-cleartext,insecure-cookie"`
+	Report       string   `flag:"report" val:"" usage:"Print the traffic summary report to stderr at the end, and write it to the JSON file, eg report.json, - for no JSON"`
+	Redact       string   `flag:"redact" val:"" usage:"Redact sensitive data in all outputs by the rules of the JSON file, eg redact.json"`
+	Filter       string   `flag:"filter" val:"" usage:"Only capture HTTP transactions matching the filter expression, eg 'host == api.example.com and status >= 500'"`
+	Routes       []string `flag:"route" val:"" usage:"Route patterns to group URIs, eg /users/{id}, or OpenAPI files in JSON or YAML, eg openapi.yaml, numeric, UUID, hex and hash segments are normalized automatically"`
+	Names        []string `flag:"name" val:"" usage:"Name of addresses as addr=name, addr is IP, IP:port or CIDR, eg 10.0.0.5=orders"`
+	NamesFile    string   `flag:"names" val:"" usage:"Name addresses by the file of lines 'addr name', reloaded on change, eg names.txt"`
+	Hosts        string   `flag:"hosts" val:"" usage:"Name IPs by their hostnames in the hosts file, eg /etc/hosts"`
+	Processes    bool     `flag:"proc" val:"false" usage:"Attribute connections to the local processes and containers by /proc, Linux only"`
+	OutFilters   []string `flag:"o.filter" val:"" usage:"Filter of an output as output=expression, eg 'stdout=latency > 200ms', output is one of -o values, web, metrics, graph, otlp, replay, report or audit"`
+	QueueSize    int      `flag:"queue.size" val:"1024" usage:"Event queue size of each output, 0 to push events to outputs synchronously"`
+	QueuePolicy  []string `flag:"queue.policy" val:"block" usage:"Policy when the queue of an output is full, block, drop-oldest or drop-newest, or output=policy for an output, eg replay=drop-oldest"`
 	Version      bool     `flag:"v" val:"false" usage:"Show version"`
+
+	sharedReport httpstream.EventHandler // the report shared by the convert jobs, nil to create one
 }
 
 // VersionInfo gives the version information.
 func (a Arg) VersionInfo() string { return " v1.0.2 2021-05-19 22:35:41" }
 
-// NewPacketSource creates new packet source.
-func (a Arg) NewPacketSource() (*gopacket.PacketSource, error) {
-	return httpstream.NewPacketSource(a.Input, a.Bpf, a.SnapLen)
+// Options creates the options for httpstream.Run.
+func (a Arg) Options() httpstream.Options {
+	var filter *httpstream.Filter
+	if a.Filter != "" {
+		var err error
+		if filter, err = httpstream.ParseFilter(a.Filter); err != nil {
+			panic(err)
+		}
+	}
+
+	router := httpstream.NewRouter()
+	for _, r := range a.Routes {
+		if stat, err := os.Stat(r); err != nil || stat.IsDir() {
+			router.Add(r)
+			continue
+		}
+		routes, err := httpstream.LoadOpenAPI(r)
+		if err != nil {
+			panic(err)
+		}
+		for _, route := range routes {
+			router.Add(route)
+		}
+	}
+
+	names, err := httpstream.NewNames(a.Names, a.NamesFile, a.Hosts)
+	if err != nil {
+		panic(err)
+	}
+
+	if a.BodyDir != "" {
+		// the bodies are saved as they arrive, before the redaction of the events
+		if a.Redact != "" {
+			panic(fmt.Errorf("-body.dir saves the bodies unredacted, so it can not be used with -redact"))
+		}
+		if err := os.MkdirAll(a.BodyDir, 0o755); err != nil {
+			panic(err)
+		}
+	}
+
+	// the packets are written as they are captured, before the redaction of the events
+	if a.Redact != "" && httpstream.SuffixPcap.Find(a.Outs) != "" {
+		panic(fmt.Errorf("-o *.pcap writes the packets unredacted, so it can not be used with -redact"))
+	}
+
+	offline := httpstream.IsPcapFile(a.Input)
+	var processes *httpstream.Processes
+	if a.Processes && !offline { // the processes of the packets in files are gone
+		pid, err := a.netnsPid()
+		if err != nil {
+			panic(err)
+		}
+		if processes, err = httpstream.NewProcesses(pid); err != nil {
+			panic(err)
+		}
+	}
+
+	return httpstream.Options{
+		Filter:          filter,
+		Router:          router,
+		Names:           names,
+		Processes:       processes,
+		OutputPcap:      httpstream.SuffixPcap.Find(a.Outs),
+		SnapLen:         a.SnapLen,
+		Shards:          a.shards(),
+		MaxMemory:       a.MemTotal << 20,
+		MaxStreamMemory: a.MemStream << 20,
+		MaxRequestBody:  a.BodyRequest << 10,
+		MaxResponseBody: a.BodyResponse << 10,
+		BodyDir:         a.BodyDir,
+		MaxBodyDir:      a.BodyDirSize << 20,
+		OnlyRequests:    a.InputRequest,
+		OnlyMethod:      a.InputMethod,
+		ConnEvents:      a.ConnEvents,
+		Security:        a.Security,
+		Offline:         offline,
+	}
+}
+
+// NewPacketSource creates new packet source by the backend of -capture, in the network namespace of -netns or -pid.
+func (a Arg) NewPacketSource() (source httpstream.PacketSource, err error) {
+	netns := a.Netns
+	if a.Pid > 0 {
+		netns = fmt.Sprintf("/proc/%d/ns/net", a.Pid)
+	}
+
+	err = httpstream.InNetns(netns, func() (err error) {
+		switch {
+		case a.Capture == "afpacket" && !httpstream.IsPcapFile(a.Input):
+			source, err = httpstream.NewAfpacketSource(a.Input, a.Bpf, a.SnapLen,
+				httpstream.AfpacketOptions{BlockSize: a.BlockSize, Blocks: a.Blocks, Fanout: a.Fanout})
+		case a.Capture == "pcap" || a.Capture == "afpacket":
+			source, err = httpstream.NewPacketSource(a.Input, a.bpf(), a.SnapLen)
+		default:
+			err = fmt.Errorf("bad -capture %q, should be pcap or afpacket", a.Capture)
+		}
+		return err
+	})
+	return source, err
+}
+
+// shards returns -shards, the number of CPUs for 0.
+func (a Arg) shards() int {
+	if a.Shards == 0 {
+		return runtime.NumCPU()
+	}
+	return a.Shards
+}
+
+// defaultBpf is the default of -bpf, for the live capture only.
+const defaultBpf = "tcp and dst port 80"
+
+// bpf returns -bpf, but not the default one for pcap files, which are read unfiltered unless -bpf is set.
+func (a Arg) bpf() string {
+	if a.Bpf == defaultBpf && httpstream.IsPcapFile(a.Input) {
+		return ""
+	}
+	return a.Bpf
+}
+
+var reProcNetns = regexp.MustCompile(`^/proc/(\d+)/ns/net$`)
+
+// netnsPid returns the process of the network namespace of -netns or -pid, 0 for the current one.
+func (a Arg) netnsPid() (int, error) {
+	if a.Pid > 0 || a.Netns == "" {
+		return a.Pid, nil
+	}
+	if m := reProcNetns.FindStringSubmatch(a.Netns); m != nil {
+		return strconv.Atoi(m[1])
+	}
+	return 0, fmt.Errorf("-proc needs -pid, or -netns of /proc/<pid>/ns/net, to know the sockets of %s", a.Netns)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		os.Exit(convert(os.Args[1:]))
+	}
+
 	var a Arg
 	flagparse.Parse(&a)
 
@@ -41,36 +208,142 @@ func main() {
 		panic(err)
 	}
 
-	eventChan := make(chan interface{}, a.EventSize)
+	eventChan := make(chan httpstream.Event, a.EventSize)
 
-	go httpstream.Run(source, httpstream.SuffixPcap.Find(a.Outs), eventChan, a.SnapLen, a.InputRequest, a.InputMethod)
+	go httpstream.Run(source, eventChan, a.Options())
 
 	a.createHandlers().Run(eventChan)
 }
 
+// reportHandler creates the report handler, or returns the shared one.
+func (a Arg) reportHandler() httpstream.EventHandler {
+	if a.sharedReport != nil {
+		return a.sharedReport
+	}
+	if a.Report == "-" {
+		return httpstream.NewEventReport("", os.Stderr)
+	}
+	return httpstream.NewEventReport(a.Report, os.Stderr)
+}
+
+// outFilters parses the filters of outputs, keyed by the output.
+func (a Arg) outFilters() map[string]*httpstream.Filter {
+	filters := make(map[string]*httpstream.Filter)
+	for _, v := range a.OutFilters {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			panic(fmt.Errorf("bad -o.filter %q, should be output=expression", v))
+		}
+		f, err := httpstream.ParseFilter(kv[1])
+		if err != nil {
+			panic(err)
+		}
+		filters[strings.TrimSpace(kv[0])] = f
+	}
+	return filters
+}
+
+// queuePolicies parses the queue policies, keyed by the output, the default policy is keyed by "".
+func (a Arg) queuePolicies() map[string]httpstream.QueuePolicy {
+	policies := make(map[string]httpstream.QueuePolicy)
+	for _, v := range a.QueuePolicy {
+		output, policy := "", v
+		if p := strings.LastIndex(v, "="); p >= 0 {
+			output, policy = strings.TrimSpace(v[:p]), v[p+1:]
+		}
+		qp, err := httpstream.ParseQueuePolicy(strings.TrimSpace(policy))
+		if err != nil {
+			panic(err)
+		}
+		policies[output] = qp
+	}
+	return policies
+}
+
 func (a Arg) createHandlers() (hs httpstream.EventHandlers) {
+	filters := a.outFilters()
+	policies := a.queuePolicies()
+	add := func(output string, h httpstream.EventHandler) {
+		if f, ok := filters[output]; ok {
+			h = httpstream.NewFilteredHandler(f, h)
+		}
+		if a.QueueSize > 0 {
+			policy, ok := policies[output]
+			if !ok {
+				policy = policies[""]
+			}
+			h = httpstream.NewQueuedHandler(output, h, a.QueueSize, policy)
+		}
+		hs = append(hs, h)
+	}
+
 	if a.WebPort > 0 {
-		hs = append(hs, NewNGServer(fmt.Sprintf(":%d", a.WebPort), a.SaveEvent))
+		metrics, graph := httpstream.NewEventMetrics(), httpstream.NewEventGraph("")
+		add("web", NewNGServer(fmt.Sprintf(":%d", a.WebPort), a.SaveEvent, metrics, graph, a.BodyDir))
+		add("metrics", metrics)
+		add("graph", graph)
 	}
 
 	if v := httpstream.SuffixStdLog.Find(a.Outs); v != "" {
-		hs = append(hs, httpstream.NewEventLog())
+		add(v, httpstream.NewEventLog())
 	}
 	if v := httpstream.SuffixStdout.Find(a.Outs); v != "" {
-		hs = append(hs, httpstream.NewEventStdout())
+		add(v, httpstream.NewEventStdout())
 	}
 	if v := httpstream.SuffixJson.Find(a.Outs); v != "" {
-		hs = append(hs, httpstream.NewEventJson(v))
+		add(v, httpstream.NewEventJson(v))
 	}
 	if v := httpstream.SuffixLog.Find(a.Outs); v != "" {
-		hs = append(hs, httpstream.NewEventLogFile(v))
+		add(v, httpstream.NewEventLogFile(v))
 	}
 	if v := httpstream.SuffixHttp.Find(a.Outs); v != "" {
-		hs = append(hs, httpstream.NewEventHttp(v))
+		add(v, httpstream.NewEventHttp(v))
+	}
+	if v := httpstream.SuffixNdjson.Find(a.Outs); v != "" {
+		add(v, httpstream.NewEventNdjson(v))
+	}
+	if v := httpstream.SuffixHar.Find(a.Outs); v != "" {
+		add(v, httpstream.NewEventHar(v))
+	}
+	if v := httpstream.SuffixCsv.Find(a.Outs); v != "" {
+		add(v, httpstream.NewEventCsv(v))
+	}
+	if v := httpstream.SuffixDot.Find(a.Outs); v != "" {
+		add(v, httpstream.NewEventGraph(v))
+	}
+	if v := httpstream.SuffixOtlp.Find(a.Outs); v != "" {
+		add(v, httpstream.NewEventOtlp(v))
+	}
+	if a.Otlp != "" {
+		if !httpstream.IsOtlpEndpoint(a.Otlp) {
+			panic(fmt.Errorf("bad -otlp %q, should be an http://, https://, grpc:// or grpcs:// endpoint", a.Otlp))
+		}
+		add("otlp", httpstream.NewEventOtlp(a.Otlp))
 	}
 
 	if a.ReplayAddr != "" {
-		hs = append(hs, httpstream.NewEventReplay(a.ReplayAddr, a.ReplayMethod))
+		add("replay", httpstream.NewEventReplay(a.ReplayAddr, a.ReplayMethod))
+	}
+
+	if a.Report != "" {
+		add("report", a.reportHandler())
+	}
+
+	if a.Audit != "" {
+		// findings are pushed to the handlers above, eg. the web server and stdout.
+		audit, err := httpstream.NewEventAudit(a.Audit, a.AuditRules, hs.PushEvent)
+		if err != nil {
+			panic(err)
+		}
+		add("audit", audit)
+	}
+
+	if a.Redact != "" {
+		r, err := httpstream.LoadRedactor(a.Redact)
+		if err != nil {
+			panic(err)
+		}
+		hs = httpstream.EventHandlers{r.Wrap(hs)}
 	}
 
 	return hs
@@ -0,0 +1,152 @@
+//go:build linux && !nopcap
+// +build linux,!nopcap
+
+package httpstream
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// afpacketSource reads the packets from the memory-mapped rings of the AF_PACKET sockets in a fanout group,
+// a goroutine a socket.
+type afpacketSource struct {
+	handles []*afpacket.TPacket
+	packets chan gopacket.Packet
+}
+
+// NewAfpacketSource creates a PacketSource of the device by AF_PACKET with TPACKET_V3 rings, "any" for all devices.
+// The ring of a socket is opt.BlockSize * opt.Blocks bytes, and opt.Fanout sockets share the packets by the flow hash.
+func NewAfpacketSource(device, bpfExpr string, snapLen int, opt AfpacketOptions) (PacketSource, error) {
+	if device == "" {
+		device = AutoSelectDev()
+	}
+	if opt.Fanout < 1 {
+		opt.Fanout = 1
+	}
+
+	var filter []bpf.RawInstruction
+	if bpfExpr != "" {
+		instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snapLen, bpfExpr)
+		if err != nil {
+			return nil, fmt.Errorf("compile BPF %q, error: %w", bpfExpr, err)
+		}
+		for _, ins := range instructions {
+			filter = append(filter, bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K})
+		}
+	}
+
+	opts, err := afpacketOptions(device, snapLen, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &afpacketSource{packets: make(chan gopacket.Packet, 1000)}
+	for i := 0; i < opt.Fanout; i++ {
+		h, err := afpacket.NewTPacket(opts...)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("open AF_PACKET on %s, error: %w", device, err)
+		}
+		s.handles = append(s.handles, h)
+
+		if filter != nil {
+			if err := h.SetBPF(filter); err != nil {
+				s.close()
+				return nil, fmt.Errorf("set BPF %q, error: %w", bpfExpr, err)
+			}
+		}
+		if opt.Fanout > 1 {
+			// the hash keeps both directions of a connection in a socket.
+			if err := h.SetFanout(afpacket.FanoutHashWithDefrag, uint16(os.Getpid())); err != nil {
+				s.close()
+				return nil, fmt.Errorf("set fanout, error: %w", err)
+			}
+		}
+	}
+
+	registerCapture(device, s.stats)
+	s.start()
+	return s, nil
+}
+
+// afpacketFrameHeadroom is the room for the TPACKET_V3 header and the link-layer address before the packet in a frame.
+const afpacketFrameHeadroom = 128
+
+// afpacketOptions returns the TPacket options of the device, the frame size fits the snap length and the headroom,
+// rounded up to a power of two, so that it divides the block size.
+func afpacketOptions(device string, snapLen int, opt AfpacketOptions) ([]interface{}, error) {
+	opts := []interface{}{afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptBlockSize(opt.BlockSize), afpacket.OptNumBlocks(opt.Blocks)}
+	if snapLen > 0 {
+		frameSize := os.Getpagesize()
+		for frameSize < snapLen+afpacketFrameHeadroom {
+			frameSize <<= 1
+		}
+		if opt.BlockSize%frameSize != 0 {
+			return nil, fmt.Errorf("AF_PACKET block size %d should be a multiple of the frame size %d of snap length %d",
+				opt.BlockSize, frameSize, snapLen)
+		}
+		opts = append(opts, afpacket.OptFrameSize(frameSize))
+	}
+	if device != "any" {
+		opts = append(opts, afpacket.OptInterface(device))
+	}
+	return opts, nil
+}
+
+func (s *afpacketSource) start() {
+	var wg sync.WaitGroup
+	for _, h := range s.handles {
+		wg.Add(1)
+		go func(h *afpacket.TPacket) {
+			defer wg.Done()
+			for p := range gopacket.NewPacketSource(h, layers.LinkTypeEthernet).Packets() {
+				s.packets <- p
+			}
+		}(h)
+	}
+
+	go func() {
+		wg.Wait()
+		close(s.packets)
+	}()
+}
+
+// Packets returns the channel of the packets of all the sockets.
+func (s *afpacketSource) Packets() chan gopacket.Packet { return s.packets }
+
+// stats sums the statistics of the sockets, which are accumulated by TPacket since the kernel resets them on read.
+func (s *afpacketSource) stats() (CaptureStats, error) {
+	return sumSocketStats(len(s.handles), func(i int) (packets, drops uint, err error) {
+		_, v3, err := s.handles[i].SocketStats()
+		return v3.Packets(), v3.Drops(), err
+	})
+}
+
+// sumSocketStats sums the packets received and dropped by the n sockets, counted by counts.
+func sumSocketStats(n int, counts func(i int) (packets, drops uint, err error)) (CaptureStats, error) {
+	var stats CaptureStats
+	for i := 0; i < n; i++ {
+		packets, drops, err := counts(i)
+		if err != nil {
+			return CaptureStats{}, err
+		}
+		stats.Received += int(packets)
+		stats.Dropped += int(drops)
+	}
+	return stats, nil
+}
+
+func (s *afpacketSource) close() {
+	for _, h := range s.handles {
+		h.Close()
+	}
+}
@@ -0,0 +1,54 @@
+//go:build linux && !nopcap
+// +build linux,!nopcap
+
+package httpstream
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/afpacket"
+)
+
+func TestAfpacketOptions(t *testing.T) {
+	page := os.Getpagesize()
+	opt := AfpacketOptions{BlockSize: 1 << 20, Blocks: 64}
+	common := []interface{}{afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptBlockSize(1 << 20), afpacket.OptNumBlocks(64)}
+
+	cases := []struct {
+		device  string
+		snapLen int
+		extra   []interface{}
+	}{
+		{"eth0", 65535, []interface{}{afpacket.OptFrameSize(1 << 17), afpacket.OptInterface("eth0")}},
+		{"any", 1500, []interface{}{afpacket.OptFrameSize(page)}},
+		{"any", 0, nil},
+	}
+	for _, c := range cases {
+		opts, err := afpacketOptions(c.device, c.snapLen, opt)
+		expected := append(append([]interface{}(nil), common...), c.extra...)
+		if err != nil || !reflect.DeepEqual(opts, expected) {
+			t.Errorf("%s/%d: options %v, error: %v, expected %v", c.device, c.snapLen, opts, err, expected)
+		}
+	}
+
+	if _, err := afpacketOptions("eth0", 65535, AfpacketOptions{BlockSize: 1 << 16, Blocks: 64}); err == nil {
+		t.Error("no error of the block size smaller than the frame size")
+	}
+}
+
+func TestSumSocketStats(t *testing.T) {
+	counts := [][2]uint{{100, 1}, {50, 0}, {7, 3}}
+	stats, err := sumSocketStats(len(counts), func(i int) (uint, uint, error) { return counts[i][0], counts[i][1], nil })
+	if err != nil || stats.Received != 157 || stats.Dropped != 4 {
+		t.Errorf("stats %+v, error: %v", stats, err)
+	}
+
+	failed := errors.New("closed")
+	if _, err := sumSocketStats(2, func(i int) (uint, uint, error) { return 0, 0, failed }); err != failed {
+		t.Errorf("error %v, expected %v", err, failed)
+	}
+}
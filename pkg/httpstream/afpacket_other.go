@@ -0,0 +1,11 @@
+//go:build !linux || nopcap
+// +build !linux nopcap
+
+package httpstream
+
+import "errors"
+
+// NewAfpacketSource creates a PacketSource by AF_PACKET, which is only supported on Linux, built without the nopcap tag.
+func NewAfpacketSource(device, bpfExpr string, snapLen int, opt AfpacketOptions) (PacketSource, error) {
+	return nil, errors.New("AF_PACKET capture is only supported on Linux, built without the nopcap tag")
+}
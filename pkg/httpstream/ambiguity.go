@@ -0,0 +1,165 @@
+package httpstream
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Severity is the severity of a finding.
+type Severity string
+
+const (
+	SeverityLow    Severity = "low"
+	SeverityMedium Severity = "medium"
+	SeverityHigh   Severity = "high"
+)
+
+// FindingCategoryAmbiguity is the category of HTTP request smuggling and protocol ambiguity findings.
+const FindingCategoryAmbiguity = "ambiguity"
+
+// Protocol ambiguity rules of the passive security mode.
+const (
+	RuleCLTEConflict     = "cl-te-conflict"
+	RuleDuplicateCL      = "duplicate-content-length"
+	RuleObfuscatedTE     = "obfuscated-transfer-encoding"
+	RuleObsFold          = "obsolete-line-folding"
+	RuleBareLF           = "bare-lf"
+	RuleInvalidChunkExt  = "invalid-chunk-extension"
+	RuleOversizedHeaders = "oversized-headers"
+)
+
+// maxHeaderBytes is the header size above which RuleOversizedHeaders is reported,
+// the same as the default of net/http.
+const maxHeaderBytes = http.DefaultMaxHeaderBytes
+
+// FindingEvent is a security finding on the captured traffic.
+type FindingEvent struct {
+	UID        string
+	Category   string
+	Rule       string
+	Severity   Severity
+	Time       time.Time
+	StreamSeq  uint
+	ID         int // the transaction, 0 if unknown
+	ClientAddr string
+	ServerAddr string
+	ClientName string // the name of ClientAddr, empty if unknown
+	ServerName string // the name of ServerAddr, empty if unknown
+	Detail     string
+}
+
+func (r FindingEvent) WriteTo(out io.Writer) (n int64, err error) {
+	m, err := fmt.Fprintf(out, "#%d [%s] Finding %s/%s %s %s->%s %s\r\n\r\n", r.StreamSeq,
+		r.Time.Format(layout), r.Category, r.Rule, r.Severity, namedAddr(r.ClientAddr, r.ClientName),
+		namedAddr(r.ServerAddr, r.ServerName), r.Detail)
+	return int64(m), err
+}
+
+// ambiguity is a protocol ambiguity found when parsing a message.
+type ambiguity struct {
+	rule     string
+	severity Severity
+	detail   string
+}
+
+func (s *httpStream) flag(rule string, severity Severity, format string, a ...interface{}) {
+	s.ambiguities = append(s.ambiguities, ambiguity{rule: rule, severity: severity, detail: fmt.Sprintf(format, a...)})
+}
+
+func (s *httpStream) inspectLine(stage ParseStage, line []byte) {
+	if i := bytes.IndexByte(line, '\n'); i >= 0 && i < len(line)-1 {
+		s.flag(RuleBareLF, SeverityMedium, "bare LF in %s: %q", stage, line)
+	}
+}
+
+func (s *httpStream) inspectHeader(raw []byte) {
+	if len(raw) > maxHeaderBytes {
+		s.flag(RuleOversizedHeaders, SeverityLow, "headers of %d bytes exceed %d", len(raw), maxHeaderBytes)
+	}
+
+	for i, line := range bytes.Split(raw[:len(raw)-4], []byte("\r\n")) {
+		if bytes.IndexByte(line, '\n') >= 0 {
+			s.flag(RuleBareLF, SeverityMedium, "bare LF in header line %d: %q", i, line)
+		}
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			s.flag(RuleObsFold, SeverityMedium, "obsolete line folding in header line %d: %q", i, line)
+		}
+	}
+}
+
+func (s *httpStream) inspectContentInfo(header http.Header) {
+	cl, te := header.Values("Content-Length"), header.Values("Transfer-Encoding")
+	if len(cl) > 0 && len(te) > 0 {
+		s.flag(RuleCLTEConflict, SeverityHigh, "Content-Length %q with Transfer-Encoding %q", cl, te)
+	}
+
+	if lengths := strings.Split(strings.Join(cl, ","), ","); len(lengths) > 1 {
+		severity := SeverityMedium
+		for _, l := range lengths[1:] {
+			if strings.TrimSpace(l) != strings.TrimSpace(lengths[0]) {
+				severity = SeverityHigh
+			}
+		}
+		s.flag(RuleDuplicateCL, severity, "Content-Length %q", cl)
+	}
+
+	for _, v := range te {
+		for _, coding := range strings.Split(v, ",") {
+			if !transferCodings[strings.Trim(coding, " ")] {
+				s.flag(RuleObfuscatedTE, SeverityHigh, "Transfer-Encoding %q", v)
+				break
+			}
+		}
+	}
+}
+
+var (
+	// transferCodings are the registered transfer codings in the exact form, others may be obfuscated.
+	transferCodings = map[string]bool{"chunked": true, "compress": true, "deflate": true, "gzip": true}
+	// chunkExt matches the chunk extensions of RFC 7230 4.1.1, with optional whitespaces (BWS).
+	chunkExt = regexp.MustCompile(`^(\s*;\s*` + token + `(\s*=\s*(` + token + `|"([^"\\]|\\.)*"))?)*\s*$`)
+)
+
+const token = "[!#$%&'*+.^_`|~0-9A-Za-z-]+"
+
+func (s *httpStream) inspectChunkExt(ext string) {
+	if !chunkExt.MatchString(ext) {
+		s.flag(RuleInvalidChunkExt, SeverityMedium, "invalid chunk extension %q", ext)
+	}
+}
+
+// emitFindings emits the ambiguities found in the message of stream as FindingEvent.
+func (p *pair) emitFindings(s *httpStream, id int, dir Direction) {
+	if len(s.ambiguities) == 0 {
+		return
+	}
+
+	clientAddr, serverAddr := s.key.src(), s.key.dst()
+	if dir == DirectionResponse {
+		clientAddr, serverAddr = serverAddr, clientAddr
+	}
+
+	for _, a := range s.ambiguities {
+		p.eventChan <- FindingEvent{
+			UID:        newEventUID(),
+			Category:   FindingCategoryAmbiguity,
+			Rule:       a.rule,
+			Severity:   a.severity,
+			Time:       s.reader.lastByte,
+			StreamSeq:  p.connSeq,
+			ID:         id,
+			ClientAddr: clientAddr,
+			ServerAddr: serverAddr,
+			ClientName: p.names.Name(clientAddr),
+			ServerName: p.names.Name(serverAddr),
+			Detail:     a.detail,
+		}
+	}
+
+	s.ambiguities = s.ambiguities[:0]
+}
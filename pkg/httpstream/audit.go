@@ -0,0 +1,295 @@
+package httpstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FindingCategoryAudit is the category of the findings of audit rules.
+const FindingCategoryAudit = "audit"
+
+// AuditRule checks HTTP messages of the captured traffic.
+type AuditRule struct {
+	Name     string
+	Severity Severity
+	// OnResponse tells the rule checks responses, the request of the response may be nil if it is not captured.
+	OnResponse bool
+	// Check returns the details of the findings.
+	Check func(req *RequestEvent, rsp *ResponseEvent) []string
+}
+
+var (
+	credentialParams = []string{"password", "passwd", "pwd", "token", "access_token", "api_key", "apikey", "secret"}
+	securityHeaders  = []string{"Strict-Transport-Security", "Content-Security-Policy", "X-Content-Type-Options"}
+	stackTrace       = regexp.MustCompile(`Traceback \(most recent call last\)|Exception in thread "|` +
+		`\n\s+at [\w$.]+\([\w$]+\.java:\d+\)|goroutine \d+ \[running\]|\.php on line \d+|` +
+		`System\.\w+Exception:|Fatal error: Uncaught`)
+	internalIP = regexp.MustCompile(`\b(10\.\d{1,3}\.\d{1,3}\.\d{1,3}|192\.168\.\d{1,3}\.\d{1,3}|` +
+		`172\.(1[6-9]|2\d|3[01])\.\d{1,3}\.\d{1,3})\b`)
+	versionDisclosure = regexp.MustCompile(`\d+\.\d+`)
+)
+
+// DefaultAuditRules is the rule set of the passive security audit.
+var DefaultAuditRules = []AuditRule{
+	{Name: "basic-auth-cleartext", Severity: SeverityHigh, Check: func(req *RequestEvent, _ *ResponseEvent) []string {
+		return headerPrefixed(req.Header, "Authorization", "Basic ")
+	}},
+	{Name: "bearer-token-cleartext", Severity: SeverityMedium, Check: func(req *RequestEvent, _ *ResponseEvent) []string {
+		return headerPrefixed(req.Header, "Authorization", "Bearer ")
+	}},
+	{Name: "credential-in-query", Severity: SeverityHigh, Check: func(req *RequestEvent, _ *ResponseEvent) (details []string) {
+		u, err := url.ParseRequestURI(req.URI)
+		if err != nil {
+			return nil
+		}
+		for name := range u.Query() {
+			for _, p := range credentialParams {
+				if strings.EqualFold(name, p) {
+					details = append(details, "query parameter "+name)
+				}
+			}
+		}
+		return details
+	}},
+	{Name: "insecure-cookie", Severity: SeverityMedium, OnResponse: true, Check: func(_ *RequestEvent, rsp *ResponseEvent) (details []string) {
+		for _, c := range rsp.Header.Values("Set-Cookie") {
+			if missing := missingCookieAttrs(c); len(missing) > 0 {
+				name := strings.TrimSpace(strings.SplitN(c, "=", 2)[0])
+				details = append(details, fmt.Sprintf("cookie %s without %s", name, strings.Join(missing, ", ")))
+			}
+		}
+		return details
+	}},
+	{Name: "missing-security-headers", Severity: SeverityLow, OnResponse: true, Check: func(_ *RequestEvent, rsp *ResponseEvent) []string {
+		if !strings.HasPrefix(rsp.Code, "2") {
+			return nil
+		}
+		var missing []string
+		for _, h := range securityHeaders {
+			if rsp.Header.Get(h) == "" {
+				missing = append(missing, h)
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		return []string{"missing " + strings.Join(missing, ", ")}
+	}},
+	{Name: "stack-trace-disclosure", Severity: SeverityMedium, OnResponse: true, Check: func(_ *RequestEvent, rsp *ResponseEvent) []string {
+		if m := stackTrace.Find(rsp.Body); m != nil {
+			return []string{fmt.Sprintf("stack trace %q in response body", strings.TrimSpace(string(m)))}
+		}
+		return nil
+	}},
+	{Name: "internal-ip-disclosure", Severity: SeverityLow, OnResponse: true, Check: func(_ *RequestEvent, rsp *ResponseEvent) []string {
+		if m := internalIP.Find(rsp.Body); m != nil {
+			return []string{fmt.Sprintf("internal IP %s in response body", m)}
+		}
+		return nil
+	}},
+	{Name: "server-version-disclosure", Severity: SeverityLow, OnResponse: true, Check: func(_ *RequestEvent, rsp *ResponseEvent) (details []string) {
+		for _, h := range []string{"Server", "X-Powered-By", "X-AspNet-Version"} {
+			if v := rsp.Header.Get(h); versionDisclosure.MatchString(v) {
+				details = append(details, fmt.Sprintf("%s: %s", h, v))
+			}
+		}
+		return details
+	}},
+}
+
+func headerPrefixed(header http.Header, name, prefix string) []string {
+	if v := header.Get(name); len(v) >= len(prefix) && strings.EqualFold(v[:len(prefix)], prefix) {
+		return []string{name + " " + strings.TrimSpace(prefix)}
+	}
+	return nil
+}
+
+func missingCookieAttrs(setCookie string) (missing []string) {
+	attrs := make(map[string]bool)
+	for _, a := range strings.Split(setCookie, ";")[1:] {
+		attrs[strings.ToLower(strings.TrimSpace(strings.SplitN(a, "=", 2)[0]))] = true
+	}
+	for _, a := range []string{"Secure", "HttpOnly", "SameSite"} {
+		if !attrs[strings.ToLower(a)] {
+			missing = append(missing, a)
+		}
+	}
+	return missing
+}
+
+// AuditRecord is a finding of the audit report, the same findings on a server are merged.
+type AuditRecord struct {
+	Rule       string    `json:"rule"`
+	Severity   Severity  `json:"severity"`
+	ServerAddr string    `json:"server"`
+	ClientAddr string    `json:"client"`
+	Detail     string    `json:"detail"`
+	Example    string    `json:"example"`
+	Count      int       `json:"count"`
+	First      time.Time `json:"first"`
+	Last       time.Time `json:"last"`
+}
+
+// AuditReport is the report file of EventAudit.
+type AuditReport struct {
+	Generated time.Time      `json:"generated"`
+	Findings  []*AuditRecord `json:"findings"`
+}
+
+// EventAudit checks HTTP transactions against the audit rules.
+type EventAudit struct {
+	filename string
+	rules    []AuditRule
+	emit     func(Event)
+	pending  *pairer // of RequestEvent
+	records  map[string]*AuditRecord
+}
+
+// NewEventAudit creates EventAudit, which writes the report to filename at the end,
+// and emits the new findings to emit. ruleNames selects the rules, separated by comma, empty for all.
+func NewEventAudit(filename, ruleNames string, emit func(Event)) (*EventAudit, error) {
+	a := &EventAudit{
+		filename: filename,
+		emit:     emit,
+		pending:  newPairer(maxPending, nil),
+		records:  make(map[string]*AuditRecord),
+	}
+
+	selected := make(map[string]bool)
+	for _, n := range strings.Split(ruleNames, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			selected[n] = true
+		}
+	}
+	names := make([]string, len(DefaultAuditRules))
+	for i, r := range DefaultAuditRules {
+		names[i] = r.Name
+		if len(selected) == 0 || selected[r.Name] {
+			a.rules = append(a.rules, r)
+			delete(selected, r.Name)
+		}
+	}
+	if len(selected) > 0 {
+		unknown := make([]string, 0, len(selected))
+		for n := range selected {
+			unknown = append(unknown, n)
+		}
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown audit rules %s, should be of %s",
+			strings.Join(unknown, ","), strings.Join(names, ","))
+	}
+
+	return a, nil
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (a *EventAudit) PushEvent(e Event) {
+	switch v := e.(type) {
+	case RequestEvent:
+		a.check(&v, nil, v.Message)
+		a.pending.add(v.Message, v)
+	case ResponseEvent:
+		if value, ok := a.pending.take(v.Message); ok {
+			req := value.(RequestEvent)
+			a.check(&req, &v, v.Message)
+		} else {
+			a.check(nil, &v, v.Message)
+		}
+	default:
+		// bypass
+	}
+}
+
+func (a *EventAudit) check(req *RequestEvent, rsp *ResponseEvent, e Message) {
+	example := ""
+	if req != nil {
+		example = req.Method + " " + req.URI
+	}
+
+	for _, r := range a.rules {
+		if r.OnResponse && rsp == nil || !r.OnResponse && rsp != nil {
+			continue
+		}
+
+		for _, detail := range r.Check(req, rsp) {
+			a.record(r, e, detail, example)
+		}
+	}
+}
+
+func (a *EventAudit) record(r AuditRule, e Message, detail, example string) {
+	key := r.Name + "\x00" + e.ServerAddr + "\x00" + detail
+	if rec, ok := a.records[key]; ok {
+		rec.Count++
+		rec.Last = e.End
+		return
+	}
+
+	a.records[key] = &AuditRecord{Rule: r.Name, Severity: r.Severity, ServerAddr: e.ServerAddr, ClientAddr: e.ClientAddr,
+		Detail: detail, Example: example, Count: 1, First: e.End, Last: e.End}
+
+	if a.emit != nil {
+		a.emit(FindingEvent{
+			UID:        newEventUID(),
+			Category:   FindingCategoryAudit,
+			Rule:       r.Name,
+			Severity:   r.Severity,
+			Time:       e.End,
+			StreamSeq:  e.StreamSeq,
+			ID:         e.ID,
+			ClientAddr: e.ClientAddr,
+			ServerAddr: e.ServerAddr,
+			ClientName: e.ClientName,
+			ServerName: e.ServerName,
+			Detail:     detail,
+		})
+	}
+}
+
+var severityOrder = map[Severity]int{SeverityHigh: 0, SeverityMedium: 1, SeverityLow: 2}
+
+// Report returns the audit report, ordered by severity and count.
+func (a *EventAudit) Report() AuditReport {
+	r := AuditReport{Generated: time.Now(), Findings: make([]*AuditRecord, 0, len(a.records))}
+	for _, rec := range a.records {
+		r.Findings = append(r.Findings, rec)
+	}
+
+	sort.Slice(r.Findings, func(i, j int) bool {
+		fi, fj := r.Findings[i], r.Findings[j]
+		if si, sj := severityOrder[fi.Severity], severityOrder[fj.Severity]; si != sj {
+			return si < sj
+		}
+		if fi.Count != fj.Count {
+			return fi.Count > fj.Count
+		}
+		return fi.First.Before(fj.First)
+	})
+
+	return r
+}
+
+// Wait implements the function of interface EventHandler.
+func (a *EventAudit) Wait() {
+	f, err := os.Create(a.filename)
+	if err != nil {
+		log.Printf("E! Cannot create audit report %s, error: %v", a.filename, err)
+		return
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(a.Report()); err != nil {
+		log.Printf("E! Write audit report %s, error: %v", a.filename, err)
+	}
+}
@@ -0,0 +1,53 @@
+package httpstream
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEventAudit(t *testing.T) {
+	var findings []FindingEvent
+	a, err := NewEventAudit("", "", func(e Event) { findings = append(findings, e.(FindingEvent)) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := RequestEvent{Method: "GET", URI: "/login?user=a&password=b", Message: Message{StreamSeq: 1, ID: 1,
+		ServerAddr: "10.0.0.1:80", Header: http.Header{"Authorization": {"Basic YTpi"}}}}
+	rsp := ResponseEvent{Code: "200", Message: Message{StreamSeq: 1, ID: 1, ServerAddr: "10.0.0.1:80",
+		Header: http.Header{
+			"Set-Cookie": {"sid=1; HttpOnly; Secure; SameSite=Lax", "lang=en; Path=/"},
+			"Server":     {"nginx/1.18.0"},
+		},
+		Body: []byte("upstream 192.168.1.20 failed")}}
+
+	a.PushEvent(req)
+	a.PushEvent(rsp)
+	a.PushEvent(req)
+
+	rules := make(map[string]int)
+	for _, f := range findings {
+		rules[f.Rule]++
+	}
+
+	for _, r := range []string{"basic-auth-cleartext", "credential-in-query", "insecure-cookie",
+		"missing-security-headers", "internal-ip-disclosure", "server-version-disclosure"} {
+		if rules[r] != 1 {
+			t.Errorf("rule %s: %d findings", r, rules[r])
+		}
+	}
+
+	if rules["stack-trace-disclosure"] != 0 || rules["bearer-token-cleartext"] != 0 {
+		t.Errorf("unexpected findings: %v", rules)
+	}
+
+	if r := a.Report(); r.Findings[0].Severity != SeverityHigh || r.Findings[0].Count != 2 {
+		t.Errorf("unexpected report: %+v", r.Findings[0])
+	}
+
+	if _, err := NewEventAudit("", "basic-auth-cleartext, cors-wildcrd", nil); err == nil ||
+		!strings.Contains(err.Error(), "cors-wildcrd") || !strings.Contains(err.Error(), "insecure-cookie") {
+		t.Errorf("unknown rule error: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+//go:build bench
+// +build bench
+
+package httpstream
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// packetChan is a PacketSource of the packets in memory.
+type packetChan chan gopacket.Packet
+
+func (c packetChan) Packets() chan gopacket.Packet { return c }
+
+func newPacketChan(packets []gopacket.Packet) packetChan {
+	c := make(packetChan, len(packets))
+	for _, p := range packets {
+		c <- p
+	}
+	close(c)
+	return c
+}
+
+// BenchmarkShards feeds the packets of dump.pcap to the pipelines of shards, which gain on multiple cores.
+func BenchmarkShards(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	ps, err := NewPacketSource("testdata/dump.pcap", "", 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var packets []gopacket.Packet
+	for p := range ps.Packets() {
+		packets = append(packets, p)
+	}
+
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			eventChan := make(chan Event, 1024)
+			p, err := NewPipeline(eventChan, Options{Offline: true, Shards: shards})
+			if err != nil {
+				b.Fatal(err)
+			}
+			go func() {
+				for range eventChan {
+				}
+			}()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c := newPacketChan(packets)
+				b.StartTimer()
+				p.Feed(c)
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(len(packets)*b.N)/b.Elapsed().Seconds(), "packets/s")
+			p.Close()
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package httpstream
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// the counters of the bodies over the limits, accessed atomically.
+	limitedBodies, spilledBodies uint64
+)
+
+// bodyLimits are the limits of the bodies captured, see Options.
+type bodyLimits struct {
+	request, response int      // bytes, 0 for unlimited
+	dir               *bodyDir // the directory of the spilled bodies, nil for none
+}
+
+func (l *bodyLimits) limit(isRequest bool) int {
+	switch {
+	case l == nil:
+		return 0
+	case isRequest:
+		return l.request
+	default:
+		return l.response
+	}
+}
+
+func (l *bodyLimits) spillDir() *bodyDir {
+	if l == nil {
+		return nil
+	}
+	return l.dir
+}
+
+var errBodyDirFull = errors.New("over the size of the body directory")
+
+// bodyDir is the directory of the spilled bodies, whose files are limited to max bytes, 0 for unlimited.
+// The oldest bodies are removed for the new ones over max, and a body is not spilled if it is over max itself.
+type bodyDir struct {
+	path string
+	max  int64
+
+	mu     sync.Mutex
+	used   int64                    // the bytes of the bodies and the ones being spilled
+	bodies *list.List               // of *spilledBody, the oldest first
+	files  map[string]*list.Element // by SHA-256
+}
+
+type spilledBody struct {
+	sha  string
+	size int64
+}
+
+// newBodyDir creates bodyDir of path with the bodies spilled before, nil if path is empty.
+func newBodyDir(path string, max int64) *bodyDir {
+	if path == "" {
+		return nil
+	}
+	d := &bodyDir{path: path, max: max, bodies: list.New(), files: make(map[string]*list.Element)}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		log.Printf("E! read body directory %s, error: %v", path, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ModTime().Before(entries[j].ModTime()) })
+	for _, e := range entries {
+		if e.Mode().IsRegular() && bodySHA256.MatchString(e.Name()) && d.reserve(e.Size()) {
+			d.add(e.Name(), e.Size())
+		}
+	}
+	return d
+}
+
+// reserve reserves n bytes for a body being spilled, removing the oldest bodies if needed,
+// and tells whether it is within max.
+func (d *bodyDir) reserve(n int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.max > 0 && d.used+n > d.max && d.bodies.Len() > 0 {
+		b := d.bodies.Remove(d.bodies.Front()).(*spilledBody)
+		delete(d.files, b.sha)
+		d.used -= b.size
+		if err := os.Remove(filepath.Join(d.path, b.sha)); err != nil && !os.IsNotExist(err) {
+			log.Printf("E! remove body %s, error: %v", b.sha, err)
+		}
+	}
+	if d.max > 0 && d.used+n > d.max {
+		return false
+	}
+	d.used += n
+	return true
+}
+
+func (d *bodyDir) release(n int64) {
+	d.mu.Lock()
+	d.used -= n
+	d.mu.Unlock()
+}
+
+// add adds the body of the reserved size, which replaces the one of the same SHA-256.
+func (d *bodyDir) add(sha string, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e, ok := d.files[sha]; ok {
+		d.used -= e.Value.(*spilledBody).size
+		d.bodies.Remove(e)
+	}
+	d.files[sha] = d.bodies.PushBack(&spilledBody{sha: sha, size: size})
+}
+
+// bodyInfo is the information of a parsed body besides its bytes.
+type bodyInfo struct {
+	size      int    // the size on the wire, before decoding
+	truncated bool   // the body is truncated to max
+	sha256    string // of the whole body spilled, empty if not spilled
+}
+
+// bodyReader reads a body, which is truncated to max bytes, <= 0 for unlimited, and the whole body is spilled
+// to the directory once it is over max, empty for none.
+type bodyReader struct {
+	reader *Reader
+	max    int
+	dir    *bodyDir
+	spill  *bodySpill
+}
+
+// read appends n bytes of the body to dst.
+func (r *bodyReader) read(dst []byte, n int) ([]byte, error) {
+	if r.spill == nil && r.dir != nil && r.max > 0 && len(dst)+n > r.max {
+		spill, err := newBodySpill(r.dir)
+		if err != nil {
+			log.Printf("E! spill body to %s, error: %v", r.dir.path, err)
+			r.dir = nil
+		} else {
+			r.spill = spill
+			_, _ = spill.Write(dst)
+		}
+	}
+
+	var w io.Writer
+	if r.spill != nil {
+		w = r.spill
+	}
+	return r.reader.AppendNext(dst, n, r.max, w)
+}
+
+// close closes the spilled file, and returns its SHA-256, empty if there is none or the body is incomplete.
+func (r *bodyReader) close(complete bool) string {
+	if r.spill == nil {
+		return ""
+	}
+	return r.spill.close(complete)
+}
+
+// bodySpill writes a body to a temporary file of the directory, which is renamed by its SHA-256 at the end.
+type bodySpill struct {
+	dir  *bodyDir
+	f    *os.File
+	h    hash.Hash
+	size int64 // reserved in dir
+	err  error
+}
+
+func newBodySpill(dir *bodyDir) (*bodySpill, error) {
+	f, err := ioutil.TempFile(dir.path, ".body-")
+	if err != nil {
+		return nil, err
+	}
+	return &bodySpill{dir: dir, f: f, h: sha256.New()}, nil
+}
+
+// Write writes the bytes to the file, the error is kept until close, so that the parsing goes on.
+func (b *bodySpill) Write(p []byte) (int, error) {
+	if b.err == nil && !b.dir.reserve(int64(len(p))) {
+		b.err = errBodyDirFull
+	}
+	if b.err == nil {
+		b.size += int64(len(p))
+		_, b.err = b.f.Write(p)
+		b.h.Write(p)
+	}
+	return len(p), nil
+}
+
+func (b *bodySpill) close(complete bool) string {
+	if err := b.f.Close(); b.err == nil {
+		b.err = err
+	}
+	if b.err != nil || !complete {
+		switch {
+		case errors.Is(b.err, errBodyDirFull):
+			log.Printf("W! spill body to %s, %v", b.dir.path, b.err)
+		case b.err != nil:
+			log.Printf("E! spill body to %s, error: %v", b.f.Name(), b.err)
+		}
+		_ = os.Remove(b.f.Name())
+		b.dir.release(b.size)
+		return ""
+	}
+
+	sum := hex.EncodeToString(b.h.Sum(nil))
+	if err := os.Rename(b.f.Name(), filepath.Join(b.dir.path, sum)); err != nil {
+		log.Printf("E! spill body to %s, error: %v", b.dir.path, err)
+		_ = os.Remove(b.f.Name())
+		b.dir.release(b.size)
+		return ""
+	}
+	b.dir.add(sum, b.size)
+	atomic.AddUint64(&spilledBodies, 1)
+	return sum
+}
+
+var bodySHA256 = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// BodyFile returns the file of the body spilled to the directory by its SHA-256, empty if the SHA-256 is bad.
+func BodyFile(dir, sha string) string {
+	if dir == "" || !bodySHA256.MatchString(sha) {
+		return ""
+	}
+	return filepath.Join(dir, sha)
+}
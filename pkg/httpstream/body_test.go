@@ -0,0 +1,168 @@
+package httpstream
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestBodyLimits(t *testing.T) {
+	const limit = 1024
+	dir := t.TempDir()
+
+	eventChan := make(chan Event, 1024)
+	p, err := NewPipeline(eventChan, Options{Offline: true, MaxResponseBody: limit, BodyDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := NewPacketSource("testdata/dump.pcap", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		p.Feed(ps)
+		p.Close()
+	}()
+
+	truncated := 0
+	for e := range eventChan {
+		r, ok := e.(ResponseEvent)
+		if !ok || !r.BodyTruncated {
+			continue
+		}
+		truncated++
+		if r.BodyOriginalSize <= limit || len(r.Body) > limit ||
+			r.Header.Get("Content-Encoding") == "" && len(r.Body) != limit {
+			t.Errorf("response body %d bytes, truncated from %d", len(r.Body), r.BodyOriginalSize)
+		}
+
+		data, err := ioutil.ReadFile(BodyFile(dir, r.BodySHA256))
+		if err != nil {
+			t.Errorf("spilled body %q, error: %v", r.BodySHA256, err)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != r.BodySHA256 || len(data) != r.BodyOriginalSize {
+			t.Errorf("spilled body %d bytes, of SHA-256 %x, expected %d bytes, %s",
+				len(data), sum, r.BodyOriginalSize, r.BodySHA256)
+		}
+	}
+	if truncated == 0 {
+		t.Error("no truncated bodies")
+	}
+
+	for _, sha := range []string{"", "../body", strings.Repeat("A", 64)} {
+		if BodyFile(dir, sha) != "" {
+			t.Errorf("body file of %q", sha)
+		}
+	}
+}
+
+func TestCompressionBomb(t *testing.T) {
+	const limit = 1024
+	rsps := gzipResponses(t, 16<<20, limit)
+	if len(rsps) != 1 {
+		t.Fatalf("%d responses", len(rsps))
+	}
+	if r := rsps[0]; len(r.Body) != limit || !r.BodyTruncated {
+		t.Errorf("decoded body %d bytes, truncated %v", len(r.Body), r.BodyTruncated)
+	}
+}
+
+func TestDecodedBodyTruncated(t *testing.T) {
+	const limit = 1024
+	rsps := gzipResponses(t, 4*limit, limit) // only the decoded body is over the limit
+	if len(rsps) != 1 {
+		t.Fatalf("%d responses", len(rsps))
+	}
+	r := rsps[0]
+	// the size on the wire is of the gzip body, smaller than the decoded one
+	if len(r.Body) != limit || !r.BodyTruncated || r.BodyOriginalSize >= limit || r.BodySize() != r.BodyOriginalSize {
+		t.Errorf("decoded body %d bytes, truncated %v, original %d", len(r.Body), r.BodyTruncated, r.BodyOriginalSize)
+	}
+	var text bytes.Buffer
+	_, _ = r.WriteTo(&text)
+	expected := fmt.Sprintf("content(%d, truncated, %d on the wire)", limit, r.BodyOriginalSize)
+	if !strings.Contains(text.String(), expected) {
+		t.Errorf("%q not in the text", expected)
+	}
+}
+
+// gzipResponses returns the responses of a gzip body of n zeros decoded to the limit.
+func gzipResponses(t *testing.T, n, limit int) (rsps []ResponseEvent) {
+	var body bytes.Buffer
+	w := gzip.NewWriter(&body)
+	_, _ = w.Write(make([]byte, n))
+	_ = w.Close()
+
+	req := []byte("GET / HTTP/1.1\r\nHost: bomb\r\n\r\n")
+	rsp := append([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: %d\r\n\r\n",
+		body.Len())), body.Bytes()...)
+	packets := []*layers.TCP{
+		{SrcPort: 5000, DstPort: 80, SYN: true, Seq: 100},
+		{SrcPort: 80, DstPort: 5000, SYN: true, ACK: true, Seq: 900, Ack: 101},
+		{SrcPort: 5000, DstPort: 80, ACK: true, PSH: true, Seq: 101, Ack: 901, BaseLayer: layers.BaseLayer{Payload: req}},
+		{SrcPort: 80, DstPort: 5000, ACK: true, PSH: true, Seq: 901, Ack: 101 + uint32(len(req)),
+			BaseLayer: layers.BaseLayer{Payload: rsp}},
+	}
+	filename := filepath.Join(t.TempDir(), "gzip.pcap")
+	writePcap(t, filename, "10.0.0.1", "10.0.0.2", packets, []bool{true, false, true, false})
+
+	ps, err := NewPacketSource(filename, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventChan := make(chan Event, 1024)
+	Run(ps, eventChan, Options{Offline: true, MaxResponseBody: limit})
+
+	for e := range eventChan {
+		if r, ok := e.(ResponseEvent); ok {
+			rsps = append(rsps, r)
+		}
+	}
+	return rsps
+}
+
+func TestBodyDirSize(t *testing.T) {
+	dir := t.TempDir()
+	old := strings.Repeat("0", 64)
+	if err := ioutil.WriteFile(filepath.Join(dir, old), make([]byte, 40), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newBodyDir(dir, 100)
+	spill := func(data string) string {
+		b, err := newBodySpill(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = b.Write([]byte(data))
+		return b.close(true)
+	}
+
+	first := spill(strings.Repeat("a", 50))  // within the size with the body spilled before
+	second := spill(strings.Repeat("b", 50)) // the oldest one is removed
+	if _, err := os.Stat(filepath.Join(dir, old)); !os.IsNotExist(err) {
+		t.Errorf("the oldest body is not removed, error: %v", err)
+	}
+	if first == "" || second == "" || d.used != 100 {
+		t.Errorf("spilled %q and %q, used %d", first, second, d.used)
+	}
+	if sha := spill(strings.Repeat("c", 101)); sha != "" || d.used != 0 {
+		t.Errorf("spilled %q over the size, used %d", sha, d.used)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("%d files left", len(files))
+	}
+}
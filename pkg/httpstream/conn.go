@@ -0,0 +1,219 @@
+package httpstream
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ConnState is the state of a TCP connection reported by ConnectionEvent.
+type ConnState string
+
+const (
+	ConnOpen       ConnState = "open"       // SYN-ACK received
+	ConnClosed     ConnState = "closed"     // FIN received
+	ConnReset      ConnState = "reset"      // RST received
+	ConnRefused    ConnState = "refused"    // RST received in reply to SYN
+	ConnTimeout    ConnState = "timeout"    // idle and flushed by the assembler
+	ConnUnfinished ConnState = "unfinished" // still alive at the end of input
+)
+
+// ConnectionEvent is TCP connection lifecycle event.
+type ConnectionEvent struct {
+	UID             string
+	State           ConnState
+	Start, End      time.Time
+	StreamSeq       uint
+	ClientAddr      string
+	ServerAddr      string
+	ClientName      string        // the name of ClientAddr, empty if unknown
+	ServerName      string        // the name of ServerAddr, empty if unknown
+	ClientProcess   *Process      // the local process of the client, nil if remote or unknown
+	ServerProcess   *Process      // the local process of the server, nil if remote or unknown
+	HandshakeRTT    time.Duration // SYN to SYN-ACK
+	ClientBytes     uint64        // payload bytes sent by client
+	ServerBytes     uint64        // payload bytes sent by server
+	Retransmissions int
+	OutOfOrder      int
+	Transactions    int // HTTP requests carried on the connection
+}
+
+func (r ConnectionEvent) WriteTo(out io.Writer) (n int64, err error) {
+	m, err := fmt.Fprintf(out, "#%d [%s] Connection %s %s->%s rtt:%s bytes:%d/%d retrans:%d ooo:%d transactions:%d\r\n\r\n",
+		r.StreamSeq, r.Start.Format(layout), r.State, namedAddr(r.ClientAddr, r.ClientName),
+		namedAddr(r.ServerAddr, r.ServerName), r.HandshakeRTT,
+		r.ClientBytes, r.ServerBytes, r.Retransmissions, r.OutOfOrder, r.Transactions)
+	return int64(m), err
+}
+
+// maxSeqHoles limits the sequence holes remembered per direction.
+const maxSeqHoles = 16
+
+type seqHole struct{ from, to uint32 }
+
+// seqState tracks the sequence numbers of one direction for retransmission and out-of-order detection.
+type seqState struct {
+	next  uint32
+	holes []seqHole
+}
+
+// connStats is the TCP level state of a pair, it is updated by the capture loop.
+type connStats struct {
+	sync.Mutex
+
+	client          streamKey // the SYN sender, or the first stream seen
+	streams         []*httpStream
+	syn, synAck     time.Time
+	first, last     time.Time
+	fin, rst        bool
+	retransmissions int
+	outOfOrder      int
+	seq             map[streamKey]*seqState
+}
+
+func (c *connStats) addStream(s *httpStream) {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(c.streams) == 0 {
+		c.client = s.key
+	}
+	c.streams = append(c.streams, s)
+}
+
+// track records the packet and reports whether the handshake has just completed.
+func (c *connStats) track(key streamKey, t *layers.TCP, seen time.Time) (opened bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.first.IsZero() {
+		c.first = seen
+	}
+	c.last = seen
+
+	switch {
+	case t.SYN && !t.ACK:
+		c.syn, c.client = seen, key
+	case t.SYN && t.ACK && c.synAck.IsZero() && !c.syn.IsZero():
+		c.synAck, opened = seen, true
+	}
+
+	c.fin = c.fin || t.FIN
+	c.rst = c.rst || t.RST
+	c.trackSeq(key, t)
+
+	return opened
+}
+
+func (c *connStats) trackSeq(key streamKey, t *layers.TCP) {
+	n := uint32(len(t.LayerPayload()))
+	if t.SYN || t.FIN {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	if c.seq == nil {
+		c.seq = make(map[streamKey]*seqState)
+	}
+
+	end := t.Seq + n
+	s, ok := c.seq[key]
+	if !ok {
+		c.seq[key] = &seqState{next: end}
+		return
+	}
+
+	switch {
+	case int32(t.Seq-s.next) > 0: // bytes between next and seq are missing
+		if len(s.holes) < maxSeqHoles {
+			s.holes = append(s.holes, seqHole{from: s.next, to: t.Seq})
+		}
+		s.next = end
+	case int32(end-s.next) > 0:
+		s.next = end
+	case s.fillHole(t.Seq, end):
+		c.outOfOrder++
+	default:
+		c.retransmissions++
+	}
+}
+
+// fillHole removes the hole covered by [from, to) and reports whether there was one.
+func (s *seqState) fillHole(from, to uint32) bool {
+	for i, h := range s.holes {
+		if int32(from-h.to) >= 0 || int32(to-h.from) <= 0 {
+			continue
+		}
+
+		s.holes = append(s.holes[:i], s.holes[i+1:]...)
+		return true
+	}
+
+	return false
+}
+
+// handshake returns the duration from SYN to SYN-ACK, 0 if the handshake is not captured.
+func (c *connStats) handshake() time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	return span(c.syn, c.synAck)
+}
+
+func (c *connStats) finalState(closing bool) ConnState {
+	c.Lock()
+	defer c.Unlock()
+
+	switch {
+	case c.rst && c.synAck.IsZero() && !c.syn.IsZero():
+		return ConnRefused
+	case c.rst:
+		return ConnReset
+	case c.fin:
+		return ConnClosed
+	case closing:
+		return ConnUnfinished
+	default:
+		return ConnTimeout
+	}
+}
+
+func (p *pair) connectionEvent(state ConnState) ConnectionEvent {
+	c := &p.conn
+	c.Lock()
+	defer c.Unlock()
+
+	e := ConnectionEvent{
+		UID:             newEventUID(),
+		State:           state,
+		Start:           c.first,
+		End:             c.last,
+		StreamSeq:       p.connSeq,
+		ClientAddr:      c.client.src(),
+		ServerAddr:      c.client.dst(),
+		ClientName:      p.names.Name(c.client.src()),
+		ServerName:      p.names.Name(c.client.dst()),
+		ClientProcess:   p.processes[c.client.src()],
+		ServerProcess:   p.processes[c.client.dst()],
+		HandshakeRTT:    span(c.syn, c.synAck),
+		Retransmissions: c.retransmissions,
+		OutOfOrder:      c.outOfOrder,
+		Transactions:    int(atomic.LoadInt32(&p.transactions)),
+	}
+
+	for _, s := range c.streams {
+		if s.key == c.client {
+			e.ClientBytes += atomic.LoadUint64(&s.bytes)
+		} else {
+			e.ServerBytes += atomic.LoadUint64(&s.bytes)
+		}
+	}
+
+	return e
+}
@@ -0,0 +1,99 @@
+package httpstream
+
+import (
+	"encoding/csv"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// csvColumns are the columns of EventCsv, timings are in milliseconds.
+var csvColumns = []string{"time", "stream", "id", "client", "server", "method", "host", "uri", "status",
+	"request_size", "response_size", "send_ms", "wait_ms", "receive_ms", "total_ms", "client_name", "server_name"}
+
+// EventCsv writes an HTTP transaction a row as CSV, the request without response is written at the end.
+type EventCsv struct {
+	filename string
+	f        *os.File
+	w        *csv.Writer
+	pending  *pairer // of RequestEvent
+}
+
+// NewEventCsv creates EventCsv.
+func NewEventCsv(filename string) *EventCsv {
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatalln("Cannot open writer ", filename)
+	}
+
+	c := &EventCsv{filename: filename, f: f, w: csv.NewWriter(f)}
+	c.pending = newPairer(maxPending, func(value interface{}) {
+		req := value.(RequestEvent)
+		c.writeTransaction(&req, nil)
+	})
+	c.write(csvColumns)
+	return c
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (c *EventCsv) PushEvent(e Event) {
+	switch v := e.(type) {
+	case RequestEvent:
+		c.pending.add(v.Message, v)
+	case ResponseEvent:
+		if value, ok := c.pending.take(v.Message); ok {
+			req := value.(RequestEvent)
+			c.writeTransaction(&req, &v)
+		} else {
+			c.writeTransaction(nil, &v)
+		}
+	default:
+		// bypass
+	}
+}
+
+// Wait implements the function of interface EventHandler.
+func (c *EventCsv) Wait() {
+	c.pending.flush()
+	c.w.Flush()
+	if err := c.w.Error(); err != nil {
+		log.Printf("E! Write %s, error: %v", c.filename, err)
+	}
+	_ = c.f.Close()
+}
+
+func (c *EventCsv) writeTransaction(req *RequestEvent, rsp *ResponseEvent) {
+	row := make([]string, len(csvColumns))
+	m, timing := eventOf(&Transaction{Request: req, Response: rsp}), Timing{}
+	row[0] = m.Start.Format(time.RFC3339Nano)
+	row[1] = strconv.FormatUint(uint64(m.StreamSeq), 10)
+	row[2] = strconv.Itoa(m.ID)
+	row[3], row[4] = m.ClientAddr, m.ServerAddr
+	row[15], row[16] = m.ClientName, m.ServerName
+
+	if req != nil {
+		row[5], row[6], row[7] = req.Method, req.Header.Get("Host"), req.URI
+		row[9] = strconv.Itoa(req.BodySize())
+		timing = req.Timing
+	}
+	if rsp != nil {
+		row[8] = rsp.Code
+		row[10] = strconv.Itoa(rsp.BodySize())
+		timing = rsp.Timing
+	}
+
+	for i, d := range []time.Duration{timing.Send(), timing.Wait(), timing.Receive(), timing.Total()} {
+		if d > 0 {
+			row[11+i] = strconv.FormatFloat(milliseconds(d), 'f', 3, 64)
+		}
+	}
+
+	c.write(row)
+}
+
+func (c *EventCsv) write(row []string) {
+	if err := c.w.Write(row); err != nil {
+		log.Printf("E! Write %s, error: %v", c.filename, err)
+	}
+}
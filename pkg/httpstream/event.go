@@ -0,0 +1,297 @@
+package httpstream
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// EventKind is the kind of Event.
+type EventKind string
+
+const (
+	KindRequest    EventKind = "HTTPRequest"
+	KindResponse   EventKind = "HTTPResponse"
+	KindConnection EventKind = "TCPConnection"
+	KindParseError EventKind = "ParseError"
+	KindFinding    EventKind = "Finding"
+)
+
+// Event is the event of the captured traffic, pushed to EventHandler.
+type Event interface {
+	Kind() EventKind
+	// EventID returns the globally unique ID of the event.
+	EventID() string
+	// EventTime returns the time of the event, the first byte of HTTP messages.
+	EventTime() time.Time
+}
+
+func (r RequestEvent) Kind() EventKind         { return KindRequest }
+func (r RequestEvent) EventID() string         { return r.UID }
+func (r RequestEvent) EventTime() time.Time    { return r.Start }
+func (r ResponseEvent) Kind() EventKind        { return KindResponse }
+func (r ResponseEvent) EventID() string        { return r.UID }
+func (r ResponseEvent) EventTime() time.Time   { return r.Start }
+func (r ConnectionEvent) Kind() EventKind      { return KindConnection }
+func (r ConnectionEvent) EventID() string      { return r.UID }
+func (r ParseErrorEvent) Kind() EventKind      { return KindParseError }
+func (r ParseErrorEvent) EventID() string      { return r.UID }
+func (r ParseErrorEvent) EventTime() time.Time { return r.Time }
+func (r FindingEvent) Kind() EventKind         { return KindFinding }
+func (r FindingEvent) EventID() string         { return r.UID }
+func (r FindingEvent) EventTime() time.Time    { return r.Time }
+
+// EventTime returns the end of the connection, or the start if it is still open.
+func (r ConnectionEvent) EventTime() time.Time {
+	if r.End.IsZero() {
+		return r.Start
+	}
+	return r.End
+}
+
+var (
+	// runID makes the event IDs unique among the runs.
+	runID    = newRunID()
+	eventSeq uint64 // accessed atomically
+)
+
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newEventUID returns a globally unique event ID, {run}-{seq}.
+func newEventUID() string {
+	return runID + "-" + strconv.FormatUint(atomic.AddUint64(&eventSeq, 1), 10)
+}
+
+// SchemaV1 is the schema of the JSON encoding of events, see EventRecord.
+const SchemaV1 = "netgraph.event/v1"
+
+// EventRecord is the versioned JSON encoding of Event:
+//
+//	{"schema":"netgraph.event/v1","kind":"HTTPRequest","id":"...","time":"RFC 3339","data":{...}}
+//
+// Data is MessageData for HTTP requests and responses, ConnectionData, ParseErrorData or FindingData
+// for the other kinds. Fields are only added to a schema version, never changed or removed.
+type EventRecord struct {
+	Schema string      `json:"schema"`
+	Kind   EventKind   `json:"kind"`
+	ID     string      `json:"id"`
+	Time   time.Time   `json:"time"`
+	Data   interface{} `json:"data"`
+}
+
+// HeaderRecord is a header field, the repeated fields are kept in separate records.
+type HeaderRecord struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// TimingRecord is the timing of HTTP transaction in milliseconds, omitted if not captured.
+type TimingRecord struct {
+	Handshake float64 `json:"handshake,omitempty"`
+	Send      float64 `json:"send,omitempty"`
+	Wait      float64 `json:"wait,omitempty"`
+	Receive   float64 `json:"receive,omitempty"`
+	Total     float64 `json:"total,omitempty"`
+}
+
+// MessageData is the data of HTTPRequest and HTTPResponse.
+type MessageData struct {
+	Stream        uint      `json:"stream"`
+	Transaction   int       `json:"transaction"` // the request ID in the stream, 0 if unknown
+	Client        string    `json:"client"`
+	Server        string    `json:"server"`
+	ClientName    string    `json:"clientName,omitempty"`
+	ServerName    string    `json:"serverName,omitempty"`
+	ClientProcess *Process  `json:"clientProcess,omitempty"`
+	ServerProcess *Process  `json:"serverProcess,omitempty"`
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+
+	Method string `json:"method,omitempty"` // request only
+	URI    string `json:"uri,omitempty"`    // request only
+	Route  string `json:"route,omitempty"`  // request only, the normalized URI
+	Code   int    `json:"code,omitempty"`   // response only
+	Reason string `json:"reason,omitempty"` // response only
+
+	Version      string         `json:"version"`
+	Headers      []HeaderRecord `json:"headers"`
+	Body         string         `json:"body,omitempty"`
+	BodyEncoding string         `json:"bodyEncoding,omitempty"` // text or base64, omitted without body
+	BodySize     int            `json:"bodySize"`
+	// BodyTruncated tells that body is truncated to the limits, whose size on the wire is BodyOriginalSize.
+	BodyTruncated    bool          `json:"bodyTruncated,omitempty"`
+	BodyOriginalSize int           `json:"bodyOriginalSize,omitempty"`
+	BodySHA256       string        `json:"bodySha256,omitempty"` // of the whole body spilled, see Options.BodyDir
+	Timing           *TimingRecord `json:"timing,omitempty"`
+}
+
+// ConnectionData is the data of TCPConnection.
+type ConnectionData struct {
+	State           ConnState  `json:"state"`
+	Stream          uint       `json:"stream"`
+	Client          string     `json:"client"`
+	Server          string     `json:"server"`
+	ClientName      string     `json:"clientName,omitempty"`
+	ServerName      string     `json:"serverName,omitempty"`
+	ClientProcess   *Process   `json:"clientProcess,omitempty"`
+	ServerProcess   *Process   `json:"serverProcess,omitempty"`
+	Start           time.Time  `json:"start"`
+	End             *time.Time `json:"end,omitempty"`
+	HandshakeRTT    float64    `json:"handshakeRtt,omitempty"` // milliseconds
+	ClientBytes     uint64     `json:"clientBytes"`
+	ServerBytes     uint64     `json:"serverBytes"`
+	Retransmissions int        `json:"retransmissions"`
+	OutOfOrder      int        `json:"outOfOrder"`
+	Transactions    int        `json:"transactions"`
+}
+
+// ParseErrorData is the data of ParseError.
+type ParseErrorData struct {
+	Stream  uint       `json:"stream"`
+	Src     string     `json:"src"`
+	Dst     string     `json:"dst"`
+	SrcName string     `json:"srcName,omitempty"`
+	DstName string     `json:"dstName,omitempty"`
+	Stage   ParseStage `json:"stage"`
+	Error   string     `json:"error"`
+	Snippet string     `json:"snippet"` // hex
+}
+
+// FindingData is the data of Finding.
+type FindingData struct {
+	Category    string   `json:"category"`
+	Rule        string   `json:"rule"`
+	Severity    Severity `json:"severity"`
+	Stream      uint     `json:"stream"`
+	Transaction int      `json:"transaction,omitempty"`
+	Client      string   `json:"client"`
+	Server      string   `json:"server"`
+	ClientName  string   `json:"clientName,omitempty"`
+	ServerName  string   `json:"serverName,omitempty"`
+	Detail      string   `json:"detail"`
+}
+
+// NewEventRecord creates the EventRecord of the event.
+func NewEventRecord(e Event) EventRecord {
+	r := EventRecord{Schema: SchemaV1, Kind: e.Kind(), ID: e.EventID(), Time: e.EventTime()}
+
+	switch v := e.(type) {
+	case RequestEvent:
+		d := newMessageData(v.Message, v.Version)
+		d.Method, d.URI, d.Route = v.Method, v.URI, v.Route
+		r.Data = d
+	case ResponseEvent:
+		d := newMessageData(v.Message, v.Version)
+		d.Code, _ = strconv.Atoi(v.Code)
+		d.Reason = v.Reason
+		r.Data = d
+	case ConnectionEvent:
+		d := ConnectionData{State: v.State, Stream: v.StreamSeq, Client: v.ClientAddr, Server: v.ServerAddr,
+			ClientName: v.ClientName, ServerName: v.ServerName, ClientProcess: v.ClientProcess,
+			ServerProcess: v.ServerProcess, Start: v.Start,
+			HandshakeRTT: milliseconds(v.HandshakeRTT), ClientBytes: v.ClientBytes, ServerBytes: v.ServerBytes,
+			Retransmissions: v.Retransmissions, OutOfOrder: v.OutOfOrder, Transactions: v.Transactions}
+		if !v.End.IsZero() {
+			d.End = &v.End
+		}
+		r.Data = d
+	case ParseErrorEvent:
+		r.Data = ParseErrorData{Stream: v.StreamSeq, Src: v.Src, Dst: v.Dst, SrcName: v.SrcName, DstName: v.DstName,
+			Stage: v.Stage, Error: v.Error, Snippet: v.Snippet}
+	case FindingEvent:
+		r.Data = FindingData{Category: v.Category, Rule: v.Rule, Severity: v.Severity, Stream: v.StreamSeq,
+			Transaction: v.ID, Client: v.ClientAddr, Server: v.ServerAddr, ClientName: v.ClientName,
+			ServerName: v.ServerName, Detail: v.Detail}
+	default:
+		r.Data = e
+	}
+
+	return r
+}
+
+// MarshalEvent encodes the event as JSON of EventRecord.
+func MarshalEvent(e Event) ([]byte, error) {
+	data, err := json.Marshal(NewEventRecord(e))
+	if err != nil {
+		return nil, fmt.Errorf("marshal %s event %s, error: %w", e.Kind(), e.EventID(), err)
+	}
+	return data, nil
+}
+
+func newMessageData(m Message, version string) MessageData {
+	d := MessageData{Stream: m.StreamSeq, Transaction: m.ID, Client: m.ClientAddr, Server: m.ServerAddr,
+		ClientName: m.ClientName, ServerName: m.ServerName, ClientProcess: m.ClientProcess,
+		ServerProcess: m.ServerProcess, Start: m.Start, End: m.End, Version: version, Headers: headerRecords(m),
+		BodySize: len(m.Body), BodyTruncated: m.BodyTruncated, BodyOriginalSize: m.BodyOriginalSize,
+		BodySHA256: m.BodySHA256}
+	d.Body, d.BodyEncoding = encodeBody(m.Body)
+
+	t := m.Timing
+	if !t.RequestStart.IsZero() || !t.ResponseStart.IsZero() {
+		d.Timing = &TimingRecord{Handshake: milliseconds(t.Handshake), Send: milliseconds(t.Send()),
+			Wait: milliseconds(t.Wait()), Receive: milliseconds(t.Receive()), Total: milliseconds(t.Total())}
+	}
+	return d
+}
+
+// headerRecords returns the header fields in the order of the wire if the raw header is captured,
+// otherwise ordered by name.
+func headerRecords(m Message) []HeaderRecord {
+	if len(m.RawHeader) > 0 {
+		records := make([]HeaderRecord, len(m.RawHeader))
+		for i, h := range m.RawHeader {
+			records[i] = HeaderRecord{Name: h.Name, Value: h.Value}
+		}
+		return records
+	}
+
+	names := make([]string, 0, len(m.Header))
+	for name := range m.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	records := make([]HeaderRecord, 0, len(names))
+	for _, name := range names {
+		for _, v := range m.Header[name] {
+			records = append(records, HeaderRecord{Name: name, Value: v})
+		}
+	}
+	return records
+}
+
+// encodeBody encodes the body as text if it is printable UTF-8, otherwise base64.
+func encodeBody(body []byte) (data, encoding string) {
+	if len(body) == 0 {
+		return "", ""
+	}
+	if isText(body) {
+		return string(body), "text"
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 && c != '\t' && c != '\r' && c != '\n' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
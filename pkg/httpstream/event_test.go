@@ -0,0 +1,79 @@
+package httpstream
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMarshalEvent(t *testing.T) {
+	start := time.Date(2021, 5, 19, 22, 35, 41, 0, time.UTC)
+	rsp := ResponseEvent{Code: "200", Reason: "OK", Version: "HTTP/1.1", Message: Message{
+		UID: newEventUID(), Start: start, StreamSeq: 3, ID: 1,
+		Header: http.Header{"Set-Cookie": {"a=1", "b=2"}, "Content-Type": {"image/png"}},
+		Body:   []byte{0x89, 'P', 'N', 'G'},
+		Timing: Timing{RequestStart: start, RequestEnd: start.Add(time.Millisecond), ResponseStart: start.Add(2 * time.Millisecond),
+			ResponseEnd: start.Add(3 * time.Millisecond)},
+	}}
+
+	data, err := MarshalEvent(rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r struct {
+		EventRecord
+		Data MessageData `json:"data"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Schema != SchemaV1 || r.Kind != KindResponse || r.ID != rsp.UID || !r.Time.Equal(start) {
+		t.Errorf("envelope: %s", data)
+	}
+	d := r.Data
+	if d.Code != 200 || d.Stream != 3 || d.Transaction != 1 || len(d.Headers) != 3 ||
+		d.Headers[1] != (HeaderRecord{Name: "Set-Cookie", Value: "a=1"}) {
+		t.Errorf("data: %s", data)
+	}
+	if d.BodyEncoding != "base64" || d.Body != "iVBORw==" || d.BodySize != 4 {
+		t.Errorf("body: %s", data)
+	}
+	if d.Timing == nil || d.Timing.Send != 1 || d.Timing.Wait != 1 || d.Timing.Total != 3 {
+		t.Errorf("timing: %s", data)
+	}
+
+	if newEventUID() == newEventUID() {
+		t.Errorf("event ID is not unique")
+	}
+}
+
+func TestRawHeader(t *testing.T) {
+	events := parseStream("GET / HTTP/1.1\r\nhost: a\r\nX-B: 1\r\n folded\r\nx-b: 2\r\n\r\n", false)
+	if len(events) != 1 {
+		t.Fatalf("events: %v", events)
+	}
+
+	data, err := MarshalEvent(events[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r struct {
+		Data MessageData `json:"data"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []HeaderRecord{{Name: "host", Value: "a"}, {Name: "X-B", Value: "1 folded"}, {Name: "x-b", Value: "2"}}
+	if len(r.Data.Headers) != len(expected) {
+		t.Fatalf("headers: %+v", r.Data.Headers)
+	}
+	for i, h := range expected {
+		if r.Data.Headers[i] != h {
+			t.Errorf("headers: %+v", r.Data.Headers)
+		}
+	}
+}
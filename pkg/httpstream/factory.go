@@ -1,38 +1,94 @@
 package httpstream
 
 import (
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/tcpassembly"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
 )
 
+// Options controls how the captured packets are turned into events.
+type Options struct {
+	OutputPcap   string // write captured packets to the pcap file, empty for none
+	SnapLen      int
+	OnlyRequests bool       // drop HTTP responses
+	OnlyMethod   string     // only capture HTTP methods, multiple separated by comma, empty for ANY
+	ConnEvents   bool       // emit TCP connection lifecycle events
+	Security     bool       // detect HTTP request smuggling and protocol ambiguities
+	Filter       *Filter    // only emit the HTTP transactions matching the filter, nil for all
+	Router       *Router    // normalize the request URIs into routes, nil for the automatic normalization only
+	Names        *Names     // resolve the addresses to names, nil for none
+	Processes    *Processes // attribute the connections to the local processes, nil for none
+	Offline      bool       // the packets are read from files, the streams are flushed by the time of packets
+	Shards       int        // assemble the TCP streams by the shards of flows, each with a goroutine, 0 for 1
+	// MaxMemory is the bytes buffered by all the streams, the oldest streams are dropped over it, 0 for unlimited.
+	MaxMemory int
+	// MaxStreamMemory is the bytes buffered by a stream, the bodies are truncated to it, and the stream is dropped
+	// if its first line or header is over it, 0 for unlimited.
+	MaxStreamMemory int
+	// MaxRequestBody and MaxResponseBody are the bytes of the bodies captured, the rest are truncated,
+	// 0 for unlimited.
+	MaxRequestBody, MaxResponseBody int
+	// BodyDir is the directory to spill the whole bodies over the limits to, the files are named by their SHA-256,
+	// empty for none.
+	BodyDir string
+	// MaxBodyDir is the bytes of the bodies in BodyDir, the oldest ones are removed over it, 0 for unlimited.
+	MaxBodyDir int
+}
+
 // Factory implements StreamFactory interface for tcpassembly.
 type Factory struct {
 	runningStream  int32
+	closing        int32
 	wg             sync.WaitGroup
-	seq            uint
+	seq            *uint64 // the next sequence number of streams, shared by the factories of shards
+	dispatched     bool    // whether the packet being assembled is numbered dispatchedSeq by the pipeline
+	dispatchedSeq  uint
+	budget         *memoryBudget // shared by the factories of shards
+	bodies         bodyLimits
 	uniStreams     map[streamKey]*pair
 	uniStreamsLock sync.Mutex
-	eventChan      chan<- interface{}
+	conns          map[streamKey]*pair
+	connsLock      sync.Mutex
+	eventChan      chan<- Event
 	onlyRequests   bool
+	connEvents     bool
+	security       bool
+	filter         *Filter
+	router         *Router
+	names          *Names
+	processes      *Processes
 	methodAllowed  func(string) bool
 }
 
 // NewFactory create a NewFactory.
-func NewFactory(out chan<- interface{}, onlyRequests bool, onlyMethod string) *Factory {
+func NewFactory(out chan<- Event, opt Options) *Factory {
+	bodyDir := newBodyDir(opt.BodyDir, int64(opt.MaxBodyDir))
 	f := &Factory{
+		seq:          new(uint64),
+		budget:       newMemoryBudget(int64(opt.MaxMemory), int64(opt.MaxStreamMemory)),
+		bodies:       bodyLimits{request: opt.MaxRequestBody, response: opt.MaxResponseBody, dir: bodyDir},
 		uniStreams:   make(map[streamKey]*pair),
+		conns:        make(map[streamKey]*pair),
 		eventChan:    out,
-		onlyRequests: onlyRequests,
+		onlyRequests: opt.OnlyRequests,
+		connEvents:   opt.ConnEvents,
+		security:     opt.Security,
+		filter:       opt.Filter,
+		router:       opt.Router,
+		names:        opt.Names,
+		processes:    opt.Processes,
 	}
 
-	if onlyMethod == "" {
+	if opt.OnlyMethod == "" {
 		f.methodAllowed = func(string) bool { return true }
 	} else {
 		m := make(map[string]bool)
-		for _, s := range strings.Split(onlyMethod, ",") {
+		for _, s := range strings.Split(opt.OnlyMethod, ",") {
 			m[s] = true
 		}
 		f.methodAllowed = func(s string) bool { return m[s] }
@@ -41,6 +97,18 @@ func NewFactory(out chan<- interface{}, onlyRequests bool, onlyMethod string) *F
 	return f
 }
 
+// newShardFactories creates the factories of n shards, whose streams are numbered by the same sequence,
+// in the order of the packets dispatched to them, and share the memory budget and the body directory.
+func newShardFactories(out chan<- Event, opt Options, n int) []*Factory {
+	factories := make([]*Factory, n)
+	for i := range factories {
+		factories[i] = NewFactory(out, opt)
+		factories[i].seq, factories[i].budget = factories[0].seq, factories[0].budget
+		factories[i].bodies.dir = factories[0].bodies.dir
+	}
+	return factories
+}
+
 // Wait for all stream exit.
 func (f *Factory) Wait() { f.wg.Wait() }
 
@@ -53,6 +121,9 @@ func (f *Factory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
 
 	key := streamKey{net: netFlow, tcp: tcpFlow}
 	stream := newHTTPStream(key)
+	stream.detect = f.security
+	stream.reader.mem = f.budget.newStream()
+	stream.bodies = &f.bodies
 	revkey := streamKey{net: netFlow.Reverse(), tcp: tcpFlow.Reverse()}
 
 	f.uniStreamsLock.Lock()
@@ -60,30 +131,129 @@ func (f *Factory) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
 
 	if p, ok := f.uniStreams[revkey]; ok {
 		delete(f.uniStreams, revkey)
-		go p.run(&f.wg, stream, f.methodAllowed)
+		f.addConn(p, stream)
+
+		go func() {
+			defer f.wg.Done()
+			defer f.closeConn(p, stream)
+
+			f.resolveProcesses(p, key)
+			p.run(stream, f.methodAllowed)
+		}()
 		return stream
 	}
 
-	p := newPair(f.seq, f.eventChan, f.onlyRequests)
+	// the number of the dispatcher, or the next one if standalone, or unexpected by the dispatcher
+	seq := f.dispatchedSeq
+	if !f.dispatched {
+		seq = uint(atomic.AddUint64(f.seq, 1) - 1)
+	}
+	f.dispatched = false
+	p := newPair(seq, f.eventChan, f.onlyRequests, f.filter, f.router, f.names)
 	f.uniStreams[key] = p
-	f.seq++
+	f.addConn(p, stream)
 
 	go func() {
+		defer f.wg.Done()
 		defer Count(&f.runningStream)()
 		defer f.DeleteUniStream(key)
+		defer f.closeConn(p, stream)
 
-		p.run(&f.wg, stream, f.methodAllowed)
+		f.resolveProcesses(p, key)
+		p.run(stream, f.methodAllowed)
 	}()
 
 	return stream
 }
 
+// resolveProcesses looks up the local processes of the connection once, by the first stream of the pair,
+// which waits for it, so that reading /proc does not block the assembler.
+func (f *Factory) resolveProcesses(p *pair, key streamKey) {
+	if f.processes == nil {
+		return
+	}
+	p.processesOnce.Do(func() {
+		src, dst := f.processes.Lookup(key.src(), key.dst())
+		p.processes = map[string]*Process{key.src(): src, key.dst(): dst}
+	})
+}
+
 func (f *Factory) DeleteUniStream(key streamKey) {
 	f.uniStreamsLock.Lock()
 	delete(f.uniStreams, key)
 	f.uniStreamsLock.Unlock()
 }
 
+// Track records the TCP flags and sequence numbers of a packet for the connection events and timings,
+// and reports whether the connection of the packet is known, in either direction.
+// It should be called before the packet is assembled, so that a FIN or RST is recorded before the streams exit,
+// and again after it if the connection is unknown, since the stream of the first packet is created by the assembly.
+func (f *Factory) Track(netFlow gopacket.Flow, t *layers.TCP, seen time.Time) bool {
+	key := streamKey{net: netFlow, tcp: t.TransportFlow()}
+
+	// the reply without payload, eg. RST to SYN, creates no stream of its own.
+	f.connsLock.Lock()
+	p := f.conns[key]
+	if p == nil {
+		p = f.conns[streamKey{net: netFlow.Reverse(), tcp: key.tcp.Reverse()}]
+	}
+	f.connsLock.Unlock()
+	if p == nil {
+		return false
+	}
+
+	if p.conn.track(key, t, seen) && f.connEvents {
+		p.eventChan <- p.connectionEvent(ConnOpen)
+	}
+	return true
+}
+
+// LearnSNI learns the name of the server from the TLS SNI of a packet.
+func (f *Factory) LearnSNI(netFlow gopacket.Flow, t *layers.TCP) {
+	if f.names != nil && len(t.Payload) > 0 && t.Payload[0] == 0x16 {
+		if sni := tlsServerName(t.Payload); sni != "" {
+			f.names.Learn(streamKey{net: netFlow, tcp: t.TransportFlow()}.dst(), sni)
+		}
+	}
+}
+
+func (f *Factory) addConn(p *pair, stream *httpStream) {
+	atomic.AddInt32(&p.running, 1)
+	p.conn.addStream(stream)
+
+	f.connsLock.Lock()
+	f.conns[stream.key] = p
+	f.connsLock.Unlock()
+}
+
+// closeConn is called when a stream of the pair exits, the last one emits the connection event.
+func (f *Factory) closeConn(p *pair, stream *httpStream) {
+	f.connsLock.Lock()
+	delete(f.conns, stream.key)
+	f.connsLock.Unlock()
+
+	if atomic.AddInt32(&p.running, -1) != 0 {
+		return
+	}
+
+	if f.filter != nil {
+		p.flushHeld()
+	}
+	if f.connEvents {
+		p.eventChan <- p.connectionEvent(p.conn.finalState(atomic.LoadInt32(&f.closing) == 1))
+	}
+}
+
+// reset resets the factory for a new packet source, whose events are sent to out.
+// It should be called when there is no running stream.
+func (f *Factory) reset(out chan<- Event) {
+	f.eventChan = out
+	atomic.StoreInt32(&f.closing, 0)
+}
+
+// markClosing marks that all the remaining streams are going to be flushed at the end of input.
+func (f *Factory) markClosing() { atomic.StoreInt32(&f.closing, 1) }
+
 func Count(counter *int32) func() {
 	atomic.AddInt32(counter, 1)
 	return func() { atomic.AddInt32(counter, -1) }
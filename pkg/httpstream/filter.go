@@ -0,0 +1,552 @@
+package httpstream
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Transaction is an HTTP request and its response, either of them may be nil when it is not captured.
+type Transaction struct {
+	Request  *RequestEvent
+	Response *ResponseEvent
+}
+
+// Filter is a parsed filter expression over the fields of HTTP transactions, eg.
+//
+//	host == api.example.com and path startswith /v2 and status >= 500
+//
+// Fields:
+//
+//	method, host, uri, path, route, query, header.<Name>, body,
+//	status, latency, client, server, client.name, server.name, client.process, server.process,
+//	client.container, server.container, resp.header.<Name>, resp.body
+//
+// client.process and server.process are the command names of the local processes, eg. java.
+//
+// Operators: == != > >= < <= contains matches(~) startswith(^=) endswith($=) in,
+// in accepts a CIDR for client and server, or a comma separated list.
+// Expressions are combined with and(&&), or(||), not(!) and parentheses.
+// Values with spaces or operator characters should be quoted.
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+// ParseFilter parses the filter expression.
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := lexFilter(expr)
+	if err != nil {
+		return nil, fmt.Errorf("filter %q, %w", expr, err)
+	}
+
+	p := &filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter %q, %w", expr, err)
+	}
+
+	return &Filter{expr: expr, root: root}, nil
+}
+
+func (f *Filter) String() string { return f.expr }
+
+// Match tells whether the transaction matches the filter.
+func (f *Filter) Match(t Transaction) bool { return f.root.eval(&t) }
+
+// NeedsResponse tells whether the filter refers to the fields of response.
+func (f *Filter) NeedsResponse() bool { return f.root.needsResponse() }
+
+type filterNode interface {
+	eval(t *Transaction) bool
+	needsResponse() bool
+}
+
+type (
+	andNode struct{ l, r filterNode }
+	orNode  struct{ l, r filterNode }
+	notNode struct{ n filterNode }
+)
+
+func (n andNode) eval(t *Transaction) bool { return n.l.eval(t) && n.r.eval(t) }
+func (n orNode) eval(t *Transaction) bool  { return n.l.eval(t) || n.r.eval(t) }
+func (n notNode) eval(t *Transaction) bool { return !n.n.eval(t) }
+func (n andNode) needsResponse() bool      { return n.l.needsResponse() || n.r.needsResponse() }
+func (n orNode) needsResponse() bool       { return n.l.needsResponse() || n.r.needsResponse() }
+func (n notNode) needsResponse() bool      { return n.n.needsResponse() }
+
+// cmpNode compares a field with the value.
+type cmpNode struct {
+	field, op, value string
+
+	number float64
+	re     *regexp.Regexp
+	nets   []*net.IPNet
+	list   []string
+}
+
+func (n *cmpNode) needsResponse() bool {
+	return n.field == "status" || n.field == "latency" || strings.HasPrefix(n.field, "resp.")
+}
+
+func (n *cmpNode) eval(t *Transaction) bool {
+	switch n.field {
+	case "status", "latency":
+		v, ok := n.numberField(t)
+		return ok && compareNumber(v, n.op, n.number)
+	}
+
+	v, ok := n.stringField(t)
+	if !ok {
+		return false
+	}
+
+	switch n.op {
+	case "==":
+		return v == n.value
+	case "!=":
+		return v != n.value
+	case "contains":
+		return strings.Contains(v, n.value)
+	case "startswith":
+		return strings.HasPrefix(v, n.value)
+	case "endswith":
+		return strings.HasSuffix(v, n.value)
+	case "matches":
+		return n.re.MatchString(v)
+	case "in":
+		return n.in(v)
+	case "exists":
+		return v != ""
+	default:
+		f, err := strconv.ParseFloat(v, 64)
+		return err == nil && compareNumber(f, n.op, n.number)
+	}
+}
+
+func (n *cmpNode) in(v string) bool {
+	if len(n.nets) > 0 {
+		host, _, err := net.SplitHostPort(v)
+		if err != nil {
+			host = v
+		}
+		ip := net.ParseIP(host)
+		for _, c := range n.nets {
+			if ip != nil && c.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, s := range n.list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func compareNumber(v float64, op string, x float64) bool {
+	switch op {
+	case "==":
+		return v == x
+	case "!=":
+		return v != x
+	case ">":
+		return v > x
+	case ">=":
+		return v >= x
+	case "<":
+		return v < x
+	case "<=":
+		return v <= x
+	default:
+		return false
+	}
+}
+
+func (n *cmpNode) numberField(t *Transaction) (float64, bool) {
+	if t.Response == nil {
+		return 0, false
+	}
+
+	if n.field == "status" {
+		code, err := strconv.Atoi(t.Response.Code)
+		return float64(code), err == nil
+	}
+
+	if t.Request == nil {
+		return 0, false
+	}
+	// latency is compared in milliseconds
+	return float64(t.Response.Timing.Total()) / float64(time.Millisecond), true
+}
+
+func (n *cmpNode) stringField(t *Transaction) (string, bool) {
+	if strings.HasPrefix(n.field, "resp.") {
+		if t.Response == nil {
+			return "", false
+		}
+		switch f := strings.TrimPrefix(n.field, "resp."); {
+		case f == "body":
+			return string(t.Response.Body), true
+		case strings.HasPrefix(f, "header."):
+			return t.Response.Header.Get(strings.TrimPrefix(f, "header.")), true
+		}
+		return "", false
+	}
+
+	switch n.field {
+	case "client", "server", "client.name", "server.name":
+		e := eventOf(t)
+		if e == nil {
+			return "", false
+		}
+		switch n.field {
+		case "client":
+			return e.ClientAddr, true
+		case "client.name":
+			return e.ClientName, true
+		case "server.name":
+			return e.ServerName, true
+		}
+		return e.ServerAddr, true
+	case "client.process", "server.process", "client.container", "server.container":
+		e := eventOf(t)
+		if e == nil {
+			return "", false
+		}
+		proc := e.ClientProcess
+		if strings.HasPrefix(n.field, "server.") {
+			proc = e.ServerProcess
+		}
+		if proc == nil {
+			return "", true
+		}
+		if strings.HasSuffix(n.field, ".container") {
+			return proc.Container, true
+		}
+		return proc.Comm, true
+	}
+
+	r := t.Request
+	if r == nil {
+		return "", false
+	}
+
+	switch n.field {
+	case "method":
+		return r.Method, true
+	case "uri":
+		return r.URI, true
+	case "path":
+		return strings.SplitN(r.URI, "?", 2)[0], true
+	case "route":
+		return r.Route, true
+	case "query":
+		if p := strings.Index(r.URI, "?"); p >= 0 {
+			return r.URI[p+1:], true
+		}
+		return "", true
+	case "host":
+		host := r.Header.Get("Host")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return host, true
+	case "body":
+		return string(r.Body), true
+	}
+
+	return r.Header.Get(strings.TrimPrefix(n.field, "header.")), true
+}
+
+func eventOf(t *Transaction) *Message {
+	if t.Request != nil {
+		return &t.Request.Message
+	}
+	if t.Response != nil {
+		return &t.Response.Message
+	}
+	return nil
+}
+
+var filterFields = map[string]bool{
+	"method": true, "host": true, "uri": true, "path": true, "route": true, "query": true, "body": true,
+	"status": true, "latency": true, "client": true, "server": true, "client.name": true, "server.name": true,
+	"client.process": true, "server.process": true, "client.container": true, "server.container": true,
+	"resp.body": true,
+}
+
+func validField(f string) bool {
+	return filterFields[f] || strings.HasPrefix(f, "header.") && len(f) > 7 ||
+		strings.HasPrefix(f, "resp.header.") && len(f) > 12
+}
+
+var opAliases = map[string]string{"~": "matches", "^=": "startswith", "$=": "endswith", "=": "=="}
+
+func newCmpNode(field, op, value string) (*cmpNode, error) {
+	if !validField(field) {
+		return nil, fmt.Errorf("unknown field %q", field)
+	}
+	if a, ok := opAliases[op]; ok {
+		op = a
+	}
+
+	n := &cmpNode{field: field, op: op, value: value}
+	switch {
+	case field == "status" || field == "latency":
+		if op != "==" && op != "!=" && op != ">" && op != ">=" && op != "<" && op != "<=" {
+			return nil, fmt.Errorf("operator %s is not supported by %s", op, field)
+		}
+		return n, n.parseNumber()
+	case op == ">" || op == ">=" || op == "<" || op == "<=":
+		return n, n.parseNumber()
+	case op == "matches":
+		re, err := regexp.Compile(value)
+		n.re = re
+		return n, err
+	case op == "in":
+		n.parseList()
+	}
+
+	return n, nil
+}
+
+func (n *cmpNode) parseNumber() error {
+	if n.field == "latency" {
+		if d, err := time.ParseDuration(n.value); err == nil {
+			n.number = float64(d) / float64(time.Millisecond)
+			return nil
+		}
+	}
+
+	v, err := strconv.ParseFloat(n.value, 64)
+	if err != nil {
+		return fmt.Errorf("bad number %q of %s", n.value, n.field)
+	}
+	n.number = v
+	return nil
+}
+
+func (n *cmpNode) parseList() {
+	for _, s := range strings.Split(n.value, ",") {
+		s = strings.TrimSpace(s)
+		if (n.field == "client" || n.field == "server") && strings.Contains(s, "/") {
+			if _, c, err := net.ParseCIDR(s); err == nil {
+				n.nets = append(n.nets, c)
+				continue
+			}
+		}
+		n.list = append(n.list, s)
+	}
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+const filterOpChars = "=!<>~^$"
+
+func lexFilter(expr string) (tokens []filterToken, err error) {
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			var b strings.Builder
+			for ; j < len(expr) && expr[j] != c; j++ {
+				if expr[j] == '\\' && j+1 < len(expr) {
+					j++
+				}
+				b.WriteByte(expr[j])
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, filterToken{text: b.String(), quoted: true})
+			i = j + 1
+		case strings.IndexByte(filterOpChars, c) >= 0 || c == '&' || c == '|':
+			j := i + 1
+			for j < len(expr) && (strings.IndexByte(filterOpChars, expr[j]) >= 0 || expr[j] == '&' || expr[j] == '|') {
+				j++
+			}
+			tokens = append(tokens, filterToken{text: expr[i:j]})
+			i = j
+		default:
+			j := i + 1
+			for j < len(expr) && !strings.ContainsRune(" \t\r\n()\"'&|"+filterOpChars, rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, filterToken{text: expr[i:j]})
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted {
+		return strings.ToLower(p.tokens[p.pos].text)
+	}
+	return ""
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, fmt.Errorf("unexpected end")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	l, err := p.parseAnd()
+	for err == nil && (p.peek() == "or" || p.peek() == "||") {
+		p.pos++
+		var r filterNode
+		if r, err = p.parseAnd(); err == nil {
+			l = orNode{l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	l, err := p.parseUnary()
+	for err == nil && (p.peek() == "and" || p.peek() == "&&") {
+		p.pos++
+		var r filterNode
+		if r, err = p.parseUnary(); err == nil {
+			l = andNode{l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.pos++
+		n, err := p.parseUnary()
+		return notNode{n: n}, err
+	case "(":
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return n, nil
+	}
+
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(field.text)
+	if i := strings.Index(name, "header."); i >= 0 { // keep the case of header name as it is
+		name = name[:i+7] + field.text[i+7:]
+	}
+
+	switch op := p.peek(); op {
+	case "==", "=", "!=", ">", ">=", "<", "<=", "~", "^=", "$=", "contains", "matches", "startswith", "endswith", "in":
+		p.pos++
+		value, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		return newCmpNode(name, op, value.text)
+	default: // a bare field tells the field is not empty
+		return newCmpNode(name, "exists", "")
+	}
+}
+
+// maxPendingFilter limits the requests held by filteredHandler for their responses.
+const maxPendingFilter = 10000
+
+// NewFilteredHandler creates a handler which pushes the HTTP events matching the filter to h,
+// other events are passed through.
+func NewFilteredHandler(f *Filter, h EventHandler) EventHandler {
+	fh := &filteredHandler{filter: f, handler: h}
+	fh.held = newPairer(maxPendingFilter, fh.evict)
+	return fh
+}
+
+type filteredHandler struct {
+	filter  *Filter
+	handler EventHandler
+	// held are the requests passed the filter, the same as pair.held, of *RequestEvent.
+	held    *pairer
+	waiting bool
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (h *filteredHandler) PushEvent(e Event) {
+	switch v := e.(type) {
+	case RequestEvent:
+		if h.filter.NeedsResponse() {
+			h.held.add(v.Message, &v)
+		} else if h.filter.Match(Transaction{Request: &v}) {
+			h.held.add(v.Message, (*RequestEvent)(nil))
+			h.handler.PushEvent(v)
+		}
+	case ResponseEvent:
+		value, ok := h.held.take(v.Message)
+		req, _ := value.(*RequestEvent)
+		switch {
+		case !h.filter.NeedsResponse():
+			if !ok {
+				return
+			}
+		case !h.filter.Match(Transaction{Request: req, Response: &v}):
+			return
+		case req != nil:
+			h.handler.PushEvent(*req)
+		}
+		h.handler.PushEvent(v)
+	default:
+		h.handler.PushEvent(e)
+	}
+}
+
+// evict emits the held request if it matches the filter without response, as if it got no response,
+// and counts it unless it is flushed by Wait.
+func (h *filteredHandler) evict(value interface{}) {
+	if !h.waiting {
+		atomic.AddUint64(&evictedHeld, 1)
+	}
+	if req := value.(*RequestEvent); req != nil && h.filter.Match(Transaction{Request: req}) {
+		h.handler.PushEvent(*req)
+	}
+}
+
+// Wait implements the function of interface EventHandler.
+func (h *filteredHandler) Wait() {
+	h.waiting = true
+	h.held.flush()
+	h.handler.Wait()
+}
@@ -0,0 +1,116 @@
+package httpstream
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type collectHandler struct{ events []Event }
+
+func (c *collectHandler) PushEvent(e Event) { c.events = append(c.events, e) }
+func (c *collectHandler) Wait()             {}
+
+func TestFilter(t *testing.T) {
+	now := time.Now()
+	req := &RequestEvent{Method: "POST", URI: "/v2/users?id=1", Message: Message{ID: 1,
+		ClientAddr: "10.1.2.3:5000", ServerAddr: "192.168.0.1:80", ServerName: "users",
+		ClientProcess: &Process{PID: 42, Comm: "java"},
+		Header:        http.Header{"Host": {"api.example.com:8080"}, "X-Request-Id": {"abc"}},
+		Body:          []byte(`{"name":"bob"}`),
+	}}
+	rsp := &ResponseEvent{Code: "503", Message: Message{ID: 1,
+		Header: http.Header{"Content-Type": {"text/plain"}},
+		Timing: Timing{RequestStart: now, ResponseEnd: now.Add(300 * time.Millisecond)},
+	}}
+
+	cases := map[string]bool{
+		`host == api.example.com and path startswith /v2 and status >= 500`:      true,
+		`method = GET or query contains "id="`:                                   true,
+		`not (method in GET,HEAD) && body ~ "\"name\":\s*\"b"`:                   true,
+		`header.X-Request-Id == abc and resp.header.content-type == text/plain`:  true,
+		`latency > 200ms and latency < 1s`:                                       true,
+		`latency <= 200`:                                                         false,
+		`client in 10.0.0.0/8 and not server in 10.0.0.0/8`:                      true,
+		`path $= users and uri != "/v2/users"`:                                   true,
+		`header.Authorization`:                                                   false,
+		`status == 200 || status == 404`:                                         false,
+		`client.process == java and server.name == users and not server.process`: true,
+	}
+	for expr, expected := range cases {
+		f, err := ParseFilter(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := f.Match(Transaction{Request: req, Response: rsp}); m != expected {
+			t.Errorf("%s: %v", expr, m)
+		}
+	}
+
+	for _, expr := range []string{`foo == 1`, `status contains 5`, `(method == GET`, `path ~ "("`, `method ==`} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("%s: no error", expr)
+		}
+	}
+
+	f, _ := ParseFilter("status >= 500")
+	c := &collectHandler{}
+	h := NewFilteredHandler(f, c)
+	h.PushEvent(*req)
+	h.PushEvent(ResponseEvent{Code: "200", Message: Message{ID: 2}})
+	h.PushEvent(*rsp)
+	h.PushEvent(ParseErrorEvent{})
+	h.Wait()
+	if len(c.events) != 3 {
+		t.Fatalf("events: %+v", c.events)
+	}
+	if _, ok := c.events[0].(RequestEvent); !ok {
+		t.Errorf("request not emitted before response: %+v", c.events)
+	}
+}
+
+func TestFilterHeldEviction(t *testing.T) {
+	f, _ := ParseFilter("method == POST or status >= 500")
+	eventChan := make(chan Event, 1)
+	p := newPair(0, eventChan, false, f, nil, nil)
+	evicted := atomic.LoadUint64(&evictedHeld)
+
+	for id := 1; id <= cap(p.idChan)+1; id++ {
+		if p.filterRequest(&RequestEvent{Method: "POST", Message: Message{ID: id}}) {
+			t.Fatalf("request %d emitted before its response", id)
+		}
+	}
+
+	if len(p.held) != cap(p.idChan) || atomic.LoadUint64(&evictedHeld) != evicted+1 {
+		t.Errorf("held %d, evicted %d", len(p.held), atomic.LoadUint64(&evictedHeld)-evicted)
+	}
+	if _, ok := p.held[1]; ok {
+		t.Error("the oldest request is still held")
+	}
+	if e := <-eventChan; e.(RequestEvent).ID != 1 { // matched without response
+		t.Errorf("evicted %+v", e)
+	}
+}
+
+func TestFilteredHandlerEviction(t *testing.T) {
+	f, _ := ParseFilter("method == POST or status >= 500")
+	c := &collectHandler{}
+	h := NewFilteredHandler(f, c)
+	evicted := atomic.LoadUint64(&evictedHeld)
+
+	for id := 1; id <= maxPendingFilter+1; id++ {
+		h.PushEvent(RequestEvent{Method: "POST", Message: Message{StreamSeq: 1, ID: id}})
+	}
+	if len(c.events) != 1 || c.events[0].(RequestEvent).ID != 1 { // matched without response
+		t.Fatalf("%d events emitted", len(c.events))
+	}
+	if n := atomic.LoadUint64(&evictedHeld) - evicted; n != 1 {
+		t.Errorf("evicted %d", n)
+	}
+
+	h.PushEvent(ResponseEvent{Code: "200", Message: Message{StreamSeq: 1, ID: 2}})
+	if len(c.events) != 3 || c.events[1].(RequestEvent).ID != 2 || c.events[2].(ResponseEvent).ID != 2 {
+		t.Errorf("the held request lost its response: %d events", len(c.events))
+	}
+}
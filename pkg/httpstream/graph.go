@@ -0,0 +1,315 @@
+package httpstream
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxEdgeSamples limits the latencies kept per edge, the percentiles are of the latest ones.
+const maxEdgeSamples = 1000
+
+// Graph is the directed graph of who calls whom, latencies are in milliseconds.
+type Graph struct {
+	Generated time.Time    `json:"generated"`
+	Start     time.Time    `json:"start"`
+	End       time.Time    `json:"end"`
+	Nodes     []*GraphNode `json:"nodes"`
+	Edges     []*GraphEdge `json:"edges"`
+}
+
+// GraphNode is the clients and servers of a name, by the name mapping, the Host header, or the IP.
+type GraphNode struct {
+	ID        string   `json:"id"`
+	Addresses []string `json:"addresses"`
+	Requests  int      `json:"requests"` // the requests received
+	Calls     int      `json:"calls"`    // the requests sent
+}
+
+// GraphEdge is the calls from a node to another.
+type GraphEdge struct {
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	Requests  int     `json:"requests"`
+	Responses int     `json:"responses"`
+	Errors    int     `json:"errors"`    // the responses of 5xx
+	Rate      float64 `json:"rate"`      // requests per second during the graph
+	ErrorRate float64 `json:"errorRate"` // errors of the responses
+	P50       float64 `json:"p50"`
+	P90       float64 `json:"p90"`
+	P99       float64 `json:"p99"`
+	Max       float64 `json:"max"`
+}
+
+type graphEdgeKey struct{ from, to string }
+
+type graphEdge struct {
+	GraphEdge
+	samples []float64 // ring of latencies
+	next    int
+}
+
+// graphNode is an IP, as a client, a server or both. It is named by the name mapping of the IP, or the first host
+// of the Host headers it served, so that a server calling others is the same node as a client.
+type graphNode struct {
+	name, host string
+	addrs      map[string]bool
+	requests   int
+	calls      int
+}
+
+// EventGraph builds the dependency graph from the HTTP transactions,
+// serves it as JSON and DOT, and writes the DOT file when the capture ends.
+type EventGraph struct {
+	filename string
+
+	mu         sync.Mutex
+	start, end time.Time
+	nodes      map[string]*graphNode       // by IP
+	edges      map[graphEdgeKey]*graphEdge // by the IPs
+	pending    *pairer                     // of graphEdgeKey
+}
+
+// NewEventGraph creates EventGraph, which writes the DOT to filename at the end, empty for none.
+func NewEventGraph(filename string) *EventGraph {
+	return &EventGraph{
+		filename: filename,
+		nodes:    make(map[string]*graphNode),
+		edges:    make(map[graphEdgeKey]*graphEdge),
+		pending:  newPairer(maxPending, nil),
+	}
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (g *EventGraph) PushEvent(e Event) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch v := e.(type) {
+	case RequestEvent:
+		g.span(v.Start)
+		clientIP, _ := splitHostPort(v.ClientAddr)
+		serverIP, _ := splitHostPort(v.ServerAddr)
+		from, to := g.node(clientIP, clientIP, v.ClientName), g.node(serverIP, v.ServerAddr, v.ServerName)
+		from.calls++
+		to.requests++
+		if host := v.Header.Get("Host"); to.host == "" && host != "" {
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			to.host = host
+		}
+
+		key := graphEdgeKey{from: clientIP, to: serverIP}
+		edge, ok := g.edges[key]
+		if !ok {
+			edge = &graphEdge{}
+			g.edges[key] = edge
+		}
+		edge.Requests++
+
+		g.pending.add(v.Message, key)
+	case ResponseEvent:
+		g.span(v.End)
+		key, ok := g.pending.take(v.Message)
+		if !ok {
+			return
+		}
+
+		edge := g.edges[key.(graphEdgeKey)]
+		edge.Responses++
+		if strings.HasPrefix(v.Code, "5") {
+			edge.Errors++
+		}
+		if d := v.Timing.Total(); d > 0 {
+			edge.add(milliseconds(d))
+		}
+	default:
+		// bypass
+	}
+}
+
+func (e *graphEdge) add(latency float64) {
+	if len(e.samples) < maxEdgeSamples {
+		e.samples = append(e.samples, latency)
+		return
+	}
+	e.samples[e.next] = latency
+	e.next = (e.next + 1) % maxEdgeSamples
+}
+
+func (g *EventGraph) span(t time.Time) {
+	if g.start.IsZero() || t.Before(g.start) {
+		g.start = t
+	}
+	if t.After(g.end) {
+		g.end = t
+	}
+}
+
+// node returns the node of the IP, with the address, IP:port of a server or the IP of a client,
+// since its port is ephemeral, and the name of the address, empty if unknown.
+func (g *EventGraph) node(ip, addr, name string) *graphNode {
+	n, ok := g.nodes[ip]
+	if !ok {
+		n = &graphNode{addrs: make(map[string]bool)}
+		g.nodes[ip] = n
+	}
+	if name != "" {
+		n.name = name
+	}
+	n.addrs[addr] = true
+	return n
+}
+
+// id returns the node ID of the IP, by its name, the host of the Host headers, or the IP.
+func (g *EventGraph) id(ip string) string {
+	n := g.nodes[ip]
+	switch {
+	case n.name != "":
+		return n.name
+	case n.host != "":
+		return n.host
+	default:
+		return ip
+	}
+}
+
+// Graph returns the graph of the transactions pushed so far, the IPs of the same name are merged as a node.
+func (g *EventGraph) Graph() Graph {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	nodes := make(map[string]*GraphNode)
+	addrs := make(map[string]map[string]bool)
+	for ip, n := range g.nodes {
+		id := g.id(ip)
+		node, ok := nodes[id]
+		if !ok {
+			node = &GraphNode{ID: id}
+			nodes[id] = node
+			addrs[id] = make(map[string]bool)
+		}
+		node.Requests += n.requests
+		node.Calls += n.calls
+		for a := range n.addrs {
+			if !addrs[id][a] {
+				addrs[id][a] = true
+				node.Addresses = append(node.Addresses, a)
+			}
+		}
+	}
+
+	edges := make(map[graphEdgeKey]*graphEdge)
+	for k, e := range g.edges {
+		key := graphEdgeKey{from: g.id(k.from), to: g.id(k.to)}
+		edge, ok := edges[key]
+		if !ok {
+			edge = &graphEdge{GraphEdge: GraphEdge{From: key.from, To: key.to}}
+			edges[key] = edge
+		}
+		edge.Requests += e.Requests
+		edge.Responses += e.Responses
+		edge.Errors += e.Errors
+		edge.samples = append(edge.samples, e.samples...)
+	}
+
+	graph := Graph{Generated: time.Now(), Start: g.start, End: g.end,
+		Nodes: make([]*GraphNode, 0, len(nodes)), Edges: make([]*GraphEdge, 0, len(edges))}
+	for _, n := range nodes {
+		sort.Strings(n.Addresses)
+		graph.Nodes = append(graph.Nodes, n)
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].ID < graph.Nodes[j].ID })
+
+	seconds := g.end.Sub(g.start).Seconds()
+	if seconds < 1 {
+		seconds = 1
+	}
+	for _, e := range edges {
+		c := e.GraphEdge
+		c.Rate = float64(c.Requests) / seconds
+		if c.Responses > 0 {
+			c.ErrorRate = float64(c.Errors) / float64(c.Responses)
+		}
+
+		sort.Float64s(e.samples)
+		c.P50, c.P90, c.P99 = percentile(e.samples, 50), percentile(e.samples, 90), percentile(e.samples, 99)
+		c.Max = percentile(e.samples, 100)
+		graph.Edges = append(graph.Edges, &c)
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		a, b := graph.Edges[i], graph.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return graph
+}
+
+// WriteDot writes the graph in the Graphviz DOT language.
+func (g Graph) WriteDot(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, "digraph netgraph {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box];")
+	for _, n := range g.Nodes {
+		fmt.Fprintf(w, "  %s [tooltip=%s];\n", strconv.Quote(n.ID), strconv.Quote(strings.Join(n.Addresses, ", ")))
+	}
+	for _, e := range g.Edges {
+		label := fmt.Sprintf("%d req, %.2f/s\nerr %.1f%%, p90 %.1fms", e.Requests, e.Rate, e.ErrorRate*100, e.P90)
+		color := "black"
+		if e.Errors > 0 {
+			color = "red"
+		}
+		fmt.Fprintf(w, "  %s -> %s [label=%s, color=%s];\n",
+			strconv.Quote(e.From), strconv.Quote(e.To), strconv.Quote(label), color)
+	}
+	fmt.Fprintln(w, "}")
+	return w.Flush()
+}
+
+// ServeHTTP serves the graph as DOT if the path ends with .dot, or as JSON.
+func (g *EventGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	graph := g.Graph()
+	var err error
+	if strings.HasSuffix(r.URL.Path, ".dot") {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		err = graph.WriteDot(w)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(graph)
+	}
+	if err != nil {
+		log.Printf("E! write graph, error: %v", err)
+	}
+}
+
+// Wait implements the function of interface EventHandler.
+func (g *EventGraph) Wait() {
+	if g.filename == "" {
+		return
+	}
+
+	f, err := os.Create(g.filename)
+	if err != nil {
+		log.Printf("E! Cannot create graph %s, error: %v", g.filename, err)
+		return
+	}
+	defer f.Close()
+
+	if err := g.Graph().WriteDot(f); err != nil {
+		log.Printf("E! Write graph %s, error: %v", g.filename, err)
+	}
+}
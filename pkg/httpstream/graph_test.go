@@ -0,0 +1,66 @@
+package httpstream
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventGraph(t *testing.T) {
+	g := NewEventGraph("")
+
+	start := time.Now()
+	// orders calls the database before being named by the Host header it serves
+	g.PushEvent(RequestEvent{Method: "GET", URI: "/", Message: Message{StreamSeq: 2, ID: 1,
+		ClientAddr: "10.0.0.1:6000", ServerAddr: "10.0.0.2:5432", Start: start}})
+	for i, code := range []string{"200", "500", "200", "200"} {
+		msg := Message{StreamSeq: 1, ID: i + 1, ClientAddr: "10.0.0.9:5000", ClientName: "frontend", ServerAddr: "10.0.0.1:80",
+			Timing: Timing{RequestStart: start, ResponseEnd: start.Add(time.Duration(i+1) * 10 * time.Millisecond)}}
+		msg.Header = http.Header{"Host": {"orders:80"}}
+		msg.Start, msg.End = start.Add(time.Duration(i)*time.Second), start.Add(time.Duration(i)*time.Second)
+		g.PushEvent(RequestEvent{Method: "GET", URI: "/", Message: msg})
+		g.PushEvent(ResponseEvent{Code: code, Message: msg})
+	}
+	// another replica of frontend
+	g.PushEvent(RequestEvent{Method: "GET", URI: "/", Message: Message{StreamSeq: 3, ID: 1,
+		ClientAddr: "10.0.0.8:5000", ClientName: "frontend", ServerAddr: "10.0.0.1:80", Start: start}})
+
+	graph := g.Graph()
+	var ids []string
+	for _, n := range graph.Nodes {
+		ids = append(ids, n.ID)
+	}
+	if strings.Join(ids, " ") != "10.0.0.2 frontend orders" {
+		t.Fatalf("unexpected nodes %+v", graph.Nodes)
+	}
+	if n := graph.Nodes[2]; strings.Join(n.Addresses, " ") != "10.0.0.1 10.0.0.1:80" || n.Requests != 5 || n.Calls != 1 {
+		t.Errorf("unexpected node %+v", n)
+	}
+	if n := graph.Nodes[1]; strings.Join(n.Addresses, " ") != "10.0.0.8 10.0.0.9" || n.Calls != 5 {
+		t.Errorf("unexpected node %+v", n)
+	}
+	if len(graph.Edges) != 2 {
+		t.Fatalf("unexpected edges %+v", graph.Edges)
+	}
+
+	e := graph.Edges[0]
+	if e.From != "frontend" || e.To != "orders" || e.Requests != 5 || e.Responses != 4 || e.Errors != 1 {
+		t.Errorf("unexpected edge %+v", e)
+	}
+	if e.ErrorRate != 0.25 || e.P50 != 20 || e.Max != 40 || e.Rate != 5.0/3 {
+		t.Errorf("unexpected edge stats %+v", e)
+	}
+	if e := graph.Edges[1]; e.From != "orders" || e.To != "10.0.0.2" || e.Responses != 0 {
+		t.Errorf("unexpected edge %+v", e)
+	}
+
+	var out bytes.Buffer
+	if err := graph.WriteDot(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"frontend" -> "orders" [label="5 req, 1.67/s\nerr 25.0%, p90 40.0ms", color=red];`) {
+		t.Errorf("unexpected DOT:\n%s", out.String())
+	}
+}
@@ -0,0 +1,356 @@
+package httpstream
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HAR is the HTTP Archive 1.2, http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string      `json:"version"`
+	Creator HARCreator  `json:"creator"`
+	Pages   []*HARPage  `json:"pages"`
+	Entries []*HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HARPage groups the entries of a host, since there is no page in the captured traffic.
+type HARPage struct {
+	StartedDateTime time.Time      `json:"startedDateTime"`
+	ID              string         `json:"id"`
+	Title           string         `json:"title"`
+	PageTimings     HARPageTimings `json:"pageTimings"`
+}
+
+type HARPageTimings struct {
+	OnContentLoad float64 `json:"onContentLoad"`
+	OnLoad        float64 `json:"onLoad"`
+}
+
+type HAREntry struct {
+	Pageref         string      `json:"pageref"`
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []HARNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+type HARContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// HARTimings are in milliseconds, -1 if not applicable.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// EventHar records HTTP transactions as HAR, the file is written when the capture ends.
+type EventHar struct {
+	filename string
+	entries  []*HAREntry
+	pending  *pairer // of *HAREntry
+	pages    map[string]*HARPage
+}
+
+// NewEventHar creates EventHar.
+func NewEventHar(filename string) *EventHar {
+	return &EventHar{
+		filename: filename,
+		pending:  newPairer(maxPending, nil),
+		pages:    make(map[string]*HARPage),
+	}
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (h *EventHar) PushEvent(e Event) {
+	switch v := e.(type) {
+	case RequestEvent:
+		entry := h.newEntry(v)
+		h.entries = append(h.entries, entry)
+		h.pending.add(v.Message, entry)
+	case ResponseEvent:
+		if entry, ok := h.pending.take(v.Message); ok {
+			setHARResponse(entry.(*HAREntry), v)
+		}
+	default:
+		// bypass
+	}
+}
+
+// Wait implements the function of interface EventHandler.
+func (h *EventHar) Wait() {
+	har := HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "netgraph", Version: "1.0"},
+		Pages:   make([]*HARPage, 0, len(h.pages)),
+		Entries: h.entries,
+	}}
+	for _, p := range h.pages {
+		har.Log.Pages = append(har.Log.Pages, p)
+	}
+	sort.Slice(har.Log.Pages, func(i, j int) bool {
+		return har.Log.Pages[i].StartedDateTime.Before(har.Log.Pages[j].StartedDateTime)
+	})
+	sort.SliceStable(har.Log.Entries, func(i, j int) bool {
+		return har.Log.Entries[i].StartedDateTime.Before(har.Log.Entries[j].StartedDateTime)
+	})
+	if har.Log.Entries == nil {
+		har.Log.Entries = []*HAREntry{}
+	}
+
+	f, err := os.Create(h.filename)
+	if err != nil {
+		log.Printf("E! Cannot create HAR %s, error: %v", h.filename, err)
+		return
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(har); err != nil {
+		log.Printf("E! Write HAR %s, error: %v", h.filename, err)
+	}
+}
+
+func (h *EventHar) newEntry(v RequestEvent) *HAREntry {
+	host := v.Header.Get("Host")
+	if host == "" {
+		host = v.ServerAddr
+	}
+
+	page, ok := h.pages[host]
+	if !ok {
+		page = &HARPage{StartedDateTime: v.Start, ID: "page_" + strconv.Itoa(len(h.pages)+1), Title: host,
+			PageTimings: HARPageTimings{OnContentLoad: -1, OnLoad: -1}}
+		h.pages[host] = page
+	}
+
+	req := HARRequest{
+		Method:      v.Method,
+		URL:         harURL(host, v.URI),
+		HTTPVersion: v.Version,
+		Cookies:     harCookies((&http.Request{Header: v.Header}).Cookies()),
+		Headers:     harHeaders(v.Message),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    v.BodySize(),
+	}
+	if p := strings.Index(v.URI, "?"); p >= 0 {
+		req.QueryString = harParams(v.URI[p+1:])
+	}
+	if len(v.Body) > 0 {
+		req.PostData = harPostData(v.Header.Get("Content-Type"), v.Body)
+	}
+
+	serverIP, _, _ := net.SplitHostPort(v.ServerAddr)
+	entry := &HAREntry{
+		Pageref:         page.ID,
+		StartedDateTime: v.Start,
+		Request:         req,
+		Response: HARResponse{Cookies: []HARCookie{}, Headers: []HARNameValue{},
+			Content: HARContent{MimeType: "x-unknown"}, HeadersSize: -1, BodySize: -1},
+		ServerIPAddress: serverIP,
+		Connection:      strconv.FormatUint(uint64(v.StreamSeq), 10),
+	}
+	setHARTimings(entry, v.Timing)
+	return entry
+}
+
+func setHARResponse(entry *HAREntry, v ResponseEvent) {
+	status, _ := strconv.Atoi(v.Code)
+	mimeType := v.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = "x-unknown"
+	}
+
+	entry.Response = HARResponse{
+		Status:      status,
+		StatusText:  v.Reason,
+		HTTPVersion: v.Version,
+		Cookies:     harCookies((&http.Response{Header: v.Header}).Cookies()),
+		Headers:     harHeaders(v.Message),
+		Content:     HARContent{Size: v.BodySize(), MimeType: mimeType},
+		RedirectURL: v.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    v.BodySize(),
+	}
+	if len(v.Body) > 0 {
+		if isText(v.Body) {
+			entry.Response.Content.Text = string(v.Body)
+		} else {
+			entry.Response.Content.Text = base64.StdEncoding.EncodeToString(v.Body)
+			entry.Response.Content.Encoding = "base64"
+		}
+	}
+	setHARTimings(entry, v.Timing)
+}
+
+func setHARTimings(entry *HAREntry, t Timing) {
+	harMillis := func(d time.Duration, captured bool) float64 {
+		if !captured {
+			return -1
+		}
+		return milliseconds(d)
+	}
+
+	entry.Timings = HARTimings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: harMillis(t.Handshake, t.Handshake > 0),
+		Send:    milliseconds(t.Send()),
+		Wait:    milliseconds(t.Wait()),
+		Receive: milliseconds(t.Receive()),
+		SSL:     -1,
+	}
+	entry.Time = entry.Timings.Send + entry.Timings.Wait + entry.Timings.Receive
+	if entry.Timings.Connect > 0 {
+		entry.Time += entry.Timings.Connect
+	}
+}
+
+// harURL returns the URL of the request target, as it is if in the absolute form, eg. to a proxy.
+func harURL(host, uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.IsAbs() {
+		return uri
+	}
+	return "http://" + host + uri
+}
+
+// harHeaders returns the header fields in the order and case of the wire, as the ndjson events.
+func harHeaders(m Message) []HARNameValue {
+	records := headerRecords(m)
+	values := make([]HARNameValue, len(records))
+	for i, r := range records {
+		values[i] = HARNameValue{Name: r.Name, Value: r.Value}
+	}
+	return values
+}
+
+func harCookies(cookies []*http.Cookie) []HARCookie {
+	values := make([]HARCookie, len(cookies))
+	for i, c := range cookies {
+		values[i] = HARCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain,
+			HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			expires := c.Expires
+			values[i].Expires = &expires
+		}
+	}
+	return values
+}
+
+// harParams parses the parameters of the form a=1&b=2, keeping their orders.
+func harParams(s string) []HARNameValue {
+	values := []HARNameValue{}
+	for _, part := range strings.Split(s, "&") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		v := HARNameValue{Name: kv[0]}
+		if n, err := url.QueryUnescape(kv[0]); err == nil {
+			v.Name = n
+		}
+		if len(kv) == 2 {
+			v.Value = kv[1]
+			if value, err := url.QueryUnescape(kv[1]); err == nil {
+				v.Value = value
+			}
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+func harPostData(contentType string, body []byte) *HARPostData {
+	d := &HARPostData{MimeType: contentType, Params: []HARNameValue{}}
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/x-www-form-urlencoded" {
+		d.Params = harParams(string(body))
+	}
+
+	if isText(body) {
+		d.Text = string(body)
+	} else {
+		d.Text = base64.StdEncoding.EncodeToString(body)
+		d.Comment = "text is base64 encoded"
+	}
+	return d
+}
@@ -0,0 +1,90 @@
+package httpstream
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventHar(t *testing.T) {
+	start := time.Date(2021, 5, 19, 22, 35, 41, 0, time.UTC)
+	timing := Timing{RequestStart: start, RequestEnd: start.Add(time.Millisecond)}
+
+	filename := filepath.Join(t.TempDir(), "a.har")
+	h := NewEventHar(filename)
+	h.PushEvent(RequestEvent{Method: "POST", URI: "/login?next=%2Fhome&x", Version: "HTTP/1.1", Message: Message{
+		Start: start, StreamSeq: 1, ID: 1, ServerAddr: "10.0.0.1:80", Timing: timing,
+		Header: http.Header{"Host": {"example.com"}, "Cookie": {"sid=1; lang=en"},
+			"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body: []byte("user=a&pwd=b"),
+	}})
+	timing.ResponseStart, timing.ResponseEnd = start.Add(3*time.Millisecond), start.Add(4*time.Millisecond)
+	h.PushEvent(ResponseEvent{Code: "302", Reason: "Found", Version: "HTTP/1.1", Message: Message{
+		StreamSeq: 1, ID: 1, Timing: timing,
+		Header: http.Header{"Location": {"/home"}, "Set-Cookie": {"sid=2; Path=/; HttpOnly"},
+			"Content-Type": {"application/octet-stream"}},
+		Body: []byte{0, 1},
+	}})
+	h.Wait()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har HAR
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatal(err)
+	}
+
+	if har.Log.Version != "1.2" || len(har.Log.Pages) != 1 || len(har.Log.Entries) != 1 {
+		t.Fatalf("HAR: %s", data)
+	}
+	e := har.Log.Entries[0]
+	req, rsp := e.Request, e.Response
+	if req.URL != "http://example.com/login?next=%2Fhome&x" || len(req.Cookies) != 2 ||
+		len(req.QueryString) != 2 || req.QueryString[0].Value != "/home" {
+		t.Errorf("request: %+v", req)
+	}
+	if req.PostData == nil || len(req.PostData.Params) != 2 || req.PostData.Text != "user=a&pwd=b" {
+		t.Errorf("post data: %+v", req.PostData)
+	}
+	if rsp.Status != 302 || rsp.RedirectURL != "/home" || len(rsp.Cookies) != 1 || !rsp.Cookies[0].HTTPOnly ||
+		rsp.Content.Encoding != "base64" || rsp.Content.Text != "AAE=" {
+		t.Errorf("response: %+v", rsp)
+	}
+	if e.Timings.Send != 1 || e.Timings.Wait != 2 || e.Timings.Receive != 1 || e.Timings.Connect != -1 || e.Time != 4 {
+		t.Errorf("timings: %+v, time: %v", e.Timings, e.Time)
+	}
+}
+
+func TestEventHarRawRequest(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "a.har")
+	h := NewEventHar(filename)
+	raw := []Header{{Name: "host", Value: "example.com"}, {Name: "X-Forwarded-For", Value: "10.0.0.3"},
+		{Name: "X-Forwarded-For", Value: "10.0.0.4"}}
+	h.PushEvent(RequestEvent{Method: "GET", URI: "http://example.com:8080/a?b=1", Version: "HTTP/1.1",
+		Message: Message{StreamSeq: 1, ID: 1, ServerAddr: "10.0.0.1:3128", RawHeader: raw,
+			Header: http.Header{"Host": {"example.com"}, "X-Forwarded-For": {"10.0.0.3", "10.0.0.4"}}}})
+	h.Wait()
+
+	data, _ := ioutil.ReadFile(filename)
+	var har HAR
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatal(err)
+	}
+	req := har.Log.Entries[0].Request
+	if req.URL != "http://example.com:8080/a?b=1" || len(req.QueryString) != 1 {
+		t.Errorf("request: %+v", req)
+	}
+	if len(req.Headers) != len(raw) {
+		t.Fatalf("headers: %+v", req.Headers)
+	}
+	for i, h := range raw {
+		if req.Headers[i].Name != h.Name || req.Headers[i].Value != h.Value {
+			t.Errorf("headers: %+v", req.Headers)
+		}
+	}
+}
@@ -12,13 +12,13 @@ import (
 // EventJson records HTTP events as JSON.
 type EventJson struct {
 	filename string
-	Ch       chan RequestEvent
+	Ch       chan Event
 	StopCh   chan struct{}
 }
 
 // NewEventJson creates EventReplay.
 func NewEventJson(filename string) *EventJson {
-	e := &EventJson{filename: filename, Ch: make(chan RequestEvent, 1000), StopCh: make(chan struct{})}
+	e := &EventJson{filename: filename, Ch: make(chan Event, 1000), StopCh: make(chan struct{})}
 	go e.loop()
 	return e
 }
@@ -85,9 +85,9 @@ func createFileName(baseFileName string, seq *int, timeLayout string) string {
 }
 
 // PushEvent implements the function of interface EventHandler.
-func (p *EventJson) PushEvent(e interface{}) {
+func (p *EventJson) PushEvent(e Event) {
 	switch v := e.(type) {
-	case RequestEvent:
+	case RequestEvent, ParseErrorEvent:
 		p.Ch <- v
 	default:
 		// bypass
@@ -106,15 +106,48 @@ type RequestRecord struct {
 	Uri    string            `json:"uri"`
 	Header map[string]string `json:"header"`
 	Body   string            `json:"body"`
+	Timing *RecordTiming     `json:"timing,omitempty"`
+}
+
+// RecordTiming is the request timing in milliseconds.
+type RecordTiming struct {
+	Handshake float64 `json:"handshake,omitempty"`
+	Send      float64 `json:"send"`
 }
 
-func writeJSON(v RequestEvent, w io.Writer) {
+func milliseconds(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+// ParseErrorRecord is the record of malformed traffic, it can be told from RequestRecord by the error field.
+type ParseErrorRecord struct {
+	Time    string `json:"time"`
+	Stream  string `json:"stream"`
+	Stage   string `json:"stage"`
+	Error   string `json:"error"`
+	Snippet string `json:"snippet"`
+}
+
+func writeJSON(e Event, w io.Writer) {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	switch v := e.(type) {
+	case RequestEvent:
+		_ = encoder.Encode(newRequestRecord(v))
+	case ParseErrorEvent:
+		_ = encoder.Encode(ParseErrorRecord{Time: v.Time.Format(layout), Stream: v.Stream,
+			Stage: string(v.Stage), Error: v.Error, Snippet: v.Snippet})
+	}
+}
+
+func newRequestRecord(v RequestEvent) RequestRecord {
+	header := v.Header.Clone() // shared by the other handlers
 	for _, n := range []string{"User-Agent", "Host", "Connection", "Transfer-Encoding", "Content-Length"} {
-		v.Header.Del(n)
+		header.Del(n)
 	}
-	r := RequestRecord{Method: v.Method, Uri: v.URI, Header: ConvertHeaders(v.Header), Body: string(v.Body),
+	r := RequestRecord{Method: v.Method, Uri: v.URI, Header: ConvertHeaders(header), Body: string(v.Body),
 		Time: v.Start.Format(`2006-01-02 15:04:05.000`)}
-	encoder := json.NewEncoder(w)
-	encoder.SetEscapeHTML(false)
-	_ = encoder.Encode(r)
+	if !v.Timing.RequestStart.IsZero() {
+		r.Timing = &RecordTiming{Handshake: milliseconds(v.Timing.Handshake), Send: milliseconds(v.Timing.Send())}
+	}
+	return r
 }
@@ -0,0 +1,38 @@
+//go:build nopcap
+// +build nopcap
+
+package httpstream
+
+import (
+	"errors"
+	"net"
+)
+
+// newLiveSource fails, since the live capture by libpcap is not built in with the nopcap tag.
+func newLiveSource(device, bpf string, snapLen int) (PacketSource, error) {
+	return nil, errors.New("live capture is not supported by the build of nopcap tag, only pcap files can be read")
+}
+
+func AutoSelectDev() string {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return "any"
+	}
+
+	for _, i := range ifs {
+		addrs, _ := i.Addrs()
+		for _, a := range addrs {
+			n, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := n.IP
+			if ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			return i.Name
+		}
+	}
+
+	return "any"
+}
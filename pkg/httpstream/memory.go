@@ -0,0 +1,147 @@
+package httpstream
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// pageSize is the bytes of a page of tcpassembly, in which the out-of-order segments are buffered.
+const pageSize = 1900
+
+// memoryPages returns the pages of tcpassembly of the bytes shared by n, 0 for unlimited.
+func memoryPages(bytes, n int) int {
+	if bytes <= 0 {
+		return 0
+	}
+	if pages := bytes / pageSize / n; pages > 0 {
+		return pages
+	}
+	return 1
+}
+
+var (
+	errEvicted      = errors.New("over the total memory budget, dropped as the oldest stream")
+	errStreamBudget = errors.New("over the memory budget of stream")
+)
+
+var (
+	// the counters of the degradations for the memory budgets, accessed atomically.
+	evictedStreams, overBudgetStreams, truncatedBodies uint64
+)
+
+// streamOverhead is the bytes accounted for a stream besides its buffered bytes, for its goroutine, channel and
+// reader, so that the streams without bytes, eg. a flood of half-open connections, are within the budget too.
+const streamOverhead = 16 << 10
+
+// memoryBudget accounts the bytes buffered by the streams of a pipeline, queued to be parsed, in the buffers
+// of the readers or in the bodies being parsed, and the overhead of the streams. When the total is over the budget,
+// the oldest streams are dropped.
+type memoryBudget struct {
+	total, perStream int64 // 0 for unlimited
+	overhead         int64 // of a stream
+	used             int64 // accessed atomically
+
+	mu       sync.Mutex
+	streams  *list.List // of *streamMemory, in the order of their creation, without the evicted ones
+	evicting int64      // the bytes of the evicted streams to be released
+}
+
+func newMemoryBudget(total, perStream int64) *memoryBudget {
+	return &memoryBudget{total: total, perStream: perStream, overhead: streamOverhead,
+		streams: list.New()}
+}
+
+// Used returns the bytes buffered by the streams, and their overhead.
+func (b *memoryBudget) Used() int64 { return atomic.LoadInt64(&b.used) }
+
+// newStream creates the memory of a stream, which is released when both the parsing and the reassembly are done.
+func (b *memoryBudget) newStream() *streamMemory {
+	m := &streamMemory{budget: b, refs: 2, evicted: make(chan struct{})}
+	b.mu.Lock()
+	m.elem = b.streams.PushBack(m)
+	b.mu.Unlock()
+	m.alloc(int(b.overhead))
+	return m
+}
+
+// evict drops the oldest streams until the total is within the budget, when the evicted streams release their bytes.
+func (b *memoryBudget) evict() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := b.streams.Front()
+	for atomic.LoadInt64(&b.used)-b.evicting > b.total {
+		for e != nil && atomic.LoadInt64(&e.Value.(*streamMemory).used) == 0 { // nothing to release
+			e = e.Next()
+		}
+		if e == nil {
+			return
+		}
+
+		oldest := e.Value.(*streamMemory)
+		e = e.Next()
+		b.streams.Remove(oldest.elem)
+		oldest.elem = nil
+		oldest.evicting = atomic.LoadInt64(&oldest.used)
+		b.evicting += oldest.evicting
+		close(oldest.evicted)
+	}
+}
+
+// streamMemory is the bytes buffered by a stream, nil for unaccounted.
+type streamMemory struct {
+	budget  *memoryBudget
+	used    int64 // accessed atomically
+	refs    int32 // the parsing and the reassembly, accessed atomically
+	evicted chan struct{}
+
+	// elem and evicting are guarded by budget.mu, elem is nil once evicted.
+	elem     *list.Element
+	evicting int64
+}
+
+func (m *streamMemory) alloc(n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&m.used, int64(n))
+	if b := m.budget; atomic.AddInt64(&b.used, int64(n)) > b.total && b.total > 0 && n > 0 {
+		b.evict()
+	}
+}
+
+func (m *streamMemory) free(n int) { m.alloc(-n) }
+
+// limit returns the bytes a stream may buffer, 0 for unlimited.
+func (m *streamMemory) limit() int {
+	if m == nil {
+		return 0
+	}
+	return int(m.budget.perStream)
+}
+
+// evictedCh returns the channel closed when the stream is evicted.
+func (m *streamMemory) evictedCh() <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+	return m.evicted
+}
+
+// done is called when the parsing or the reassembly of the stream is done, the second one releases the bytes.
+func (m *streamMemory) done() {
+	if m == nil || atomic.AddInt32(&m.refs, -1) != 0 {
+		return
+	}
+
+	b := m.budget
+	b.mu.Lock()
+	if m.elem != nil {
+		b.streams.Remove(m.elem)
+	}
+	b.evicting -= m.evicting
+	b.mu.Unlock()
+	atomic.AddInt64(&b.used, -atomic.SwapInt64(&m.used, 0))
+}
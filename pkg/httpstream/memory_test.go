@@ -0,0 +1,89 @@
+package httpstream
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := newMemoryBudget(100, 0)
+	b.overhead = 0
+	idle, old, young := b.newStream(), b.newStream(), b.newStream()
+	old.alloc(60)
+	young.alloc(30)
+	young.alloc(30) // over the total, the oldest stream buffering bytes is evicted
+
+	evicted := func(m *streamMemory) bool {
+		select {
+		case <-m.evictedCh():
+			return true
+		default:
+			return false
+		}
+	}
+	if evicted(idle) || !evicted(old) || evicted(young) {
+		t.Errorf("evicted idle %v, old %v, young %v", evicted(idle), evicted(old), evicted(young))
+	}
+
+	young.alloc(10) // still within the budget after the evicted one is released
+	if evicted(young) {
+		t.Error("young evicted before old is released")
+	}
+
+	for _, m := range []*streamMemory{idle, old, young} {
+		m.done()
+		m.done() // both the parsing and the reassembly
+	}
+	if b.Used() != 0 || b.streams.Len() != 0 || b.evicting != 0 {
+		t.Errorf("used %d, streams %d, evicting %d", b.Used(), b.streams.Len(), b.evicting)
+	}
+
+	// the streams without bytes are evicted for their overhead
+	b.overhead = 40
+	first, second, third := b.newStream(), b.newStream(), b.newStream()
+	if !evicted(first) || evicted(second) || evicted(third) {
+		t.Errorf("evicted first %v, second %v, third %v", evicted(first), evicted(second), evicted(third))
+	}
+	for _, m := range []*streamMemory{first, second, third} {
+		m.done()
+		m.done()
+	}
+	if b.Used() != 0 || b.evicting != 0 {
+		t.Errorf("used %d, evicting %d", b.Used(), b.evicting)
+	}
+}
+
+func TestStreamMemoryBudget(t *testing.T) {
+	const limit = 4096
+	truncated := atomic.LoadUint64(&truncatedBodies)
+
+	eventChan := make(chan Event, 1024)
+	p, err := NewPipeline(eventChan, Options{Offline: true, MaxStreamMemory: limit, MaxMemory: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps, err := NewPacketSource("testdata/dump.pcap", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		p.Feed(ps)
+		p.Close()
+	}()
+
+	responses := 0
+	for e := range eventChan {
+		if r, ok := e.(ResponseEvent); ok {
+			responses++
+			if len(r.Body) > limit && r.Header.Get("Content-Encoding") == "" {
+				t.Errorf("response body %d bytes over the budget", len(r.Body))
+			}
+		}
+	}
+	if responses == 0 || atomic.LoadUint64(&truncatedBodies) == truncated {
+		t.Errorf("responses %d, no truncated bodies", responses)
+	}
+	if used := p.factories[0].budget.Used(); used != 0 {
+		t.Errorf("%d bytes not released", used)
+	}
+}
@@ -0,0 +1,351 @@
+package httpstream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricBuckets are the upper bounds of the latency histogram in seconds.
+var metricBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricPendingTimeout is how long a request waits for its response, by the time of events,
+// before it is counted as the one without response.
+const metricPendingTimeout = time.Minute
+
+// maxMetricSeries limits the label sets of the HTTP metrics, the routes beyond are labelled as otherRoute.
+const maxMetricSeries = 10000
+
+type metricLabels struct{ server, method, route, statusClass string }
+
+type metricSeries struct {
+	count    uint64   // the transactions
+	observed uint64   // the transactions with latencies
+	sum      float64  // the latencies in seconds
+	buckets  []uint64 // cumulative counts of metricBuckets
+}
+
+// EventMetrics exposes the RED metrics of the observed HTTP traffic and the internal metrics
+// in the Prometheus text format. The servers are labelled by their names, or addresses if unknown.
+type EventMetrics struct {
+	mu          sync.Mutex
+	series      map[metricLabels]*metricSeries
+	pending     *pairer // of metricLabels
+	parseErrors map[ParseStage]uint64
+}
+
+// NewEventMetrics creates EventMetrics.
+func NewEventMetrics() *EventMetrics {
+	m := &EventMetrics{
+		series:      make(map[metricLabels]*metricSeries),
+		parseErrors: make(map[ParseStage]uint64),
+	}
+	// count the requests without responses
+	m.pending = newPairer(maxPending, func(l interface{}) { m.observe(l.(metricLabels), 0) })
+	return m
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (m *EventMetrics) PushEvent(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch v := e.(type) {
+	case RequestEvent:
+		m.pending.expire(v.Start.Add(-metricPendingTimeout))
+
+		route := v.Route
+		if route == "" {
+			route = normalizeRoute(v.URI)
+		}
+		server := v.ServerName
+		if server == "" {
+			server = v.ServerAddr
+		}
+		m.pending.add(v.Message, metricLabels{server: server, method: v.Method, route: route, statusClass: "none"})
+	case ResponseEvent:
+		value, ok := m.pending.take(v.Message)
+		if !ok {
+			return
+		}
+
+		l := value.(metricLabels)
+		l.statusClass = statusClass(v.Code)
+		m.observe(l, v.Timing.Total())
+	case ParseErrorEvent:
+		m.parseErrors[v.Stage]++
+	default:
+		// bypass
+	}
+}
+
+// statusClass returns the class of the status code, eg. 2xx.
+func statusClass(code string) string {
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return "other"
+	}
+	return code[:1] + "xx"
+}
+
+// observe counts the transaction, and observes its latency if it is known.
+func (m *EventMetrics) observe(l metricLabels, latency time.Duration) {
+	s, ok := m.series[l]
+	if !ok {
+		if len(m.series) >= maxMetricSeries {
+			l.route = otherRoute
+		}
+		if s, ok = m.series[l]; !ok {
+			s = &metricSeries{buckets: make([]uint64, len(metricBuckets))}
+			m.series[l] = s
+		}
+	}
+
+	s.count++
+	if latency <= 0 {
+		return
+	}
+	s.observed++
+	seconds := latency.Seconds()
+	s.sum += seconds
+	for i, le := range metricBuckets {
+		if seconds <= le {
+			s.buckets[i]++
+		}
+	}
+}
+
+// Wait implements the function of interface EventHandler.
+func (m *EventMetrics) Wait() {}
+
+// ServeHTTP serves the metrics for Prometheus.
+func (m *EventMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := m.WriteTo(w); err != nil {
+		log.Printf("E! write metrics, error: %v", err)
+	}
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *EventMetrics) WriteTo(out io.Writer) (int64, error) {
+	cw := &countWriter{w: out}
+	w := bufio.NewWriter(cw)
+
+	m.writeHTTP(w)
+	writeInternalMetrics(w)
+
+	err := w.Flush()
+	return cw.n, err
+}
+
+func (m *EventMetrics) writeHTTP(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]metricLabels, 0, len(m.series))
+	for l := range m.series {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.server != b.server {
+			return a.server < b.server
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.statusClass < b.statusClass
+	})
+
+	writeMetricHeader(w, "netgraph_http_requests_total", "counter",
+		"HTTP requests observed, status_class is none for the requests without responses.")
+	for _, l := range labels {
+		fmt.Fprintf(w, "netgraph_http_requests_total{%s} %d\n", l, m.series[l].count)
+	}
+
+	writeMetricHeader(w, "netgraph_http_request_duration_seconds", "histogram",
+		"Latency from the first byte of request to the last byte of response.")
+	for _, l := range labels {
+		s := m.series[l]
+		if s.observed == 0 {
+			continue
+		}
+		for i, le := range metricBuckets {
+			fmt.Fprintf(w, "netgraph_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				l, strconv.FormatFloat(le, 'g', -1, 64), s.buckets[i])
+		}
+		fmt.Fprintf(w, "netgraph_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, s.observed)
+		fmt.Fprintf(w, "netgraph_http_request_duration_seconds_sum{%s} %g\n", l, s.sum)
+		fmt.Fprintf(w, "netgraph_http_request_duration_seconds_count{%s} %d\n", l, s.observed)
+	}
+
+	stages := make([]string, 0, len(m.parseErrors))
+	for stage := range m.parseErrors {
+		stages = append(stages, string(stage))
+	}
+	sort.Strings(stages)
+	writeMetricHeader(w, "netgraph_parse_errors_total", "counter",
+		"Malformed HTTP traffic by the parsing stage, stage stream counts the dropped streams.")
+	for _, stage := range stages {
+		fmt.Fprintf(w, "netgraph_parse_errors_total{stage=\"%s\"} %d\n",
+			escapeLabel(stage), m.parseErrors[ParseStage(stage)])
+	}
+}
+
+func (l metricLabels) String() string {
+	return fmt.Sprintf(`server="%s",method="%s",route="%s",status_class="%s"`,
+		escapeLabel(l.server), escapeLabel(l.method), escapeLabel(l.route), escapeLabel(l.statusClass))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var (
+	processedPackets uint64 // accessed atomically
+
+	pipelines     = make(map[*Pipeline]bool)
+	captures      = make(map[string]func() (CaptureStats, error))
+	internalsLock sync.Mutex
+)
+
+// CaptureStats is the statistics of a live capture.
+type CaptureStats struct {
+	Received  int // packets received
+	Dropped   int // packets dropped by the kernel
+	IfDropped int // packets dropped by the interface
+}
+
+// registerCapture registers the statistics of the live capture on the device.
+func registerCapture(device string, stats func() (CaptureStats, error)) {
+	internalsLock.Lock()
+	captures[device] = stats
+	internalsLock.Unlock()
+}
+
+func registerPipeline(p *Pipeline, running bool) {
+	internalsLock.Lock()
+	if running {
+		pipelines[p] = true
+	} else {
+		delete(pipelines, p)
+	}
+	internalsLock.Unlock()
+}
+
+func writeInternalMetrics(w io.Writer) {
+	writeMetricHeader(w, "netgraph_packets_processed_total", "counter", "TCP packets processed.")
+	fmt.Fprintf(w, "netgraph_packets_processed_total %d\n", atomic.LoadUint64(&processedPackets))
+
+	internalsLock.Lock()
+	var streams int32
+	var buffered int64
+	events := 0
+	for p := range pipelines {
+		for _, f := range p.factories {
+			streams += f.RunningStreamCount()
+		}
+		buffered += p.factories[0].budget.Used()
+		events += len(p.ech)
+	}
+	devices := make([]string, 0, len(captures))
+	for device := range captures {
+		devices = append(devices, device)
+	}
+	stats := make(map[string]CaptureStats, len(captures))
+	for _, device := range devices {
+		s, err := captures[device]()
+		if err != nil {
+			log.Printf("E! capture stats of %s, error: %v", device, err)
+			continue
+		}
+		stats[device] = s
+	}
+	internalsLock.Unlock()
+	sort.Strings(devices)
+
+	writeMetricHeader(w, "netgraph_active_streams", "gauge", "TCP streams being parsed.")
+	fmt.Fprintf(w, "netgraph_active_streams %d\n", streams)
+	writeMetricHeader(w, "netgraph_memory_buffered_bytes", "gauge",
+		"Bytes buffered by the TCP streams, queued to be parsed or in the bodies being parsed, and their overhead.")
+	fmt.Fprintf(w, "netgraph_memory_buffered_bytes %d\n", buffered)
+	writeMetricHeader(w, "netgraph_memory_streams_dropped_total", "counter",
+		"TCP streams dropped for the memory budgets, total for the oldest streams over the total budget.")
+	fmt.Fprintf(w, "netgraph_memory_streams_dropped_total{budget=\"total\"} %d\n", atomic.LoadUint64(&evictedStreams))
+	fmt.Fprintf(w, "netgraph_memory_streams_dropped_total{budget=\"stream\"} %d\n", atomic.LoadUint64(&overBudgetStreams))
+	writeMetricHeader(w, "netgraph_memory_bodies_truncated_total", "counter",
+		"HTTP bodies truncated to the memory budget of stream.")
+	fmt.Fprintf(w, "netgraph_memory_bodies_truncated_total %d\n", atomic.LoadUint64(&truncatedBodies))
+	writeMetricHeader(w, "netgraph_bodies_truncated_total", "counter", "HTTP bodies truncated to the body limits.")
+	fmt.Fprintf(w, "netgraph_bodies_truncated_total %d\n", atomic.LoadUint64(&limitedBodies))
+	writeMetricHeader(w, "netgraph_bodies_spilled_total", "counter", "HTTP bodies over the limits saved to the body directory.")
+	fmt.Fprintf(w, "netgraph_bodies_spilled_total %d\n", atomic.LoadUint64(&spilledBodies))
+	writeMetricHeader(w, "netgraph_filter_held_evicted_total", "counter",
+		"Filtered requests evicted from the ones held for their responses over the limits.")
+	fmt.Fprintf(w, "netgraph_filter_held_evicted_total %d\n", atomic.LoadUint64(&evictedHeld))
+	writeMetricHeader(w, "netgraph_otlp_spans_dropped_total", "counter",
+		"OpenTelemetry spans dropped after failing to be exported to the OTLP endpoint, or over the buffer.")
+	fmt.Fprintf(w, "netgraph_otlp_spans_dropped_total %d\n", atomic.LoadUint64(&otlpDroppedSpans))
+	writeMetricHeader(w, "netgraph_event_channel_length", "gauge", "Events waiting to be pushed to the outputs.")
+	fmt.Fprintf(w, "netgraph_event_channel_length %d\n", events)
+
+	queues := AllQueueStats()
+	writeMetricHeader(w, "netgraph_queue_length", "gauge", "Events waiting in the queue of the output.")
+	for _, q := range queues {
+		fmt.Fprintf(w, "netgraph_queue_length{queue=\"%s\"} %d\n", escapeLabel(q.Name), q.Queued)
+	}
+	writeMetricHeader(w, "netgraph_queue_lag_seconds", "gauge",
+		"How long the last handled event waited in the queue of the output.")
+	for _, q := range queues {
+		fmt.Fprintf(w, "netgraph_queue_lag_seconds{queue=\"%s\"} %g\n", escapeLabel(q.Name), q.Lag.Seconds())
+	}
+	writeMetricHeader(w, "netgraph_queue_dropped_total", "counter", "Events dropped by the queue of the output.")
+	for _, q := range queues {
+		fmt.Fprintf(w, "netgraph_queue_dropped_total{queue=\"%s\"} %d\n", escapeLabel(q.Name), q.Dropped)
+	}
+
+	for _, m := range []struct {
+		name, help string
+		value      func(CaptureStats) int
+	}{
+		{"netgraph_capture_packets_received_total", "Packets received by the capture.",
+			func(s CaptureStats) int { return s.Received }},
+		{"netgraph_capture_packets_dropped_total", "Packets dropped by the kernel for the capture.",
+			func(s CaptureStats) int { return s.Dropped }},
+		{"netgraph_capture_packets_if_dropped_total", "Packets dropped by the network interface.",
+			func(s CaptureStats) int { return s.IfDropped }},
+	} {
+		writeMetricHeader(w, m.name, "counter", m.help)
+		for _, device := range devices {
+			if s, ok := stats[device]; ok {
+				fmt.Fprintf(w, "%s{device=\"%s\"} %d\n", m.name, escapeLabel(device), m.value(s))
+			}
+		}
+	}
+}
+
+// countWriter counts the bytes written.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,50 @@
+package httpstream
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventMetrics(t *testing.T) {
+	m := NewEventMetrics()
+
+	start := time.Now()
+	for i, code := range []string{"200", "404", "200"} {
+		msg := Message{StreamSeq: 1, ID: i + 1, ServerAddr: "10.0.0.1:80",
+			Timing: Timing{RequestStart: start, ResponseEnd: start.Add(time.Duration(i+1) * 20 * time.Millisecond)}}
+		m.PushEvent(RequestEvent{Method: "GET", URI: "/users/" + code, Route: "/users/{id}", Message: msg})
+		m.PushEvent(ResponseEvent{Code: code, Message: msg})
+	}
+	m.PushEvent(ParseErrorEvent{Stage: StageHeader})
+
+	// only the requests waiting longer than the timeout are counted without responses
+	for i, d := range []time.Duration{0, 90 * time.Second, 2 * time.Minute} {
+		m.PushEvent(RequestEvent{Method: "POST", URI: "/orders", Message: Message{StreamSeq: 2, ID: i + 1,
+			ServerAddr: "10.0.0.2:80", Start: start.Add(d)}})
+	}
+	m.PushEvent(ResponseEvent{Code: "201", Message: Message{StreamSeq: 2, ID: 2}})
+
+	var out bytes.Buffer
+	if _, err := m.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := `server="10.0.0.1:80",method="GET",route="/users/{id}",status_class="2xx"`
+	for _, line := range []string{
+		`netgraph_http_requests_total{` + labels + `} 2`,
+		`netgraph_http_requests_total{server="10.0.0.1:80",method="GET",route="/users/{id}",status_class="4xx"} 1`,
+		`netgraph_http_request_duration_seconds_bucket{` + labels + `,le="0.025"} 1`,
+		`netgraph_http_request_duration_seconds_bucket{` + labels + `,le="0.1"} 2`,
+		`netgraph_http_request_duration_seconds_count{` + labels + `} 2`,
+		`netgraph_parse_errors_total{stage="header"} 1`,
+		`netgraph_http_requests_total{server="10.0.0.2:80",method="POST",route="/orders",status_class="none"} 1`,
+		`netgraph_http_requests_total{server="10.0.0.2:80",method="POST",route="/orders",status_class="2xx"} 1`,
+		`# TYPE netgraph_active_streams gauge`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %s in:\n%s", line, out.String())
+		}
+	}
+}
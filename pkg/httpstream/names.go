@@ -0,0 +1,320 @@
+package httpstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	namesReloadInterval = 5 * time.Second // how often the mapping file is checked for changes
+	maxLearnedNames     = 10000           // limits the server addresses named by Host headers and SNI
+)
+
+// Names resolves the addresses to service names, eg. 10.2.3.4:8080 to orders. The names are looked up in the order of
+//  1. the mappings of IP:port, IP or CIDR, the longest prefix first, which are given or read from the mapping file;
+//  2. the names learned from the Host headers and TLS SNI seen on the server address;
+//  3. the hostnames of the IPs in the hosts file.
+//
+// The mapping file is reloaded when it changes. A nil Names resolves no names.
+type Names struct {
+	given    []nameMapping
+	filename string
+
+	mu       sync.RWMutex
+	mappings []nameMapping // the given and the mapping file
+	modTime  time.Time
+	learned  map[string]string // by the server address
+	hosts    map[string]string // by the IP
+}
+
+// nameMapping maps an IP:port, or the IPs of the network to the name.
+type nameMapping struct {
+	addr string // IP:port, empty for the network
+	net  *net.IPNet
+	name string
+}
+
+// NewNames creates Names with the mappings as addr=name, addr is IP, IP:port or CIDR,
+// the mapping file of lines as "addr name", and the hosts file, eg. /etc/hosts, empty for none.
+func NewNames(mappings []string, filename, hostsFile string) (*Names, error) {
+	n := &Names{filename: filename, learned: make(map[string]string), hosts: make(map[string]string)}
+	for _, v := range mappings {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad name mapping %q, should be addr=name", v)
+		}
+		m, err := parseNameMapping(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, err
+		}
+		n.given = append(n.given, m)
+	}
+	n.mappings = sortNameMappings(n.given)
+
+	if hostsFile != "" {
+		hosts, err := readHostsFile(hostsFile)
+		if err != nil {
+			return nil, err
+		}
+		n.hosts = hosts
+	}
+
+	if filename != "" {
+		if err := n.Reload(); err != nil {
+			return nil, err
+		}
+		go n.watch()
+	}
+	return n, nil
+}
+
+// parseNameMapping parses the mapping of addr, which is IP, IP:port or CIDR.
+func parseNameMapping(addr, name string) (nameMapping, error) {
+	if name == "" {
+		return nameMapping{}, fmt.Errorf("no name of %q", addr)
+	}
+	if strings.Contains(addr, "/") {
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nameMapping{}, fmt.Errorf("bad CIDR %q of name %s", addr, name)
+		}
+		return nameMapping{net: ipnet, name: name}, nil
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nameMapping{}, fmt.Errorf("bad IP:port %q of name %s", addr, name)
+		}
+		return nameMapping{addr: net.JoinHostPort(ip.String(), port), name: name}, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nameMapping{}, fmt.Errorf("bad IP %q of name %s", addr, name)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return nameMapping{net: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, name: name}, nil
+}
+
+// sortNameMappings returns the mappings in the order of lookup, IP:port first, then the longer prefixes.
+func sortNameMappings(mappings []nameMapping) []nameMapping {
+	sorted := append([]nameMapping(nil), mappings...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if (a.addr != "") != (b.addr != "") {
+			return a.addr != ""
+		}
+		if a.net == nil || b.net == nil {
+			return false
+		}
+		ones1, _ := a.net.Mask.Size()
+		ones2, _ := b.net.Mask.Size()
+		return ones1 > ones2
+	})
+	return sorted
+}
+
+// Reload reads the mapping file if it is changed, the given mappings take precedence.
+func (n *Names) Reload() error {
+	stat, err := os.Stat(n.filename)
+	if err != nil {
+		return err
+	}
+	n.mu.RLock()
+	unchanged := stat.ModTime().Equal(n.modTime)
+	n.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(n.filename)
+	if err != nil {
+		return err
+	}
+	mappings := append([]nameMapping(nil), n.given...)
+	for i, fields := range fileFields(data) {
+		if len(fields) != 2 {
+			return fmt.Errorf("bad line %d of names %s, should be: addr name", i+1, n.filename)
+		}
+		m, err := parseNameMapping(fields[0], fields[1])
+		if err != nil {
+			return fmt.Errorf("names %s, %w", n.filename, err)
+		}
+		mappings = append(mappings, m)
+	}
+
+	n.mu.Lock()
+	n.mappings = sortNameMappings(mappings)
+	n.modTime = stat.ModTime()
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *Names) watch() {
+	ticker := time.NewTicker(namesReloadInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := n.Reload(); err != nil {
+			log.Printf("E! Reload names, error: %v", err)
+		}
+	}
+}
+
+// fileFields returns the fields of the lines, without the empty lines and # comments.
+func fileFields(data []byte) [][]string {
+	var lines [][]string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if p := strings.Index(line, "#"); p >= 0 {
+			line = line[:p]
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			lines = append(lines, fields)
+		}
+	}
+	return lines
+}
+
+// readHostsFile reads the first hostname of the IPs in the hosts file.
+func readHostsFile(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make(map[string]string)
+	for _, fields := range fileFields(data) {
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 || ip.IsLoopback() {
+			continue
+		}
+		if _, ok := hosts[ip.String()]; !ok {
+			hosts[ip.String()] = fields[1]
+		}
+	}
+	return hosts, nil
+}
+
+// Name returns the name of the address IP:port, empty if unknown.
+func (n *Names) Name(addr string) string {
+	if n == nil || addr == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, m := range n.mappings {
+		if m.addr != "" && m.addr == addr || m.net != nil && ip != nil && m.net.Contains(ip) {
+			return m.name
+		}
+	}
+	if name, ok := n.learned[addr]; ok {
+		return name
+	}
+	if ip != nil {
+		return n.hosts[ip.String()]
+	}
+	return ""
+}
+
+// Learn names the server address by the host of the Host header or TLS SNI, the IP literals are ignored.
+// The first name learned is kept, so that a server of virtual hosts, eg. a shared ingress, keeps its name.
+func (n *Names) Learn(serverAddr, host string) {
+	if n == nil || serverAddr == "" {
+		return
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "" || net.ParseIP(host) != nil {
+		return
+	}
+
+	n.mu.RLock()
+	_, ok := n.learned[serverAddr]
+	full := len(n.learned) >= maxLearnedNames
+	n.mu.RUnlock()
+	if ok || full {
+		return
+	}
+
+	n.mu.Lock()
+	if _, ok := n.learned[serverAddr]; !ok {
+		n.learned[serverAddr] = host
+	}
+	n.mu.Unlock()
+}
+
+// tlsServerName returns the SNI of the TLS ClientHello starting the payload, empty if none.
+// The ClientHello split into several segments is not supported.
+func tlsServerName(payload []byte) string {
+	// record: type(1)=handshake, version(2), length(2); handshake: type(1)=client_hello, length(3)
+	if len(payload) < 9 || payload[0] != 0x16 || payload[1] != 0x03 || payload[5] != 0x01 {
+		return ""
+	}
+	b := payload[9:]
+
+	// version(2), random(32), session id, cipher suites, compression methods
+	if len(b) < 34 {
+		return ""
+	}
+	b = b[34:]
+	for _, size := range []int{1, 2, 1} {
+		if len(b) < size {
+			return ""
+		}
+		n := int(b[0])
+		if size == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < size+n {
+			return ""
+		}
+		b = b[size+n:]
+	}
+
+	if len(b) < 2 {
+		return ""
+	}
+	b = b[2:] // extensions length, which may be beyond the segment
+	for len(b) >= 4 {
+		typ, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return ""
+		}
+		if typ == 0 { // server_name: list length(2), name type(1)=host_name, name length(2), name
+			ext := b[4 : 4+n]
+			if len(ext) < 5 || ext[2] != 0 {
+				return ""
+			}
+			l := int(binary.BigEndian.Uint16(ext[3:]))
+			if len(ext) < 5+l {
+				return ""
+			}
+			return string(ext[5 : 5+l])
+		}
+		b = b[4+n:]
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package httpstream
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNames(t *testing.T) {
+	dir := t.TempDir()
+	file, hosts := filepath.Join(dir, "names.txt"), filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(file, []byte("# addr name\n10.0.0.0/8 cluster\n10.1.0.0/16 team\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(hosts, []byte("127.0.0.1 localhost\n192.168.1.2 nas nas.lan\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := NewNames([]string{"10.1.2.3:8080=orders", "10.1.2.4=payments"}, file, hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Learn("192.168.1.9:80", "www.example.com:80")
+	n.Learn("192.168.1.9:80", "blog.example.com") // another virtual host keeps the first name
+	n.Learn("10.9.9.9:80", "www.example.com")
+	n.Learn("192.168.1.8:80", "192.168.1.8")
+
+	for addr, want := range map[string]string{
+		"10.1.2.3:8080":  "orders",
+		"10.1.2.3:9090":  "team",
+		"10.1.2.4:1234":  "payments",
+		"10.2.0.1:80":    "cluster",
+		"10.9.9.9:80":    "cluster",
+		"192.168.1.9:80": "www.example.com",
+		"192.168.1.2:22": "nas",
+		"192.168.1.8:80": "",
+		"127.0.0.1:80":   "",
+	} {
+		if got := n.Name(addr); got != want {
+			t.Errorf("Name(%s) = %q, want %q", addr, got, want)
+		}
+	}
+
+	// reload on change
+	if err := ioutil.WriteFile(file, []byte("10.0.0.0/8 renamed\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.Name("10.1.2.3:9090"); got != "renamed" {
+		t.Errorf("Name after reload = %q, want renamed", got)
+	}
+	if got := n.Name("10.1.2.3:8080"); got != "orders" {
+		t.Errorf("Name of the given mapping after reload = %q, want orders", got)
+	}
+
+	if _, err := NewNames([]string{"10.0.0.1"}, "", ""); err == nil {
+		t.Error("expect error of mapping without name")
+	}
+	if (*Names)(nil).Name("10.0.0.1:80") != "" {
+		t.Error("expect no name of nil Names")
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: "api.example.com"}).Handshake()
+		client.Close()
+	}()
+
+	buf := make([]byte, 4096)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tlsServerName(buf[:n]); got != "api.example.com" {
+		t.Errorf("tlsServerName = %q", got)
+	}
+	if got := tlsServerName([]byte("GET / HTTP/1.1\r\n")); got != "" {
+		t.Errorf("tlsServerName of HTTP = %q", got)
+	}
+}
@@ -0,0 +1,46 @@
+package httpstream
+
+import (
+	"bufio"
+	"log"
+	"os"
+)
+
+// EventNdjson writes all the events as newline delimited JSON of the schema netgraph.event/v1, one event a line.
+// Unlike EventJson, it keeps every field of the events for analytics, instead of the replay-able requests.
+type EventNdjson struct {
+	filename string
+	f        *os.File
+	w        *bufio.Writer
+}
+
+// NewEventNdjson creates EventNdjson.
+func NewEventNdjson(filename string) *EventNdjson {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o755)
+	if err != nil {
+		log.Fatalln("Cannot open writer ", filename)
+	}
+	return &EventNdjson{filename: filename, f: f, w: bufio.NewWriter(f)}
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (p *EventNdjson) PushEvent(e Event) {
+	data, err := MarshalEvent(e)
+	if err != nil {
+		log.Printf("E! %v", err)
+		return
+	}
+
+	data = append(data, '\n')
+	if _, err := p.w.Write(data); err != nil {
+		log.Printf("E! Write %s, error: %v", p.filename, err)
+	}
+}
+
+// Wait implements the function of interface EventHandler.
+func (p *EventNdjson) Wait() {
+	if err := p.w.Flush(); err != nil {
+		log.Printf("E! Write %s, error: %v", p.filename, err)
+	}
+	_ = p.f.Close()
+}
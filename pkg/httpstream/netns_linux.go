@@ -0,0 +1,56 @@
+package httpstream
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// InNetns runs fn in the network namespace of the file, eg. /proc/<pid>/ns/net, empty for the current one.
+// The sockets created by fn stay in the namespace, eg. of pcap, while the other goroutines, eg. of the web server,
+// stay in the current one.
+func InNetns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+
+	target, err := os.Open(netns)
+	if err != nil {
+		return fmt.Errorf("open network namespace %s, error: %w", netns, err)
+	}
+	defer target.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		// the namespace is of the thread, so the goroutine is locked to the thread until the namespace is restored,
+		// or the thread is terminated with the goroutine if it fails.
+		runtime.LockOSThread()
+
+		current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("open the current network namespace, error: %w", err)
+			return
+		}
+		defer current.Close()
+
+		if err := setns(target); err != nil {
+			runtime.UnlockOSThread()
+			errCh <- fmt.Errorf("enter network namespace %s, error: %w", netns, err)
+			return
+		}
+
+		fnErr := fn()
+		if err := setns(current); err != nil {
+			errCh <- fmt.Errorf("restore network namespace, error: %w", err)
+			return
+		}
+		runtime.UnlockOSThread()
+		errCh <- fnErr
+	}()
+	return <-errCh
+}
+
+func setns(ns *os.File) error { return unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET) }
@@ -0,0 +1,30 @@
+package httpstream
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestInNetns(t *testing.T) {
+	called := false
+	if err := InNetns("", func() error { called = true; return nil }); err != nil || !called {
+		t.Errorf("expect fn called in the current namespace, error: %v", err)
+	}
+	if err := InNetns("/nonexistent/ns/net", func() error { return nil }); err == nil {
+		t.Error("expect error of the nonexistent namespace")
+	}
+
+	var ifs []net.Interface
+	err := InNetns("/proc/self/ns/net", func() (err error) {
+		ifs, err = net.Interfaces()
+		return err
+	})
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("no privilege to enter network namespaces")
+	}
+	if err != nil || len(ifs) == 0 {
+		t.Errorf("unexpected interfaces %v, error: %v", ifs, err)
+	}
+}
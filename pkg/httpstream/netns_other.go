@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package httpstream
+
+import "errors"
+
+// InNetns runs fn in the network namespace of the file, network namespaces are only supported on Linux.
+func InNetns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+	return errors.New("network namespaces are only supported on Linux")
+}
@@ -0,0 +1,73 @@
+package httpstream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngMagic is the type of the section header block which starts a pcapng file, the same in both byte orders.
+const pcapngMagic = 0x0A0D0D0A
+
+// pcapFileReader is the reader of pcap or pcapng files.
+type pcapFileReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// offlineSource reads the packets of a pcap or pcapng file in Go, without libpcap,
+// and closes the file at the end.
+type offlineSource struct {
+	packets chan gopacket.Packet
+}
+
+// newOfflineSource creates a PacketSource of the pcap or pcapng file, whose packets are filtered by the BPF subset
+// of packetFilter.
+func newOfflineSource(filename, bpf string) (PacketSource, error) {
+	filter, err := parsePacketFilter(bpf)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(4)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var r pcapFileReader
+	if binary.LittleEndian.Uint32(magic) == pcapngMagic {
+		r, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	} else {
+		r, err = pcapgo.NewReader(br) // also gzipped
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	s := &offlineSource{packets: make(chan gopacket.Packet, 1000)}
+	go func() {
+		defer f.Close()
+		defer close(s.packets)
+
+		for p := range gopacket.NewPacketSource(r, r.LinkType()).Packets() {
+			if filter == nil || filter.Match(p) {
+				s.packets <- p
+			}
+		}
+	}()
+	return s, nil
+}
+
+// Packets returns the channel of the packets of the file.
+func (s *offlineSource) Packets() chan gopacket.Packet { return s.packets }
@@ -0,0 +1,101 @@
+package httpstream
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPacketFilter(t *testing.T) {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("10.1.2.3").To4(), DstIP: net.ParseIP("192.168.0.1").To4()}
+	tcp := &layers.TCP{SrcPort: 5000, DstPort: 8080, SYN: true}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		eth, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+
+	cases := map[string]bool{
+		`tcp and dst port 8080`:                      true,
+		`tcp dst port 80`:                            false,
+		`src host 10.1.2.3 && !(udp || ip6)`:         true,
+		`dst host 10.1.2.3`:                          false,
+		`net 192.168.0.0/16 and portrange 8000-8100`: true,
+		`src net 192.168.0.0/16`:                     false,
+		`ip and (port 80 or port 5000) and not udp`:  true,
+		`udp or ip6 or tcp src portrange 5001-6000`:  false,
+	}
+	for expr, expected := range cases {
+		f, err := parsePacketFilter(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Match(packet) != expected {
+			t.Errorf("%s: %v", expr, !expected)
+		}
+	}
+
+	for _, expr := range []string{`ether host 1`, `port http`, `host`, `(tcp`, `portrange 9-1`, `tcp port 80 8080`} {
+		if _, err := parsePacketFilter(expr); err == nil {
+			t.Errorf("%s: no error", expr)
+		}
+	}
+}
+
+func TestOfflineSource(t *testing.T) {
+	ps, err := NewPacketSource("testdata/dump.pcap", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pcapng file of the same packets.
+	filename := filepath.Join(t.TempDir(), "dump.pcapng")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, requests := 0, 0
+	for p := range ps.Packets() {
+		ci := p.Metadata().CaptureInfo
+		ci.InterfaceIndex = 0
+		if err := w.WritePacket(ci, p.Data()); err != nil {
+			t.Fatal(err)
+		}
+		packets++
+		if tcp, ok := p.TransportLayer().(*layers.TCP); ok && tcp.DstPort == 80 {
+			requests++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for bpf, expected := range map[string]int{"": packets, "tcp and dst port 80": requests} {
+		ps, err := NewPacketSource(filename, bpf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for range ps.Packets() {
+			n++
+		}
+		if n != expected || n == 0 {
+			t.Errorf("pcapng %q, expected %d packets, got %d", bpf, expected, n)
+		}
+	}
+}
@@ -0,0 +1,558 @@
+package httpstream
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// OTLP JSON encoding of traces, https://github.com/open-telemetry/opentelemetry-proto,
+// the IDs are hex strings and the 64-bit integers are decimal strings.
+type (
+	OtlpTracesData struct {
+		ResourceSpans []*OtlpResourceSpans `json:"resourceSpans"`
+	}
+
+	OtlpResourceSpans struct {
+		Resource   OtlpResource      `json:"resource"`
+		ScopeSpans []*OtlpScopeSpans `json:"scopeSpans"`
+	}
+
+	OtlpResource struct {
+		Attributes []OtlpKeyValue `json:"attributes"`
+	}
+
+	OtlpScopeSpans struct {
+		Scope OtlpScope   `json:"scope"`
+		Spans []*OtlpSpan `json:"spans"`
+	}
+
+	OtlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+
+	OtlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []OtlpKeyValue `json:"attributes"`
+		Events            []OtlpEvent    `json:"events,omitempty"`
+		Status            OtlpStatus     `json:"status"`
+	}
+
+	OtlpEvent struct {
+		TimeUnixNano string `json:"timeUnixNano"`
+		Name         string `json:"name"`
+	}
+
+	OtlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+
+	OtlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value OtlpValue `json:"value"`
+	}
+
+	OtlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+const (
+	otlpSpanKindServer  = 2
+	otlpStatusError     = 2
+	otlpBatchSize       = 512
+	otlpMaxBuffered     = 16 * otlpBatchSize // the spans buffered while exporting, over which they are dropped
+	otlpFlushInterval   = 5 * time.Second
+	otlpDefaultHTTPPath = "/v1/traces"
+	otlpGRPCPath        = "/opentelemetry.proto.collector.trace.v1.TraceService/Export"
+	otlpRetries         = 3
+	otlpRetryWait       = time.Second // doubled on each retry
+)
+
+// otlpDroppedSpans counts the spans dropped for failing to be exported, accessed atomically.
+var otlpDroppedSpans uint64
+
+// EventOtlp exports the HTTP transactions as OpenTelemetry spans, to an OTLP/HTTP endpoint with the JSON encoding,
+// to an OTLP/gRPC endpoint, or to a file of OTLP JSON lines. The spans are grouped by the server as the resource
+// service.name. The failed exports are retried, and the spans are dropped after the retries.
+type EventOtlp struct {
+	target   string // the endpoint URL or the filename
+	client   *http.Client
+	grpc     bool
+	f        *os.File
+	w        *bufio.Writer
+	pending  *pairer // of RequestEvent
+	mu       sync.Mutex
+	spans    map[string][]*OtlpSpan // by service
+	buffered int
+	full     chan struct{} // signals flushLoop to export a full batch
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewEventOtlp creates EventOtlp, target is the OTLP/HTTP endpoint like http://localhost:4318,
+// the OTLP/gRPC endpoint like grpc://localhost:4317, grpcs:// for TLS, or the filename.
+func NewEventOtlp(target string) *EventOtlp {
+	o := &EventOtlp{
+		target: target,
+		spans:  make(map[string][]*OtlpSpan),
+		full:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	// export the requests without responses
+	o.pending = newPairer(maxPending, func(req interface{}) { o.add(NewOtlpSpan(req.(RequestEvent), nil)) })
+
+	if IsOtlpEndpoint(target) {
+		u, err := url.Parse(target)
+		if err != nil {
+			log.Fatalln("Bad OTLP endpoint ", target)
+		}
+		o.client = &http.Client{Timeout: 10 * time.Second}
+		switch u.Scheme {
+		case "grpc", "grpcs":
+			o.grpc = true
+			o.client.Transport = newGRPCTransport(u.Scheme == "grpc")
+			u.Scheme = strings.Replace(u.Scheme, "grpc", "http", 1)
+			u.Path = otlpGRPCPath
+		default:
+			if u.Path == "" || u.Path == "/" {
+				u.Path = otlpDefaultHTTPPath
+			}
+		}
+		o.target = u.String()
+	} else {
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o755)
+		if err != nil {
+			log.Fatalln("Cannot open writer ", target)
+		}
+		o.f, o.w = f, bufio.NewWriter(f)
+	}
+
+	go o.flushLoop()
+	return o
+}
+
+// IsOtlpEndpoint tells whether the target is an OTLP/HTTP or OTLP/gRPC endpoint instead of a file.
+func IsOtlpEndpoint(target string) bool {
+	for _, scheme := range []string{"http://", "https://", "grpc://", "grpcs://"} {
+		if strings.HasPrefix(target, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// newGRPCTransport creates the HTTP/2 transport of gRPC, over cleartext TCP (h2c) if plain.
+func newGRPCTransport(plain bool) *http2.Transport {
+	if !plain {
+		return &http2.Transport{}
+	}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.DialTimeout(network, addr, 10*time.Second)
+		},
+	}
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (o *EventOtlp) PushEvent(e Event) {
+	switch v := e.(type) {
+	case RequestEvent:
+		o.pending.add(v.Message, v)
+	case ResponseEvent:
+		if req, ok := o.pending.take(v.Message); ok {
+			o.add(NewOtlpSpan(req.(RequestEvent), &v))
+		}
+	default:
+		// bypass
+	}
+}
+
+// add buffers the span, a full batch is exported by flushLoop, so that the slow exports do not block PushEvent.
+func (o *EventOtlp) add(service string, span *OtlpSpan) {
+	o.mu.Lock()
+	if o.buffered >= otlpMaxBuffered {
+		o.mu.Unlock()
+		atomic.AddUint64(&otlpDroppedSpans, 1)
+		return
+	}
+	o.spans[service] = append(o.spans[service], span)
+	o.buffered++
+	full := o.buffered >= otlpBatchSize
+	o.mu.Unlock()
+
+	if full {
+		select {
+		case o.full <- struct{}{}:
+		default: // signaled already
+		}
+	}
+}
+
+func (o *EventOtlp) flushLoop() {
+	defer close(o.done)
+
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			o.flush()
+		case <-o.full:
+			o.flush()
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+// flush exports the buffered spans as a batch.
+func (o *EventOtlp) flush() {
+	o.mu.Lock()
+	spans := o.spans
+	o.spans, o.buffered = make(map[string][]*OtlpSpan), 0
+	o.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	n := 0
+	for _, s := range spans {
+		n += len(s)
+	}
+	d := newOtlpTracesData(spans)
+
+	if o.client == nil {
+		data, err := json.Marshal(d)
+		if err != nil {
+			log.Printf("E! Marshal OTLP spans, error: %v", err)
+			return
+		}
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		if _, err := o.w.Write(append(data, '\n')); err != nil {
+			log.Printf("E! Write %s, error: %v", o.target, err)
+		}
+		return
+	}
+
+	var data []byte
+	if o.grpc {
+		data = marshalOtlpProto(d)
+	} else {
+		var err error
+		if data, err = json.Marshal(d); err != nil {
+			log.Printf("E! Marshal OTLP spans, error: %v", err)
+			return
+		}
+	}
+	for retry := 0; ; retry++ {
+		retryable, err := o.export(data)
+		if err == nil {
+			return
+		}
+		if !retryable || retry >= otlpRetries {
+			atomic.AddUint64(&otlpDroppedSpans, uint64(n))
+			log.Printf("E! Export %d OTLP spans to %s, dropped, error: %v", n, o.target, err)
+			return
+		}
+		log.Printf("W! Export OTLP spans to %s, retry, error: %v", o.target, err)
+		time.Sleep(otlpRetryWait << retry)
+	}
+}
+
+// export posts the encoded spans, and tells whether to retry if failed,
+// by the retryable statuses of the OTLP specification.
+func (o *EventOtlp) export(data []byte) (retryable bool, err error) {
+	if !o.grpc {
+		rsp, err := o.client.Post(o.target, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return true, err
+		}
+		_, _ = io.Copy(ioutil.Discard, rsp.Body)
+		_ = rsp.Body.Close()
+		switch rsp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, fmt.Errorf("status: %s", rsp.Status)
+		}
+		if rsp.StatusCode/100 != 2 {
+			return false, fmt.Errorf("status: %s", rsp.Status)
+		}
+		return false, nil
+	}
+
+	// a gRPC message is prefixed by the compressed flag and the 4-byte length
+	frame := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	req, err := http.NewRequest(http.MethodPost, o.target, bytes.NewReader(append(frame, data...)))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	rsp, err := o.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, err = io.Copy(ioutil.Discard, rsp.Body) // the trailers follow the body
+	_ = rsp.Body.Close()
+	if err != nil {
+		return true, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return rsp.StatusCode == http.StatusServiceUnavailable, fmt.Errorf("status: %s", rsp.Status)
+	}
+
+	status, message := rsp.Trailer.Get("Grpc-Status"), rsp.Trailer.Get("Grpc-Message")
+	if status == "" { // a trailers-only response
+		status, message = rsp.Header.Get("Grpc-Status"), rsp.Header.Get("Grpc-Message")
+	}
+	switch status {
+	case "0":
+		return false, nil
+	case "1", "4", "8", "10", "11", "14", "15": // CANCELLED, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED ...
+		return true, fmt.Errorf("grpc-status: %s %s", status, message)
+	default:
+		return false, fmt.Errorf("grpc-status: %q %s", status, message)
+	}
+}
+
+// Wait implements the function of interface EventHandler.
+func (o *EventOtlp) Wait() {
+	close(o.stop)
+	<-o.done
+
+	o.pending.flush()
+	o.flush()
+	if o.f != nil {
+		if err := o.w.Flush(); err != nil {
+			log.Printf("E! Write %s, error: %v", o.target, err)
+		}
+		_ = o.f.Close()
+	}
+}
+
+func newOtlpTracesData(spans map[string][]*OtlpSpan) OtlpTracesData {
+	services := make([]string, 0, len(spans))
+	for s := range spans {
+		services = append(services, s)
+	}
+	sort.Strings(services)
+
+	d := OtlpTracesData{ResourceSpans: make([]*OtlpResourceSpans, len(services))}
+	for i, s := range services {
+		d.ResourceSpans[i] = &OtlpResourceSpans{
+			Resource: OtlpResource{Attributes: []OtlpKeyValue{otlpString("service.name", s)}},
+			ScopeSpans: []*OtlpScopeSpans{{
+				Scope: OtlpScope{Name: "netgraph", Version: "1.0"},
+				Spans: spans[s],
+			}},
+		}
+	}
+	return d
+}
+
+// NewOtlpSpan creates the span of the HTTP transaction with the HTTP semantic conventions,
+// and returns the service name of the server. rsp is nil if the request got no response.
+func NewOtlpSpan(req RequestEvent, rsp *ResponseEvent) (service string, span *OtlpSpan) {
+	route := req.Route
+	if route == "" {
+		route = normalizeRoute(req.URI)
+	}
+
+	traceID, parentID := traceContext(req.Header)
+	if traceID == "" {
+		traceID = randomHex(16)
+	}
+	span = &OtlpSpan{
+		TraceID:      traceID,
+		SpanID:       randomHex(8),
+		ParentSpanID: parentID,
+		Name:         req.Method + " " + route,
+		Kind:         otlpSpanKindServer,
+	}
+
+	host := req.Header.Get("Host")
+	serverHost, serverPort := splitHostPort(req.ServerAddr)
+	clientHost, clientPort := splitHostPort(req.ClientAddr)
+	service = req.ServerName
+	if service == "" {
+		service = host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			service = h
+		}
+	}
+	if service == "" {
+		service = serverHost
+	}
+
+	path, query := routePath(req.URI), ""
+	if p := strings.Index(req.URI, "?"); p >= 0 {
+		query = req.URI[p+1:]
+	}
+	span.Attributes = []OtlpKeyValue{
+		otlpString("http.request.method", req.Method),
+		otlpString("http.route", route),
+		otlpString("url.path", path),
+		otlpString("url.scheme", "http"),
+		otlpString("server.address", serverHost),
+		otlpInt("server.port", serverPort),
+		otlpString("client.address", clientHost),
+		otlpInt("client.port", clientPort),
+		otlpString("network.protocol.name", "http"),
+		otlpString("network.protocol.version", strings.TrimPrefix(req.Version, "HTTP/")),
+		otlpInt("http.request.body.size", req.BodySize()),
+	}
+	if query != "" {
+		span.Attributes = append(span.Attributes, otlpString("url.query", query))
+	}
+	if req.ClientName != "" {
+		span.Attributes = append(span.Attributes, otlpString("netgraph.client.name", req.ClientName))
+	}
+	if ua := req.Header.Get("User-Agent"); ua != "" {
+		span.Attributes = append(span.Attributes, otlpString("user_agent.original", ua))
+	}
+
+	timing := req.Timing
+	end := req.End
+	if rsp != nil {
+		timing, end = rsp.Timing, rsp.End
+		status, _ := strconv.Atoi(rsp.Code)
+		span.Attributes = append(span.Attributes,
+			otlpInt("http.response.status_code", status), otlpInt("http.response.body.size", rsp.BodySize()))
+		if status >= 500 {
+			span.Status = OtlpStatus{Code: otlpStatusError}
+			span.Attributes = append(span.Attributes, otlpString("error.type", rsp.Code))
+		}
+	} else {
+		span.Status = OtlpStatus{Code: otlpStatusError, Message: "no response captured"}
+	}
+
+	// the captured timings, in milliseconds like the other outputs.
+	for _, t := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"netgraph.timing.handshake_ms", timing.Handshake}, {"netgraph.timing.send_ms", timing.Send()},
+		{"netgraph.timing.wait_ms", timing.Wait()}, {"netgraph.timing.receive_ms", timing.Receive()},
+	} {
+		if t.d > 0 {
+			span.Attributes = append(span.Attributes, otlpDouble(t.name, milliseconds(t.d)))
+		}
+	}
+
+	span.StartTimeUnixNano = unixNano(req.Start)
+	span.EndTimeUnixNano = unixNano(end)
+	if !timing.RequestEnd.IsZero() {
+		span.Events = append(span.Events, OtlpEvent{TimeUnixNano: unixNano(timing.RequestEnd), Name: "request sent"})
+	}
+	if !timing.ResponseStart.IsZero() {
+		span.Events = append(span.Events, OtlpEvent{TimeUnixNano: unixNano(timing.ResponseStart), Name: "first byte received"})
+	}
+	return service, span
+}
+
+// traceContext returns the trace ID and the parent span ID of W3C traceparent or B3 headers, empty if absent.
+func traceContext(h http.Header) (traceID, parentID string) {
+	if tp := strings.Split(strings.TrimSpace(h.Get("Traceparent")), "-"); len(tp) >= 4 {
+		if isHexID(tp[1], 32) && isHexID(tp[2], 16) {
+			return strings.ToLower(tp[1]), strings.ToLower(tp[2])
+		}
+	}
+
+	// b3: {TraceId}-{SpanId}-{SamplingState}-{ParentSpanId}
+	if b3 := strings.Split(strings.TrimSpace(h.Get("B3")), "-"); len(b3) >= 2 {
+		traceID, parentID = b3[0], b3[1]
+	} else {
+		traceID, parentID = h.Get("X-B3-Traceid"), h.Get("X-B3-Spanid")
+	}
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if !isHexID(traceID, 32) {
+		return "", ""
+	}
+	if !isHexID(parentID, 16) {
+		parentID = ""
+	}
+	return strings.ToLower(traceID), strings.ToLower(parentID)
+}
+
+// isHexID tells whether s is a valid hex ID of n digits, which are not all zero.
+func isHexID(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func splitHostPort(addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func unixNano(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpString(key, value string) OtlpKeyValue {
+	return OtlpKeyValue{Key: key, Value: OtlpValue{StringValue: &value}}
+}
+
+func otlpInt(key string, value int) OtlpKeyValue {
+	s := strconv.Itoa(value)
+	return OtlpKeyValue{Key: key, Value: OtlpValue{IntValue: &s}}
+}
+
+func otlpDouble(key string, value float64) OtlpKeyValue {
+	return OtlpKeyValue{Key: key, Value: OtlpValue{DoubleValue: &value}}
+}
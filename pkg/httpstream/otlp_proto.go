@@ -0,0 +1,143 @@
+package httpstream
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strconv"
+)
+
+// protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// protoBuffer encodes the protobuf messages of OTLP by hand, only the fields netgraph exports,
+// the field numbers are of opentelemetry/proto/collector/trace/v1/trace_service.proto and its imports.
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	*b = append(*b, make([]byte, binary.MaxVarintLen64)...)
+	n := binary.PutUvarint((*b)[len(*b)-binary.MaxVarintLen64:], v)
+	*b = (*b)[:len(*b)-binary.MaxVarintLen64+n]
+}
+
+func (b *protoBuffer) tag(field, wireType int) { b.varint(uint64(field)<<3 | uint64(wireType)) }
+
+func (b *protoBuffer) uint(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, protoVarint)
+		b.varint(v)
+	}
+}
+
+func (b *protoBuffer) fixed64(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, protoFixed64)
+		*b = append(*b, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64((*b)[len(*b)-8:], v)
+	}
+}
+
+func (b *protoBuffer) bytes(field int, v []byte) {
+	if len(v) != 0 {
+		b.tag(field, protoBytes)
+		b.varint(uint64(len(v)))
+		*b = append(*b, v...)
+	}
+}
+
+func (b *protoBuffer) string(field int, v string) { b.bytes(field, []byte(v)) }
+
+// message encodes the embedded message of field by encode, even if empty.
+func (b *protoBuffer) message(field int, encode func(m *protoBuffer)) {
+	var m protoBuffer
+	encode(&m)
+	b.tag(field, protoBytes)
+	b.varint(uint64(len(m)))
+	*b = append(*b, m...)
+}
+
+// marshalOtlpProto encodes the traces as an ExportTraceServiceRequest message.
+func marshalOtlpProto(d OtlpTracesData) []byte {
+	var b protoBuffer
+	for _, rs := range d.ResourceSpans {
+		rs := rs
+		b.message(1, func(m *protoBuffer) {
+			m.message(1, func(r *protoBuffer) { r.attributes(1, rs.Resource.Attributes) })
+			for _, ss := range rs.ScopeSpans {
+				ss := ss
+				m.message(2, func(s *protoBuffer) {
+					s.message(1, func(scope *protoBuffer) {
+						scope.string(1, ss.Scope.Name)
+						scope.string(2, ss.Scope.Version)
+					})
+					for _, span := range ss.Spans {
+						s.message(2, span.marshalProto)
+					}
+				})
+			}
+		})
+	}
+	return b
+}
+
+func (span *OtlpSpan) marshalProto(b *protoBuffer) {
+	b.bytes(1, hexBytes(span.TraceID))
+	b.bytes(2, hexBytes(span.SpanID))
+	b.bytes(4, hexBytes(span.ParentSpanID))
+	b.string(5, span.Name)
+	b.uint(6, uint64(span.Kind))
+	b.fixed64(7, decimalUint(span.StartTimeUnixNano))
+	b.fixed64(8, decimalUint(span.EndTimeUnixNano))
+	b.attributes(9, span.Attributes)
+	for _, e := range span.Events {
+		e := e
+		b.message(11, func(m *protoBuffer) {
+			m.fixed64(1, decimalUint(e.TimeUnixNano))
+			m.string(2, e.Name)
+		})
+	}
+	b.message(15, func(m *protoBuffer) {
+		m.string(2, span.Status.Message)
+		m.uint(3, uint64(span.Status.Code))
+	})
+}
+
+func (b *protoBuffer) attributes(field int, attrs []OtlpKeyValue) {
+	for _, a := range attrs {
+		a := a
+		b.message(field, func(kv *protoBuffer) {
+			kv.string(1, a.Key)
+			kv.message(2, func(v *protoBuffer) {
+				switch {
+				case a.Value.StringValue != nil:
+					// an empty string is still a string value
+					v.tag(1, protoBytes)
+					v.varint(uint64(len(*a.Value.StringValue)))
+					*v = append(*v, *a.Value.StringValue...)
+				case a.Value.IntValue != nil:
+					i, _ := strconv.ParseInt(*a.Value.IntValue, 10, 64)
+					v.tag(3, protoVarint)
+					v.varint(uint64(i))
+				case a.Value.DoubleValue != nil:
+					v.tag(4, protoFixed64)
+					*v = append(*v, make([]byte, 8)...)
+					binary.LittleEndian.PutUint64((*v)[len(*v)-8:], math.Float64bits(*a.Value.DoubleValue))
+				}
+			})
+		})
+	}
+}
+
+func hexBytes(s string) []byte {
+	b, _ := hex.DecodeString(s)
+	return b
+}
+
+func decimalUint(s string) uint64 {
+	v, _ := strconv.ParseUint(s, 10, 64)
+	return v
+}
@@ -0,0 +1,195 @@
+package httpstream
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestTraceContext(t *testing.T) {
+	cases := []struct {
+		header            http.Header
+		traceID, parentID string
+	}{
+		{http.Header{"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}},
+			"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{http.Header{"B3": {"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"}},
+			"80f198ee56343ba864fe8b2a57d3eff7", "e457b5a2e4d86bd1"},
+		{http.Header{"X-B3-Traceid": {"a3ce929d0e0e4736"}, "X-B3-Spanid": {"00f067aa0ba902b7"}},
+			"0000000000000000a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{http.Header{"Traceparent": {"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}}, "", ""},
+		{http.Header{}, "", ""},
+	}
+	for _, c := range cases {
+		if traceID, parentID := traceContext(c.header); traceID != c.traceID || parentID != c.parentID {
+			t.Errorf("%v: got %s/%s", c.header, traceID, parentID)
+		}
+	}
+}
+
+func otlpTestTransaction(o *EventOtlp) {
+	start := time.Date(2021, 5, 19, 0, 0, 0, 0, time.UTC)
+	timing := Timing{RequestStart: start, RequestEnd: start.Add(time.Millisecond),
+		ResponseStart: start.Add(10 * time.Millisecond), ResponseEnd: start.Add(12 * time.Millisecond)}
+	m := Message{StreamSeq: 1, ID: 1, Start: start, End: timing.ResponseEnd, ClientAddr: "10.0.0.2:5000",
+		ServerAddr: "10.0.0.1:80", Timing: timing, Header: http.Header{"Host": {"api:80"},
+			"Traceparent": {"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}}}
+	o.PushEvent(RequestEvent{Method: "GET", URI: "/users/42?x=1", Route: "/users/{id}", Version: "HTTP/1.1", Message: m})
+	o.PushEvent(ResponseEvent{Code: "503", Message: m})
+}
+
+func TestEventOtlp(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "traces.otlp")
+	o := NewEventOtlp(filename)
+	otlpTestTransaction(o)
+	o.Wait()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var d OtlpTracesData
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatal(err)
+	}
+
+	rs := d.ResourceSpans[0]
+	span := rs.ScopeSpans[0].Spans[0]
+	if *rs.Resource.Attributes[0].Value.StringValue != "api" || span.Name != "GET /users/{id}" ||
+		span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" ||
+		span.Status.Code != otlpStatusError || span.EndTimeUnixNano != "1621382400012000000" || len(span.Events) != 2 {
+		t.Errorf("unexpected span: %s", data)
+	}
+
+	attrs := make(map[string]OtlpValue)
+	for _, a := range span.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	if *attrs["http.response.status_code"].IntValue != "503" || *attrs["url.query"].StringValue != "x=1" ||
+		*attrs["netgraph.timing.wait_ms"].DoubleValue != 9 {
+		t.Errorf("unexpected attributes: %s", data)
+	}
+}
+
+// protoFields decodes the fields of a protobuf message, only of the wire types written by protoBuffer.
+func protoFields(t *testing.T, b []byte) map[uint64][][]byte {
+	fields := make(map[uint64][][]byte)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		var v []byte
+		switch tag & 7 {
+		case protoVarint:
+			_, n = binary.Uvarint(b)
+			v, b = b[:n], b[n:]
+		case protoFixed64:
+			v, b = b[:8], b[8:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			v, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			t.Fatalf("wire type %d", tag&7)
+		}
+		fields[tag>>3] = append(fields[tag>>3], v)
+	}
+	return fields
+}
+
+func TestEventOtlpGRPC(t *testing.T) {
+	var spans int32
+	h := func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != otlpGRPCPath || r.Header.Get("Content-Type") != "application/grpc" ||
+			len(data) < 5 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+			t.Errorf("bad gRPC request %s %v, %d bytes", r.URL.Path, r.Header, len(data))
+			w.Header().Set("Grpc-Status", "3")
+			return
+		}
+
+		rs := protoFields(t, protoFields(t, data[5:])[1][0])
+		service := protoFields(t, protoFields(t, protoFields(t, rs[1][0])[1][0])[2][0])[1][0]
+		span := protoFields(t, protoFields(t, rs[2][0])[2][0])
+		if string(service) != "api" || string(span[5][0]) != "GET /users/{id}" ||
+			binary.LittleEndian.Uint64(span[8][0]) != 1621382400012000000 || len(span[9]) != 18 || len(span[11]) != 2 {
+			t.Errorf("unexpected span %q", span)
+		}
+		atomic.AddInt32(&spans, 1)
+
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		_, _ = w.Write([]byte{0, 0, 0, 0, 0}) // an empty ExportTraceServiceResponse
+		w.Header().Set("Grpc-Status", "0")
+	}
+	s := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(h), &http2.Server{}))
+	defer s.Close()
+
+	dropped := atomic.LoadUint64(&otlpDroppedSpans)
+	o := NewEventOtlp(strings.Replace(s.URL, "http://", "grpc://", 1))
+	otlpTestTransaction(o)
+	o.Wait()
+	if atomic.LoadInt32(&spans) == 0 || atomic.LoadUint64(&otlpDroppedSpans) != dropped {
+		t.Errorf("no spans exported, %d dropped", atomic.LoadUint64(&otlpDroppedSpans)-dropped)
+	}
+}
+
+func TestEventOtlpFailure(t *testing.T) {
+	var posts int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		w.WriteHeader(http.StatusBadRequest) // not retryable
+	}))
+	defer s.Close()
+
+	dropped := atomic.LoadUint64(&otlpDroppedSpans)
+	o := NewEventOtlp(s.URL)
+	otlpTestTransaction(o)
+	o.Wait()
+	if n := atomic.LoadUint64(&otlpDroppedSpans) - dropped; posts != 1 || n != 1 {
+		t.Errorf("%d posts, %d spans dropped", posts, n)
+	}
+}
+
+func TestEventOtlpSlowExport(t *testing.T) {
+	release := make(chan struct{})
+	var spans int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var d OtlpTracesData
+		_ = json.NewDecoder(r.Body).Decode(&d)
+		for _, rs := range d.ResourceSpans {
+			atomic.AddInt32(&spans, int32(len(rs.ScopeSpans[0].Spans)))
+		}
+	}))
+	defer s.Close()
+
+	o := NewEventOtlp(s.URL)
+	pushed := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*otlpBatchSize; i++ {
+			otlpTestTransaction(o)
+		}
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("PushEvent blocked by the export")
+	}
+
+	close(release)
+	o.Wait()
+	if n := atomic.LoadInt32(&spans); n != 2*otlpBatchSize {
+		t.Errorf("%d spans exported", n)
+	}
+}
@@ -0,0 +1,237 @@
+package httpstream
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetFilter is the subset of the BPF syntax of pcap-filter(7) matched in Go for the pcap files,
+// which are read without libpcap, eg.
+//
+//	tcp and dst port 80
+//	host 10.0.0.1 and (port 8080 or portrange 9000-9100)
+//	not src net 192.168.0.0/16
+//
+// Primitives: [tcp|udp|ip|ip6] [src|dst] host <ip>, net <cidr>, port <port>, portrange <from-to>,
+// and the bare protocols tcp, udp, ip, ip6.
+// Primitives are combined with and(&&), or(||), not(!) and parentheses.
+type packetFilter struct {
+	expr string
+	root packetMatch
+}
+
+// packetMatch tells whether the packet matches a node of the filter.
+type packetMatch func(p *packetInfo) bool
+
+// packetInfo is the fields of a packet to filter.
+type packetInfo struct {
+	ip4, ip6, tcp, udp bool
+	src, dst           net.IP
+	srcPort, dstPort   int
+}
+
+// parsePacketFilter parses the BPF expression, nil for empty.
+func parsePacketFilter(expr string) (*packetFilter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+
+	lexer := strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " and ", "||", " or ", "!", " not ")
+	p := &packetFilterParser{tokens: strings.Fields(strings.ToLower(lexer.Replace(expr)))}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bpf %q, %w", expr, err)
+	}
+
+	return &packetFilter{expr: expr, root: root}, nil
+}
+
+func (f *packetFilter) String() string { return f.expr }
+
+// Match tells whether the packet matches the filter, the packets other than IP are never matched.
+func (f *packetFilter) Match(packet gopacket.Packet) bool {
+	var p packetInfo
+	switch n := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		p.ip4, p.src, p.dst = true, n.SrcIP, n.DstIP
+	case *layers.IPv6:
+		p.ip6, p.src, p.dst = true, n.SrcIP, n.DstIP
+	default:
+		return false
+	}
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		p.tcp, p.srcPort, p.dstPort = true, int(t.SrcPort), int(t.DstPort)
+	case *layers.UDP:
+		p.udp, p.srcPort, p.dstPort = true, int(t.SrcPort), int(t.DstPort)
+	}
+
+	return f.root(&p)
+}
+
+func andPacket(l, r packetMatch) packetMatch { return func(i *packetInfo) bool { return l(i) && r(i) } }
+func orPacket(l, r packetMatch) packetMatch  { return func(i *packetInfo) bool { return l(i) || r(i) } }
+
+type packetFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *packetFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *packetFilterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", fmt.Errorf("unexpected end")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *packetFilterParser) parseOr() (packetMatch, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.peek() == "or" {
+		p.pos++
+		var r packetMatch
+		if r, err = p.parseAnd(); err == nil {
+			l = orPacket(l, r)
+		}
+	}
+	return l, err
+}
+
+func (p *packetFilterParser) parseAnd() (packetMatch, error) {
+	l, err := p.parseUnary()
+	for err == nil && p.peek() == "and" {
+		p.pos++
+		var r packetMatch
+		if r, err = p.parseUnary(); err == nil {
+			l = andPacket(l, r)
+		}
+	}
+	return l, err
+}
+
+func (p *packetFilterParser) parseUnary() (packetMatch, error) {
+	switch p.peek() {
+	case "not":
+		p.pos++
+		n, err := p.parseUnary()
+		return func(i *packetInfo) bool { return !n(i) }, err
+	case "(":
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return n, nil
+	}
+
+	return p.parsePrimitive()
+}
+
+// parsePrimitive parses [proto] [dir] type id, eg. tcp dst port 80, where the type may be omitted after the proto.
+func (p *packetFilterParser) parsePrimitive() (packetMatch, error) {
+	var proto packetMatch
+	switch p.peek() {
+	case "tcp":
+		proto = func(i *packetInfo) bool { return i.tcp }
+	case "udp":
+		proto = func(i *packetInfo) bool { return i.udp }
+	case "ip":
+		proto = func(i *packetInfo) bool { return i.ip4 }
+	case "ip6":
+		proto = func(i *packetInfo) bool { return i.ip6 }
+	}
+	if proto != nil {
+		p.pos++
+		switch p.peek() {
+		case "src", "dst", "host", "net", "port", "portrange":
+		default:
+			return proto, nil
+		}
+	}
+
+	src, dst := true, true
+	switch p.peek() {
+	case "src":
+		dst = false
+		p.pos++
+	case "dst":
+		src = false
+		p.pos++
+	}
+
+	typ, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	id, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	var m packetMatch
+	switch typ {
+	case "host":
+		ip := net.ParseIP(id)
+		if ip == nil {
+			return nil, fmt.Errorf("bad host %q, should be an IP", id)
+		}
+		m = func(i *packetInfo) bool { return src && ip.Equal(i.src) || dst && ip.Equal(i.dst) }
+	case "net":
+		_, ipNet, err := net.ParseCIDR(id)
+		if err != nil {
+			return nil, fmt.Errorf("bad net %q, should be a CIDR", id)
+		}
+		m = func(i *packetInfo) bool { return src && ipNet.Contains(i.src) || dst && ipNet.Contains(i.dst) }
+	case "port", "portrange":
+		from, to, err := parsePortRange(typ, id)
+		if err != nil {
+			return nil, err
+		}
+		m = func(i *packetInfo) bool {
+			return (i.tcp || i.udp) && (src && i.srcPort >= from && i.srcPort <= to || dst && i.dstPort >= from && i.dstPort <= to)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported %q without libpcap, only host, net, port, portrange, tcp, udp, ip, ip6", typ)
+	}
+
+	if proto != nil {
+		return andPacket(proto, m), nil
+	}
+	return m, nil
+}
+
+// parsePortRange parses the port, eg. 80, or the port range, eg. 8000-8080.
+func parsePortRange(typ, id string) (from, to int, err error) {
+	fromStr, toStr := id, id
+	if typ == "portrange" {
+		if p := strings.IndexByte(id, '-'); p > 0 {
+			fromStr, toStr = id[:p], id[p+1:]
+		}
+	}
+	if from, err = strconv.Atoi(fromStr); err == nil {
+		to, err = strconv.Atoi(toStr)
+	}
+	if err != nil || from < 0 || to > 65535 || from > to {
+		return 0, 0, fmt.Errorf("bad %s %q", typ, id)
+	}
+	return from, to, nil
+}
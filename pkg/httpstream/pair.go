@@ -7,28 +7,40 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // EventHandler handle HTTP events.
 type EventHandler interface {
-	PushEvent(interface{})
+	PushEvent(Event)
 	Wait()
 }
 
 type EventHandlers []EventHandler
 
-func (handlers EventHandlers) Run(eventChan <-chan interface{}) {
-	for e := range eventChan {
-		for _, h := range handlers {
-			h.PushEvent(e)
-		}
+// PushEvent pushes the event to all the handlers.
+func (handlers EventHandlers) PushEvent(e Event) {
+	for _, h := range handlers {
+		h.PushEvent(e)
 	}
+}
 
-	for _, h := range handlers {
-		h.Wait()
+// Wait waits all the handlers in reverse order, since the later handlers may push events to the earlier ones.
+func (handlers EventHandlers) Wait() {
+	for i := len(handlers) - 1; i >= 0; i-- {
+		handlers[i].Wait()
+	}
+}
+
+func (handlers EventHandlers) Run(eventChan <-chan Event) {
+	for e := range eventChan {
+		handlers.PushEvent(e)
 	}
+
+	handlers.Wait()
 }
 
 // Header is HTTP header key-value pair.
@@ -37,29 +49,43 @@ type Header struct {
 	Value string
 }
 
-// Event is HTTP request or response.
-type Event struct {
-	Type       string
-	Start, End time.Time
+// Message is the common part of HTTP request and response.
+type Message struct {
+	UID        string    // the globally unique ID of the event
+	Start, End time.Time // the first and last byte of the message
 	StreamSeq  uint
 	ID         int
 	ClientAddr string
 	ServerAddr string
-	Header     http.Header
-	Body       []byte
+	ClientName string // the name of ClientAddr, empty if unknown
+	ServerName string // the name of ServerAddr, empty if unknown
+	// ClientProcess and ServerProcess are the local processes of the ends, nil if remote or unknown
+	ClientProcess *Process
+	ServerProcess *Process
+	Header        http.Header
+	RawHeader     []Header // the header fields in the order and case of the wire
+	Body          []byte
+	// BodyTruncated tells that Body is truncated to the limits, whose size on the wire is BodyOriginalSize.
+	// BodyOriginalSize is of the encoded body, eg. gzip, so it is smaller than Body if only the decoded one is
+	// truncated, and the decoded size is unknown.
+	BodyTruncated    bool
+	BodyOriginalSize int
+	BodySHA256       string // the SHA-256 of the whole body spilled to the body directory, empty if not spilled
+	Timing           Timing
 }
 
 // RequestEvent is HTTP request.
 type RequestEvent struct {
-	Event
+	Message
 	Method  string
 	URI     string
+	Route   string // the normalized URI, eg. /users/{id}
 	Version string
 }
 
 // ResponseEvent is HTTP response.
 type ResponseEvent struct {
-	Event
+	Message
 	Version string
 	Code    string
 	Reason  string
@@ -68,29 +94,72 @@ type ResponseEvent struct {
 // pair is Bi-direction HTTP stream pair.
 type pair struct {
 	connSeq   uint
-	eventChan chan<- interface{}
+	eventChan chan<- Event
 
+	// mu guards the fields shared by the request and response streams.
+	mu                             sync.Mutex
 	method, clientAddr, serverAddr string
-
-	idChan       chan int
-	id           int
-	onlyRequests bool
+	clientName, serverName         string
+	timings                        map[int]Timing
+	// held are the requests passed the filter, by ID. The requests are held until their responses
+	// when the filter refers to responses, otherwise they are emitted and the values are nil.
+	held     map[int]*RequestEvent
+	heldFrom int // no held request is older than it
+
+	idChan        chan int
+	id            int
+	onlyRequests  bool
+	filter        *Filter
+	router        *Router
+	names         *Names
+	processes     map[string]*Process // the local processes by the addresses, set once the streams run
+	processesOnce sync.Once
+
+	conn         connStats
+	running      int32 // running streams of the pair, accessed atomically
+	transactions int32 // accessed atomically
+	unpaired     int32 // set when a response found no request in time until an ID arrives, accessed atomically
 }
 
-func newPair(seq uint, eventChan chan<- interface{}, onlyRequests bool) *pair {
-	return &pair{connSeq: seq, eventChan: eventChan, idChan: make(chan int, 10000), onlyRequests: onlyRequests}
+// evictedHeld counts the requests evicted from the ones held by the filter, accessed atomically.
+var evictedHeld uint64
+
+// pairTimeout is how long a response waits for its request to be parsed from the other stream.
+const pairTimeout = 500 * time.Millisecond
+
+func newPair(seq uint, eventChan chan<- Event, onlyRequests bool, filter *Filter, router *Router, names *Names) *pair {
+	return &pair{
+		connSeq: seq, eventChan: eventChan, idChan: make(chan int, 10000), onlyRequests: onlyRequests,
+		timings: make(map[int]Timing), held: make(map[int]*RequestEvent), filter: filter,
+		router: router, names: names,
+	}
 }
 
-func (p *pair) run(wg *sync.WaitGroup, stream *httpStream, methodAllowed func(string) bool) {
-	defer wg.Done()
+func (p *pair) run(stream *httpStream, methodAllowed func(string) bool) {
+	defer stream.reader.mem.done()
 	defer close(stream.reader.stopCh)
 
 	dir := DirectionUnknown
 	for {
 		if err := p.handleTransaction(&dir, stream, methodAllowed); err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			p.emitFindings(stream, 0, dir)
+
+			var pe *ParseError
+			switch {
+			case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
 				log.Printf("EOF %s", stream.key.String())
-			} else {
+				if stream.dropped != "" {
+					p.eventChan <- p.droppedEvent(stream, stream.dropped, stream.droppedAt)
+				}
+			case errors.Is(err, errEvicted):
+				atomic.AddUint64(&evictedStreams, 1)
+				p.eventChan <- p.droppedEvent(stream, errEvicted.Error(), stream.reader.lastSeen)
+			case errors.Is(err, errStreamBudget):
+				atomic.AddUint64(&overBudgetStreams, 1)
+				p.eventChan <- p.droppedEvent(stream, errStreamBudget.Error(), stream.reader.lastSeen)
+			case errors.As(err, &pe):
+				p.eventChan <- p.parseErrorEvent(stream, pe)
+			default:
 				log.Printf("E! %s, error: %v", stream.key.String(), err)
 			}
 			return
@@ -99,49 +168,155 @@ func (p *pair) run(wg *sync.WaitGroup, stream *httpStream, methodAllowed func(st
 }
 
 func (p *pair) handleRequestTransaction(method, uri, version string, s *httpStream, methodAllowed func(string) bool) error {
-	reqStart := s.reader.lastSeen
-	reqHeader, err := s.parseHeader()
+	reqStart := s.reader.firstByte
+	reqHeader, reqRaw, err := s.parseHeader()
 	if err != nil {
 		return err
 	}
 
-	p.clientAddr = s.key.net.Src().String() + ":" + s.key.tcp.Src().String()
-	p.serverAddr = s.key.net.Dst().String() + ":" + s.key.tcp.Dst().String()
-
-	reqBody, err := s.parseBody(method, reqHeader, true)
+	reqBody, reqInfo, err := s.parseBody(method, reqHeader, true)
 	if err != nil {
 		return err
 	}
 
+	timing := Timing{RequestStart: reqStart, RequestEnd: s.reader.lastByte}
+	p.names.Learn(s.key.dst(), reqHeader.Get("Host"))
+	clientName, serverName := p.names.Name(s.key.src()), p.names.Name(s.key.dst())
+
+	p.mu.Lock()
+	p.clientAddr = s.key.src()
+	p.serverAddr = s.key.dst()
+	p.clientName, p.serverName = clientName, serverName
 	p.method = method
 	p.id++
-	TryPut(p.idChan, p.id)
-
-	if !methodAllowed(method) {
-		return nil
+	if p.id == 1 {
+		timing.Handshake = p.conn.handshake()
+	}
+	if len(p.timings) < cap(p.idChan) {
+		p.timings[p.id] = timing
 	}
+	p.mu.Unlock()
+
+	atomic.AddInt32(&p.transactions, 1)
 
-	p.eventChan <- RequestEvent{
+	req := RequestEvent{
 		Method:  method,
 		URI:     uri,
+		Route:   p.router.Route(uri),
 		Version: version,
 
-		Event: Event{
-			ClientAddr: p.clientAddr,
-			ServerAddr: p.serverAddr,
-			Type:       "HTTPRequest",
-			StreamSeq:  p.connSeq,
-			Start:      reqStart,
-			End:        s.reader.lastSeen,
-			ID:         p.id,
-			Header:     reqHeader,
-			Body:       reqBody,
+		Message: Message{
+			ClientAddr:       p.clientAddr,
+			ServerAddr:       p.serverAddr,
+			ClientName:       clientName,
+			ServerName:       serverName,
+			ClientProcess:    p.processes[p.clientAddr],
+			ServerProcess:    p.processes[p.serverAddr],
+			UID:              newEventUID(),
+			StreamSeq:        p.connSeq,
+			Start:            timing.RequestStart,
+			End:              timing.RequestEnd,
+			ID:               p.id,
+			Header:           reqHeader,
+			RawHeader:        reqRaw,
+			Body:             reqBody,
+			BodyTruncated:    reqInfo.truncated,
+			BodyOriginalSize: reqInfo.size,
+			BodySHA256:       reqInfo.sha256,
+			Timing:           timing,
 		},
 	}
 
+	// filter before the ID is put, so that the response always finds the held request.
+	emit := methodAllowed(method) && p.filterRequest(&req)
+	TryPut(p.idChan, p.id)
+	p.emitFindings(s, p.id, DirectionRequest)
+
+	if emit {
+		p.eventChan <- req
+	}
+
 	return nil
 }
 
+// filterRequest tells whether the request should be emitted now, the request may be held until its response.
+func (p *pair) filterRequest(req *RequestEvent) bool {
+	switch {
+	case p.filter == nil:
+		return true
+	case p.filter.NeedsResponse():
+		p.evicted(p.hold(req.ID, req))
+		return false
+	case p.filter.Match(Transaction{Request: req}):
+		p.evicted(p.hold(req.ID, nil))
+		return true
+	default:
+		return false
+	}
+}
+
+// hold holds the request until its response, and returns the oldest held request evicted for it, if any,
+// whose value may be nil.
+func (p *pair) hold(id int, req *RequestEvent) (evicted *RequestEvent, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.held) >= cap(p.idChan) {
+		// the IDs are increasing, so the oldest one is found from heldFrom.
+		for ; !ok; p.heldFrom++ {
+			if evicted, ok = p.held[p.heldFrom]; ok {
+				delete(p.held, p.heldFrom)
+			}
+		}
+	}
+	p.held[id] = req
+	return evicted, ok
+}
+
+// evicted counts the held request evicted, whose response will be dropped, and emits it if it matches the filter
+// without response, as if it got no response.
+func (p *pair) evicted(req *RequestEvent, ok bool) {
+	if !ok {
+		return
+	}
+	atomic.AddUint64(&evictedHeld, 1)
+	if req != nil && p.filter.Match(Transaction{Request: req}) {
+		p.eventChan <- *req
+	}
+}
+
+func (p *pair) unhold(id int) (req *RequestEvent, ok bool) {
+	p.mu.Lock()
+	req, ok = p.held[id]
+	delete(p.held, id)
+	p.mu.Unlock()
+	return req, ok
+}
+
+// flushHeld emits the held requests that got no responses if they match the filter, when the pair ends.
+func (p *pair) flushHeld() {
+	p.mu.Lock()
+	ids := make([]int, 0, len(p.held))
+	for id, req := range p.held {
+		if req != nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	reqs := make([]*RequestEvent, len(ids))
+	for i, id := range ids {
+		reqs[i] = p.held[id]
+	}
+	p.held = make(map[int]*RequestEvent)
+	p.mu.Unlock()
+
+	for _, req := range reqs {
+		if p.filter.Match(Transaction{Request: req}) {
+			p.eventChan <- *req
+		}
+	}
+}
+
 func (p *pair) handleTransaction(dir *Direction, stream *httpStream, methodAllowed func(string) bool) error {
 	direction, p1, p2, p3, err := stream.parseFirstLine(*dir)
 	if err != nil {
@@ -157,41 +332,99 @@ func (p *pair) handleTransaction(dir *Direction, stream *httpStream, methodAllow
 }
 
 func (p *pair) handleResponseTransaction(respVersion, code, reason string, stream *httpStream) error {
-	respStart := stream.reader.lastSeen
-	respHeader, err := stream.parseHeader()
+	respStart := stream.reader.firstByte
+	respHeader, respRaw, err := stream.parseHeader()
 	if err != nil {
 		return err
 	}
-	respBody, err := stream.parseBody(p.method, respHeader, false)
+
+	p.mu.Lock()
+	method, clientAddr, serverAddr := p.method, p.clientAddr, p.serverAddr
+	clientName, serverName := p.clientName, p.serverName
+	p.mu.Unlock()
+
+	respBody, respInfo, err := stream.parseBody(method, respHeader, false)
 	if err != nil {
 		return err
 	}
 
-	if p.onlyRequests {
-		return nil
-	}
+	id := p.requestID()
+	p.mu.Lock()
+	timing := p.timings[id]
+	delete(p.timings, id)
+	p.mu.Unlock()
+
+	timing.ResponseStart, timing.ResponseEnd = respStart, stream.reader.lastByte
+	p.emitFindings(stream, id, DirectionResponse)
 
-	p.eventChan <- ResponseEvent{
+	rsp := ResponseEvent{
 		Version: respVersion,
 		Code:    code,
 		Reason:  reason,
 
-		Event: Event{
-			Type:       "HTTPResponse",
-			StreamSeq:  p.connSeq,
-			Start:      respStart,
-			End:        stream.reader.lastSeen,
-			ID:         TryGet(p.idChan),
-			ClientAddr: p.clientAddr,
-			ServerAddr: p.serverAddr,
-			Header:     respHeader,
-			Body:       respBody,
+		Message: Message{
+			UID:              newEventUID(),
+			StreamSeq:        p.connSeq,
+			Start:            timing.ResponseStart,
+			End:              timing.ResponseEnd,
+			ID:               id,
+			ClientAddr:       clientAddr,
+			ServerAddr:       serverAddr,
+			ClientName:       clientName,
+			ServerName:       serverName,
+			ClientProcess:    p.processes[clientAddr],
+			ServerProcess:    p.processes[serverAddr],
+			Header:           respHeader,
+			RawHeader:        respRaw,
+			Body:             respBody,
+			BodyTruncated:    respInfo.truncated,
+			BodyOriginalSize: respInfo.size,
+			BodySHA256:       respInfo.sha256,
+			Timing:           timing,
 		},
 	}
 
+	if p.filter != nil {
+		req, ok := p.unhold(id)
+		switch {
+		case !p.filter.NeedsResponse():
+			if !ok { // the request is filtered out
+				return nil
+			}
+		case !p.filter.Match(Transaction{Request: req, Response: &rsp}):
+			return nil
+		case req != nil:
+			p.eventChan <- *req
+		}
+	}
+
+	if !p.onlyRequests {
+		p.eventChan <- rsp
+	}
+
 	return nil
 }
 
+// requestID returns the ID of the request which the response replies to.
+// The request stream may be parsed later than the response stream, so wait a while for it. Once a response
+// got no request in time (eg. only one direction captured), the next ones don't wait until an ID arrives again.
+func (p *pair) requestID() int {
+	if atomic.LoadInt32(&p.unpaired) == 0 {
+		select {
+		case id := <-p.idChan:
+			return id
+		case <-time.After(pairTimeout):
+			atomic.StoreInt32(&p.unpaired, 1)
+		}
+	}
+
+	id, ok := TryGet2(p.idChan)
+	if ok {
+		atomic.StoreInt32(&p.unpaired, 0)
+	}
+	return id
+}
+
 var fp = func(w io.Writer, format string, a ...interface{}) int64 {
 	n, _ := fmt.Fprintf(w, format, a...)
 	return int64(n)
@@ -199,10 +432,18 @@ var fp = func(w io.Writer, format string, a ...interface{}) int64 {
 
 const layout = "2006-01-02 15:04:05.000"
 
+// namedAddr returns the address with its name, eg. orders(10.2.3.4:8080), or the address if the name is unknown.
+func namedAddr(addr, name string) string {
+	if name == "" {
+		return addr
+	}
+	return name + "(" + addr + ")"
+}
+
 func (r RequestEvent) WriteTo(out io.Writer) (n int64, err error) {
 	var b bytes.Buffer
-	b.WriteString(fmt.Sprintf("#%d [%s] Request %s->%s\r\n", r.StreamSeq,
-		r.Start.Format(layout), r.ClientAddr, r.ServerAddr))
+	b.WriteString(fmt.Sprintf("#%d [%s] Request %s->%s %s\r\n", r.StreamSeq,
+		r.Start.Format(layout), namedAddr(r.ClientAddr, r.ClientName), namedAddr(r.ServerAddr, r.ServerName), r.Timing))
 	b.WriteString(fmt.Sprintf("%s %s %s\r\n", r.Method, r.URI, r.Version))
 	r.writeHeader(&b)
 	r.writeBody(&b)
@@ -211,22 +452,33 @@ func (r RequestEvent) WriteTo(out io.Writer) (n int64, err error) {
 
 func (r ResponseEvent) WriteTo(out io.Writer) (n int64, err error) {
 	var b bytes.Buffer
-	b.WriteString(fmt.Sprintf("#%d [%s] Response %s<-%s\r\n", r.StreamSeq,
-		r.Start.Format(layout), r.ClientAddr, r.ServerAddr))
+	b.WriteString(fmt.Sprintf("#%d [%s] Response %s<-%s %s\r\n", r.StreamSeq,
+		r.Start.Format(layout), namedAddr(r.ClientAddr, r.ClientName), namedAddr(r.ServerAddr, r.ServerName), r.Timing))
 	b.WriteString(fmt.Sprintf("%s %s %s\r\n", r.Version, r.Code, r.Reason))
 	r.writeHeader(&b)
 	r.writeBody(&b)
 	return b.WriteTo(out)
 }
 
-func (r Event) writeHeader(b *bytes.Buffer) {
+func (r Message) writeHeader(b *bytes.Buffer) {
 	for h := range r.Header {
 		b.WriteString(fmt.Sprintf("%s: %s\r\n", h, r.Header.Get(h)))
 	}
 }
 
-func (r Event) writeBody(b *bytes.Buffer) {
-	if len(r.Body) > 0 {
+// BodySize returns the size of the body, the size on the wire if it is truncated.
+func (r Message) BodySize() int {
+	if r.BodyTruncated {
+		return r.BodyOriginalSize
+	}
+	return len(r.Body)
+}
+
+func (r Message) writeBody(b *bytes.Buffer) {
+	if r.BodyTruncated {
+		b.WriteString(fmt.Sprintf("\r\ncontent(%d, truncated, %d on the wire)", len(r.Body), r.BodyOriginalSize))
+		b.WriteString(fmt.Sprintf("%s", r.Body))
+	} else if len(r.Body) > 0 {
 		b.WriteString(fmt.Sprintf("\r\ncontent(%d)", len(r.Body)))
 		b.WriteString(fmt.Sprintf("%s", r.Body))
 	}
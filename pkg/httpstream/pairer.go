@@ -0,0 +1,93 @@
+package httpstream
+
+import (
+	"container/list"
+	"sort"
+	"time"
+)
+
+// maxPending limits the requests waiting for their responses in a handler.
+const maxPending = 10000
+
+type transactionKey struct {
+	seq uint
+	id  int
+}
+
+// pendingRequest is the value of a request waiting for its response.
+type pendingRequest struct {
+	key   transactionKey
+	start time.Time
+	value interface{}
+}
+
+// pairer pairs the responses with the requests waiting for them by the transactions in a handler.
+// Over max requests, the oldest ones are evicted as if they got no responses.
+type pairer struct {
+	max     int
+	pending map[transactionKey]*list.Element
+	order   *list.List // of *pendingRequest, in the order of adding
+	evict   func(value interface{})
+}
+
+// newPairer creates pairer of at most max requests, evict is called with the values of the requests
+// which got no responses, nil for none.
+func newPairer(max int, evict func(value interface{})) *pairer {
+	if evict == nil {
+		evict = func(interface{}) {}
+	}
+	return &pairer{max: max, pending: make(map[transactionKey]*list.Element), order: list.New(), evict: evict}
+}
+
+// add adds the value of the request waiting for its response.
+func (p *pairer) add(req Message, value interface{}) {
+	key := transactionKey{seq: req.StreamSeq, id: req.ID}
+	if e, ok := p.pending[key]; ok { // the ID is reused, eg. by another feed
+		p.order.Remove(e)
+		delete(p.pending, key)
+	}
+	for p.order.Len() >= p.max {
+		p.evictFront()
+	}
+	p.pending[key] = p.order.PushBack(&pendingRequest{key: key, start: req.Start, value: value})
+}
+
+// take returns the value of the request of the response, and removes it.
+func (p *pairer) take(rsp Message) (interface{}, bool) {
+	key := transactionKey{seq: rsp.StreamSeq, id: rsp.ID}
+	e, ok := p.pending[key]
+	if !ok {
+		return nil, false
+	}
+	p.order.Remove(e)
+	delete(p.pending, key)
+	return e.Value.(*pendingRequest).value, true
+}
+
+// expire evicts the requests started before the time.
+func (p *pairer) expire(before time.Time) {
+	for e := p.order.Front(); e != nil && e.Value.(*pendingRequest).start.Before(before); e = p.order.Front() {
+		p.evictFront()
+	}
+}
+
+// flush evicts all the requests in the order of their starts.
+func (p *pairer) flush() {
+	reqs := make([]*pendingRequest, 0, p.order.Len())
+	for e := p.order.Front(); e != nil; e = e.Next() {
+		reqs = append(reqs, e.Value.(*pendingRequest))
+	}
+	p.pending = make(map[transactionKey]*list.Element)
+	p.order.Init()
+
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].start.Before(reqs[j].start) })
+	for _, r := range reqs {
+		p.evict(r.value)
+	}
+}
+
+func (p *pairer) evictFront() {
+	r := p.order.Remove(p.order.Front()).(*pendingRequest)
+	delete(p.pending, r.key)
+	p.evict(r.value)
+}
@@ -0,0 +1,36 @@
+package httpstream
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPairer(t *testing.T) {
+	var evicted []interface{}
+	p := newPairer(3, func(v interface{}) { evicted = append(evicted, v) })
+	start := time.Now()
+	req := func(id int, d time.Duration) Message { return Message{StreamSeq: 1, ID: id, Start: start.Add(d)} }
+
+	p.add(req(1, 0), 1)
+	p.add(req(2, time.Second), 2)
+	p.add(req(3, 3*time.Second), 3)
+	p.add(req(4, 2*time.Second), 4) // over max, only the oldest is evicted
+	if v, ok := p.take(req(2, 0)); !ok || v != 2 {
+		t.Errorf("take 2: %v, %v", v, ok)
+	}
+	if _, ok := p.take(req(1, 0)); ok {
+		t.Error("take the evicted 1")
+	}
+
+	p.expire(start.Add(2500 * time.Millisecond)) // stops at 3, which is not expired
+	p.add(req(5, time.Second), 5)
+	p.flush() // in the order of the starts
+
+	if expected := []interface{}{1, 5, 4, 3}; !reflect.DeepEqual(evicted, expected) {
+		t.Errorf("evicted %v, expected %v", evicted, expected)
+	}
+	if len(p.pending) != 0 || p.order.Len() != 0 {
+		t.Errorf("pending %d after flush", len(p.pending))
+	}
+}
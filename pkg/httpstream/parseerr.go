@@ -0,0 +1,94 @@
+package httpstream
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ParseStage is the stage of HTTP parsing where malformed traffic is found.
+type ParseStage string
+
+const (
+	StageFirstLine   ParseStage = "first-line"
+	StageHeader      ParseStage = "header"
+	StageChunked     ParseStage = "chunked"
+	StageContentInfo ParseStage = "content-info"
+	StageBody        ParseStage = "body"
+	StageStream      ParseStage = "stream" // the rest of the stream is dropped, eg. for lost segments
+)
+
+// maxSnippet limits the offending bytes kept in ParseErrorEvent.
+const maxSnippet = 64
+
+// ParseError is the error of malformed HTTP message.
+type ParseError struct {
+	Stage ParseStage
+	Err   error
+	Data  []byte // the offending bytes
+}
+
+func newParseError(stage ParseStage, data []byte, format string, a ...interface{}) *ParseError {
+	return &ParseError{Stage: stage, Err: fmt.Errorf(format, a...), Data: data}
+}
+
+func (e *ParseError) Error() string { return fmt.Sprintf("bad %s, %v", e.Stage, e.Err) }
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ParseErrorEvent is the diagnostic event of malformed HTTP traffic.
+type ParseErrorEvent struct {
+	UID       string
+	Time      time.Time
+	StreamSeq uint
+	Stream    string // the stream key, {src} -> {dst}
+	Src, Dst  string
+	SrcName   string // the name of Src, empty if unknown
+	DstName   string // the name of Dst, empty if unknown
+	Stage     ParseStage
+	Error     string
+	Snippet   string // hex of the offending bytes, at most maxSnippet bytes
+}
+
+func (p *pair) parseErrorEvent(s *httpStream, e *ParseError) ParseErrorEvent {
+	data := e.Data
+	if len(data) > maxSnippet {
+		data = data[:maxSnippet]
+	}
+
+	return ParseErrorEvent{
+		UID:       newEventUID(),
+		Time:      s.reader.lastSeen,
+		StreamSeq: p.connSeq,
+		Stream:    s.key.String(),
+		Src:       s.key.src(),
+		Dst:       s.key.dst(),
+		SrcName:   p.names.Name(s.key.src()),
+		DstName:   p.names.Name(s.key.dst()),
+		Stage:     e.Stage,
+		Error:     e.Err.Error(),
+		Snippet:   hex.EncodeToString(data),
+	}
+}
+
+// droppedEvent reports the stream dropped for the reason at the time, eg. by the reassembly or the memory budgets.
+func (p *pair) droppedEvent(s *httpStream, reason string, at time.Time) ParseErrorEvent {
+	return ParseErrorEvent{
+		UID:       newEventUID(),
+		Time:      at,
+		StreamSeq: p.connSeq,
+		Stream:    s.key.String(),
+		Src:       s.key.src(),
+		Dst:       s.key.dst(),
+		SrcName:   p.names.Name(s.key.src()),
+		DstName:   p.names.Name(s.key.dst()),
+		Stage:     StageStream,
+		Error:     "dropped, " + reason,
+	}
+}
+
+func (r ParseErrorEvent) WriteTo(out io.Writer) (n int64, err error) {
+	m, err := fmt.Fprintf(out, "#%d [%s] ParseError %s stage:%s error:%s\r\n%s\r\n\r\n",
+		r.StreamSeq, r.Time.Format(layout), r.Stream, r.Stage, r.Error, r.Snippet)
+	return int64(m), err
+}
@@ -19,6 +19,11 @@ const (
 	SuffixPcap   OutSuffix = ".pcap"
 	SuffixLog    OutSuffix = ".log"
 	SuffixJson   OutSuffix = ".json"
+	SuffixHar    OutSuffix = ".har"
+	SuffixNdjson OutSuffix = ".ndjson"
+	SuffixCsv    OutSuffix = ".csv"
+	SuffixOtlp   OutSuffix = ".otlp"
+	SuffixDot    OutSuffix = ".dot"
 )
 
 func (o OutSuffix) Find(ss []string) string {
@@ -72,13 +77,16 @@ func NewEventHttp(name string) *EventPrinter {
 }
 
 // PushEvent implements the function of interface EventHandler.
-func (p *EventPrinter) PushEvent(e interface{}) {
+func (p *EventPrinter) PushEvent(e Event) {
 	switch v := e.(type) {
 	case RequestEvent:
 		_, _ = WriteRequestTo(p.replay, v, p.writer)
 	case ResponseEvent:
 		_, _ = WriteResponseTo(p.replay, v, p.writer)
-
+	case io.WriterTo: // connection, parse error and finding events
+		if !p.replay {
+			_, _ = v.WriteTo(p.writer)
+		}
 	default:
 		log.Printf("Unknown event: %v", e)
 	}
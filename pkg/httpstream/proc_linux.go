@@ -0,0 +1,187 @@
+package httpstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// procRescanInterval limits how often the sockets of all the processes are scanned for an unknown socket.
+	procRescanInterval = 200 * time.Millisecond
+	// procTableInterval limits how often /proc/net/tcp{,6} are read for an unknown connection.
+	procTableInterval = 20 * time.Millisecond
+)
+
+// containerID matches the container ID in the cgroup path, eg. /docker/<id>, or cri-containerd-<id>.scope.
+var containerID = regexp.MustCompile(`[0-9a-f]{64}`)
+
+type procResolver struct {
+	root     string         // the mount point of procfs
+	net      string         // the directory of the TCP sockets of the network namespace
+	sockets  map[uint64]int // the PIDs by the socket inodes
+	procs    map[int]*Process
+	lastScan time.Time
+	table    map[[2]string]uint64 // the socket inodes by the local and remote addresses
+	lastRead time.Time
+}
+
+// NewProcesses creates Processes of the connections in the network namespace of the process pid,
+// 0 for the one of netgraph.
+func NewProcesses(pid int) (*Processes, error) {
+	p := newProcesses("/proc")
+	if pid > 0 {
+		p.net = filepath.Join(p.root, strconv.Itoa(pid), "net")
+		if _, err := os.Stat(p.net); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func newProcesses(root string) *Processes {
+	return &Processes{procResolver: procResolver{root: root, net: filepath.Join(root, "net"),
+		sockets: make(map[uint64]int), procs: make(map[int]*Process)}}
+}
+
+// lookup returns the process of the socket from local to remote.
+func (r *procResolver) lookup(local, remote string) *Process {
+	inode := r.socketInode(local, remote)
+	if inode == 0 {
+		return nil
+	}
+
+	pid, ok := r.sockets[inode]
+	if !ok && time.Since(r.lastScan) >= procRescanInterval {
+		r.scan()
+		pid, ok = r.sockets[inode]
+	}
+	if !ok {
+		return nil
+	}
+	return r.process(pid)
+}
+
+// socketInode returns the inode of the TCP socket from local to remote in /proc/net/tcp{,6}, 0 if not found.
+// The sockets are cached, and reread for an unknown one.
+func (r *procResolver) socketInode(local, remote string) uint64 {
+	inode, ok := r.table[[2]string{local, remote}]
+	if !ok && time.Since(r.lastRead) >= procTableInterval {
+		r.readTable()
+		inode = r.table[[2]string{local, remote}]
+	}
+	return inode
+}
+
+// readTable reads the TCP sockets of /proc/net/tcp{,6}.
+func (r *procResolver) readTable() {
+	r.lastRead = time.Now()
+	table := make(map[[2]string]uint64, len(r.table))
+	for _, name := range []string{"tcp", "tcp6"} {
+		data, err := ioutil.ReadFile(filepath.Join(r.net, name))
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Scan() // header
+		for scanner.Scan() {
+			// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			if inode, err := strconv.ParseUint(fields[9], 10, 64); err == nil && inode != 0 {
+				table[[2]string{procAddr(fields[1]), procAddr(fields[2])}] = inode
+			}
+		}
+	}
+	r.table = table
+}
+
+// procAddr decodes the address of /proc/net/tcp{,6}, eg. 0100007F:0050 to 127.0.0.1:80.
+// The IP is in the 32-bit words of the host byte order, which is little endian on the supported platforms.
+func procAddr(s string) string {
+	p := strings.IndexByte(s, ':')
+	if p < 0 {
+		return ""
+	}
+	b, err := hex.DecodeString(s[:p])
+	if err != nil || len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return ""
+	}
+	port, err := strconv.ParseUint(s[p+1:], 16, 16)
+	if err != nil {
+		return ""
+	}
+
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10))
+}
+
+// scan reads the socket inodes of the file descriptors of all the processes.
+func (r *procResolver) scan() {
+	r.lastScan = time.Now()
+	sockets := make(map[uint64]int, len(r.sockets))
+	procs := make(map[int]*Process, len(r.procs))
+
+	dirs, _ := os.ReadDir(r.root)
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(r.root, d.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // exited, or not permitted
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if inode, err := strconv.ParseUint(strings.TrimSuffix(link[8:], "]"), 10, 64); err == nil {
+				sockets[inode] = pid
+			}
+		}
+		if p, ok := r.procs[pid]; ok {
+			procs[pid] = p
+		}
+	}
+
+	r.sockets, r.procs = sockets, procs
+}
+
+// process returns the process of the PID, which is read once until it exits.
+func (r *procResolver) process(pid int) *Process {
+	if p, ok := r.procs[pid]; ok {
+		return p
+	}
+
+	dir := filepath.Join(r.root, strconv.Itoa(pid))
+	p := &Process{PID: pid}
+	if comm, err := ioutil.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		p.Comm = strings.TrimSpace(string(comm))
+	}
+	if cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		p.Cmdline = strings.TrimSpace(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})))
+	}
+	if cgroup, err := ioutil.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+		p.Container = string(containerID.Find(cgroup))
+	}
+
+	r.procs[pid] = p
+	return p
+}
@@ -0,0 +1,66 @@
+package httpstream
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcesses(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, data string) {
+		name = filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 10.0.0.5:43210 -> 10.0.0.1:80 by java in a container, 127.0.0.1:80 <- 127.0.0.1:5000 by nginx
+	write("net/tcp", "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"+
+		"   0: 0500000A:A8CA 0100000A:0050 01 00000000:00000000 00:00000000 00000000  1000        0 555 1 0 20 4 30 10 -1\n"+
+		"   1: 0100007F:0050 0100007F:1388 01 00000000:00000000 00:00000000 00000000     0        0 777 1 0 20 4 30 10 -1\n")
+	write("net/tcp6", "  sl  local_address remote_address st tx_queue rx_queue tr tm->when retrnsmt uid timeout inode\n")
+	write("123/comm", "java\n")
+	write("123/cmdline", "java\x00-jar\x00app.jar\x00")
+	write("123/cgroup", "0::/system.slice/docker-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.scope\n")
+	write("456/comm", "nginx\n")
+	for pid, inode := range map[string]string{"123": "555", "456": "777"} {
+		if err := os.MkdirAll(filepath.Join(root, pid, "fd"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("socket:["+inode+"]", filepath.Join(root, pid, "fd", "3")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p := newProcesses(root)
+	client, server := p.Lookup("10.0.0.5:43210", "10.0.0.1:80")
+	if client == nil || client.PID != 123 || client.Comm != "java" || client.Cmdline != "java -jar app.jar" ||
+		client.Container != "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef" {
+		t.Errorf("unexpected client process %+v", client)
+	}
+	if server != nil {
+		t.Errorf("unexpected remote server process %+v", server)
+	}
+
+	client, server = p.Lookup("127.0.0.1:5000", "127.0.0.1:80")
+	if client != nil || server == nil || server.PID != 456 || server.Comm != "nginx" || server.Container != "" {
+		t.Errorf("unexpected processes %+v %+v", client, server)
+	}
+
+	// the known sockets are cached
+	if err := os.Remove(filepath.Join(root, "net", "tcp")); err != nil {
+		t.Fatal(err)
+	}
+	if client, _ := p.Lookup("10.0.0.5:43210", "10.0.0.1:80"); client == nil || client.PID != 123 {
+		t.Errorf("unexpected cached client process %+v", client)
+	}
+
+	if got := procAddr("00000000000000000000000001000000:1F90"); got != "[::1]:8080" {
+		t.Errorf("procAddr of IPv6 = %s", got)
+	}
+}
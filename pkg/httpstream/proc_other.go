@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package httpstream
+
+import "errors"
+
+type procResolver struct{}
+
+// NewProcesses creates Processes, which is only supported on Linux.
+func NewProcesses(pid int) (*Processes, error) {
+	return nil, errors.New("process attribution is only supported on Linux")
+}
+
+func (procResolver) lookup(local, remote string) *Process { return nil }
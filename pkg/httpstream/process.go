@@ -0,0 +1,31 @@
+package httpstream
+
+import "sync"
+
+// Process is the local process of an end of a connection.
+type Process struct {
+	PID       int    `json:"pid"`
+	Comm      string `json:"comm"`                // the command name, eg. java
+	Cmdline   string `json:"cmdline,omitempty"`   // the arguments separated by spaces
+	Container string `json:"container,omitempty"` // the container ID of the cgroup, empty if not in a container
+}
+
+// Processes attributes the connections to the local processes and containers by the socket inodes in /proc,
+// the TCP sockets, the sockets of the processes and the processes are cached. It is only supported on Linux.
+type Processes struct {
+	mu sync.Mutex
+	procResolver
+}
+
+// Lookup returns the local processes of the ends of the connection between the addresses IP:port,
+// nil for the remote ends or the unknown ones. A nil Processes looks up nothing.
+func (p *Processes) Lookup(a, b string) (pa, pb *Process) {
+	if p == nil {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lookup(a, b), p.lookup(b, a)
+}
@@ -0,0 +1,183 @@
+package httpstream
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueuePolicy is what a handler queue does when it is full.
+type QueuePolicy string
+
+const (
+	QueueBlock      QueuePolicy = "block"       // wait for the handler, the capture is slowed down
+	QueueDropOldest QueuePolicy = "drop-oldest" // drop the oldest queued event
+	QueueDropNewest QueuePolicy = "drop-newest" // drop the event being pushed
+)
+
+// ParseQueuePolicy parses the queue policy.
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch p := QueuePolicy(s); p {
+	case QueueBlock, QueueDropOldest, QueueDropNewest:
+		return p, nil
+	case "":
+		return QueueBlock, nil
+	default:
+		return "", fmt.Errorf("unknown queue policy %q, should be one of block, drop-oldest and drop-newest", s)
+	}
+}
+
+// QueueStats is the statistics of a handler queue.
+type QueueStats struct {
+	Name     string        `json:"name"`
+	Policy   QueuePolicy   `json:"policy"`
+	Capacity int           `json:"capacity"`
+	Queued   int           `json:"queued"`
+	Pushed   uint64        `json:"pushed"`
+	Handled  uint64        `json:"handled"`
+	Dropped  uint64        `json:"dropped"`
+	Lag      time.Duration `json:"lag"`    // how long the last handled event waited in the queue
+	MaxLag   time.Duration `json:"maxLag"` // the max of Lag
+}
+
+type queuedEvent struct {
+	e  Event
+	at time.Time
+}
+
+// QueuedHandler pushes events to the handler in its own goroutine through a bounded queue,
+// so that a slow handler does not stall the others and the capture.
+type QueuedHandler struct {
+	name    string
+	handler EventHandler
+	policy  QueuePolicy
+	ch      chan queuedEvent
+	done    chan struct{}
+
+	pushed, handled, dropped uint64 // accessed atomically
+	lag, maxLag              int64  // accessed atomically
+}
+
+var (
+	queues     []*QueuedHandler // the queues not waited yet
+	queuesLock sync.Mutex
+)
+
+// NewQueuedHandler creates QueuedHandler of the queue size, and starts its worker.
+func NewQueuedHandler(name string, h EventHandler, size int, policy QueuePolicy) *QueuedHandler {
+	if policy == "" {
+		policy = QueueBlock
+	}
+	q := &QueuedHandler{
+		name:    name,
+		handler: h,
+		policy:  policy,
+		ch:      make(chan queuedEvent, size),
+		done:    make(chan struct{}),
+	}
+
+	queuesLock.Lock()
+	queues = append(queues, q)
+	queuesLock.Unlock()
+
+	go q.work()
+	return q
+}
+
+// AllQueueStats returns the statistics of all the handler queues not waited yet.
+func AllQueueStats() []QueueStats {
+	queuesLock.Lock()
+	defer queuesLock.Unlock()
+
+	stats := make([]QueueStats, len(queues))
+	for i, q := range queues {
+		stats[i] = q.Stats()
+	}
+	return stats
+}
+
+func (q *QueuedHandler) work() {
+	defer close(q.done)
+
+	for qe := range q.ch {
+		lag := int64(time.Since(qe.at))
+		atomic.StoreInt64(&q.lag, lag)
+		for {
+			max := atomic.LoadInt64(&q.maxLag)
+			if lag <= max || atomic.CompareAndSwapInt64(&q.maxLag, max, lag) {
+				break
+			}
+		}
+
+		q.handler.PushEvent(qe.e)
+		atomic.AddUint64(&q.handled, 1)
+	}
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (q *QueuedHandler) PushEvent(e Event) {
+	atomic.AddUint64(&q.pushed, 1)
+	qe := queuedEvent{e: e, at: time.Now()}
+
+	switch q.policy {
+	case QueueDropNewest:
+		select {
+		case q.ch <- qe:
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+		}
+	case QueueDropOldest:
+		for {
+			select {
+			case q.ch <- qe:
+				return
+			default:
+			}
+			select {
+			case <-q.ch:
+				atomic.AddUint64(&q.dropped, 1)
+			default:
+			}
+		}
+	default:
+		q.ch <- qe
+	}
+}
+
+// Wait implements the function of interface EventHandler.
+func (q *QueuedHandler) Wait() {
+	close(q.ch)
+	<-q.done
+
+	if s := q.Stats(); s.Dropped > 0 {
+		log.Printf("W! handler %s dropped %d of %d events, max lag %s", s.Name, s.Dropped, s.Pushed, s.MaxLag)
+	}
+
+	queuesLock.Lock()
+	for i, other := range queues {
+		if other == q {
+			queues = append(queues[:i], queues[i+1:]...)
+			break
+		}
+	}
+	queuesLock.Unlock()
+
+	q.handler.Wait()
+}
+
+// Stats returns the statistics of the queue.
+func (q *QueuedHandler) Stats() QueueStats {
+	return QueueStats{
+		Name:     q.name,
+		Policy:   q.policy,
+		Capacity: cap(q.ch),
+		Queued:   len(q.ch),
+		Pushed:   atomic.LoadUint64(&q.pushed),
+		Handled:  atomic.LoadUint64(&q.handled),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+		Lag:      time.Duration(atomic.LoadInt64(&q.lag)),
+		MaxLag:   time.Duration(atomic.LoadInt64(&q.maxLag)),
+	}
+}
@@ -0,0 +1,99 @@
+package httpstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// blockHandler blocks in PushEvent until it is released.
+type blockHandler struct {
+	collectHandler
+	release chan struct{}
+}
+
+func (b *blockHandler) PushEvent(e Event) {
+	<-b.release
+	b.collectHandler.PushEvent(e)
+}
+
+func TestQueuedHandler(t *testing.T) {
+	cases := map[QueuePolicy][]int{
+		QueueDropNewest: {0, 1, 2},
+		QueueDropOldest: {0, 3, 4},
+	}
+
+	for policy, expected := range cases {
+		b := &blockHandler{release: make(chan struct{})}
+		q := NewQueuedHandler(string(policy), b, 2, policy)
+
+		q.PushEvent(RequestEvent{})
+		for q.Stats().Queued != 0 { // wait for the worker to take the first event
+			runtime.Gosched()
+		}
+		for i := 1; i < 5; i++ {
+			q.PushEvent(RequestEvent{Message: Message{ID: i}})
+		}
+		close(b.release)
+		q.Wait()
+		for _, s := range AllQueueStats() {
+			if s.Name == string(policy) {
+				t.Errorf("%s still in the queues after Wait", policy)
+			}
+		}
+
+		s := q.Stats()
+		if s.Pushed != 5 || s.Dropped != 2 || s.Handled != 3 {
+			t.Errorf("%s stats: %+v", policy, s)
+		}
+		if len(b.events) != len(expected) {
+			t.Fatalf("%s events: %v", policy, b.events)
+		}
+		for i, e := range expected {
+			if b.events[i].(RequestEvent).ID != e {
+				t.Errorf("%s events: %v", policy, b.events)
+			}
+		}
+	}
+}
+
+// hostHandler records the Host headers of the requests.
+type hostHandler struct{ hosts []string }
+
+func (h *hostHandler) PushEvent(e Event) {
+	if v, ok := e.(RequestEvent); ok && v.Header.Get(XHttpCapRelay) == "" {
+		h.hosts = append(h.hosts, v.Header.Get("Host"))
+	}
+}
+func (h *hostHandler) Wait() {}
+
+// TestQueuedHeaders tests the handlers changing the headers don't change the ones of the other handlers,
+// run with -race.
+func TestQueuedHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer server.Close()
+
+	hosts := &hostHandler{}
+	handlers := EventHandlers{
+		NewQueuedHandler("json", NewEventJson(filepath.Join(t.TempDir(), "a.json")), 10, QueueBlock),
+		NewQueuedHandler("replay", NewEventReplay(server.Listener.Addr().String(), ""), 10, QueueBlock),
+		NewQueuedHandler("hosts", hosts, 10, QueueBlock),
+	}
+	for i := 0; i < 20; i++ {
+		handlers.PushEvent(RequestEvent{Method: "GET", URI: "/", Message: Message{ID: i,
+			Header: http.Header{"Host": {"a"}, "User-Agent": {"test"}}}})
+	}
+	handlers.Wait()
+
+	if len(hosts.hosts) != 20 {
+		t.Fatalf("hosts: %v", hosts.hosts)
+	}
+	for _, h := range hosts.hosts {
+		if h != "a" {
+			t.Errorf("hosts: %v", hosts.hosts)
+			break
+		}
+	}
+}
@@ -28,6 +28,17 @@ type Reader struct {
 	stopCh   chan interface{}
 	buffer   *bytes.Buffer
 	lastSeen time.Time
+	mem      *streamMemory // the bytes queued in src and buffered, nil for unaccounted
+
+	// seens holds the timestamps of the blocks remained in buffer.
+	seens []blockSeen
+	// firstByte and lastByte are the timestamps of the first and last byte of the last read.
+	firstByte, lastByte time.Time
+}
+
+type blockSeen struct {
+	n    int
+	seen time.Time
 }
 
 // NewReader create a new Reader.
@@ -40,19 +51,30 @@ func NewReader() *Reader {
 }
 
 func (s *Reader) fillBuffer() error {
-	if dataBlock, ok := <-s.src; ok {
+	select {
+	case dataBlock, ok := <-s.src:
+		if !ok {
+			return io.EOF
+		}
 		s.buffer.Write(dataBlock.Bytes)
 		s.lastSeen = dataBlock.Seen
+		if len(dataBlock.Bytes) > 0 {
+			s.seens = append(s.seens, blockSeen{n: len(dataBlock.Bytes), seen: dataBlock.Seen})
+		}
 		return nil
+	case <-s.mem.evictedCh():
+		return errEvicted
 	}
-	return io.EOF
 }
 
-// ReadUntil read bytes until delim.
+// ReadUntil read bytes until delim, the bytes should be within the memory budget of the stream.
 func (s *Reader) ReadUntil(delim []byte) ([]byte, error) {
 	var p int
 	for {
 		if p = bytes.Index(s.buffer.Bytes(), delim); p == -1 {
+			if limit := s.mem.limit(); limit > 0 && s.buffer.Len() > limit {
+				return nil, errStreamBudget
+			}
 			if err := s.fillBuffer(); err != nil {
 				return nil, err
 			}
@@ -60,6 +82,8 @@ func (s *Reader) ReadUntil(delim []byte) ([]byte, error) {
 			break
 		}
 	}
+	s.consume(p + len(delim))
+	s.mem.free(p + len(delim))
 	return s.buffer.Next(p + len(delim)), nil
 }
 
@@ -70,7 +94,68 @@ func (s *Reader) Next(n int) ([]byte, error) {
 			return nil, err
 		}
 	}
+	s.consume(n)
+	s.mem.free(n)
 	dst := make([]byte, n)
 	copy(dst, s.buffer.Next(n))
 	return dst, nil
 }
+
+// AppendNext reads n bytes from stream, and appends them to dst until dst is max bytes, <= 0 for unlimited.
+// The rest are discarded as they arrive, so that they are never buffered. All the n bytes are written to w too,
+// nil for none. The appended bytes stay accounted in the memory of the stream, until they are freed by freeBody.
+func (s *Reader) AppendNext(dst []byte, n, max int, w io.Writer) ([]byte, error) {
+	for n > 0 {
+		if s.buffer.Len() == 0 {
+			if err := s.fillBuffer(); err != nil {
+				return dst, err
+			}
+			continue
+		}
+
+		m := s.buffer.Len()
+		if m > n {
+			m = n
+		}
+		s.consume(m)
+		b := s.buffer.Next(m)
+		if w != nil {
+			if _, err := w.Write(b); err != nil {
+				return dst, err
+			}
+		}
+		if keep := max - len(dst); max > 0 && keep < len(b) {
+			if keep < 0 {
+				keep = 0
+			}
+			b = b[:keep]
+		}
+		dst = append(dst, b...)
+		s.mem.free(m - len(b))
+		n -= m
+	}
+	return dst, nil
+}
+
+// consume drops the timestamps of the n bytes to be read, and records the first and last of them.
+func (s *Reader) consume(n int) {
+	if n == 0 || len(s.seens) == 0 {
+		return
+	}
+
+	s.firstByte = s.seens[0].seen
+	for n > 0 && len(s.seens) > 0 {
+		b := &s.seens[0]
+		s.lastByte = b.seen
+		if b.n > n {
+			b.n -= n
+			return
+		}
+
+		n -= b.n
+		s.seens = s.seens[1:]
+	}
+}
+
+// freeBody frees the bytes of a body read by AppendNext from the memory of the stream.
+func (s *Reader) freeBody(body []byte) { s.mem.free(len(body)) }
@@ -0,0 +1,452 @@
+package httpstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RedactAction is the way to redact sensitive data.
+type RedactAction string
+
+const (
+	RedactMask RedactAction = "mask" // keep the last 4 characters of long values, mask the others with *
+	RedactHash RedactAction = "hash" // replace with the prefix of sha256 hex
+	RedactDrop RedactAction = "drop" // remove the header, parameter, field or matched text
+)
+
+// RedactRule is a redaction rule, exactly one of Header, Query, JSON, Form and Regex should be set.
+type RedactRule struct {
+	Header string       `json:"header"` // header name, case-insensitive
+	Query  string       `json:"query"`  // query parameter name of request URI
+	JSON   string       `json:"json"`   // dotted path of JSON body, * matches any key or array element, eg. cards.*.number
+	Form   string       `json:"form"`   // field name of x-www-form-urlencoded body
+	Regex  string       `json:"regex"`  // regular expression on body
+	Action RedactAction `json:"action"`
+
+	regex *regexp.Regexp
+	// quoted and raw match the header field or query parameter in the texts of findings and parse errors,
+	// quoted by %q or raw, whose value is the second group.
+	quoted, raw *regexp.Regexp
+	// jsonKey matches the last key of JSON path in the bodies which do not decode, eg. truncated,
+	// nil if the path ends with * or an index.
+	jsonKey *regexp.Regexp
+}
+
+// RedactConfig is the configuration file of Redactor.
+type RedactConfig struct {
+	Rules []RedactRule `json:"rules"`
+}
+
+// Redactor redacts sensitive data of HTTP events before they are pushed to the handlers.
+type Redactor struct {
+	rules []RedactRule
+}
+
+// LoadRedactor loads Redactor from the JSON configuration file.
+func LoadRedactor(filename string) (*Redactor, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var c RedactConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parse redact config %s, error: %w", filename, err)
+	}
+
+	return NewRedactor(c)
+}
+
+// NewRedactor creates Redactor.
+func NewRedactor(c RedactConfig) (*Redactor, error) {
+	r := &Redactor{}
+	for i, rule := range c.Rules {
+		targets := 0
+		for _, t := range []string{rule.Header, rule.Query, rule.JSON, rule.Form, rule.Regex} {
+			if t != "" {
+				targets++
+			}
+		}
+		if targets != 1 {
+			return nil, fmt.Errorf("redact rule #%d should have exactly one of header, query, json, form and regex", i)
+		}
+
+		switch rule.Action {
+		case RedactMask, RedactHash, RedactDrop:
+		case "":
+			rule.Action = RedactMask
+		default:
+			return nil, fmt.Errorf("redact rule #%d: unknown action %q", i, rule.Action)
+		}
+
+		if rule.Regex != "" {
+			var err error
+			if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+				return nil, fmt.Errorf("redact rule #%d: %w", i, err)
+			}
+		}
+		switch {
+		case rule.Header != "":
+			field := `(?i)(\b` + regexp.QuoteMeta(rule.Header) + `[ \t]*:[ \t]*)`
+			rule.quoted = regexp.MustCompile(field + `((?:[^"\\]|\\[^rn])*)`)
+			rule.raw = regexp.MustCompile(field + `([^\r\n]*)`)
+		case rule.Query != "":
+			param := `([?&]` + regexp.QuoteMeta(url.QueryEscape(rule.Query)) + `=)`
+			rule.quoted = regexp.MustCompile(param + `((?:[^&#"\\ ]|\\[^rn])*)`)
+			rule.raw = regexp.MustCompile(param + `([^&#\s]*)`)
+		case rule.JSON != "":
+			path := strings.Split(rule.JSON, ".")
+			if key := path[len(path)-1]; key != "*" && !isIndex(key) {
+				rule.jsonKey = regexp.MustCompile(`("` + regexp.QuoteMeta(key) + `"\s*:\s*)` +
+					`("(?:[^"\\]|\\.)*"?|[\[{]|[^\s,}\]]*)(\s*,)?`)
+			}
+		}
+
+		r.rules = append(r.rules, rule)
+	}
+
+	return r, nil
+}
+
+// Redact redacts the sensitive data of HTTP request and response events, and the raw lines quoted by
+// findings and parse errors, other events are returned as they are.
+func (r *Redactor) Redact(e Event) Event {
+	switch v := e.(type) {
+	case RequestEvent:
+		v.URI = r.redactURI(v.URI)
+		r.redactMessage(&v.Message)
+		return v
+	case ResponseEvent:
+		r.redactMessage(&v.Message)
+		return v
+	case FindingEvent:
+		v.Detail = r.redactText(v.Detail, true)
+		return v
+	case ParseErrorEvent:
+		v.Error = r.redactText(v.Error, true)
+		if data, err := hex.DecodeString(v.Snippet); err == nil {
+			v.Snippet = hex.EncodeToString([]byte(r.redactText(string(data), false)))
+		}
+		return v
+	default:
+		return e
+	}
+}
+
+// Wrap wraps the handlers, so that they all get redacted events.
+func (r *Redactor) Wrap(handlers EventHandlers) EventHandler {
+	return &redactHandler{redactor: r, handlers: handlers}
+}
+
+type redactHandler struct {
+	redactor *Redactor
+	handlers EventHandlers
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (h *redactHandler) PushEvent(e Event) { h.handlers.PushEvent(h.redactor.Redact(e)) }
+
+// Wait implements the function of interface EventHandler.
+func (h *redactHandler) Wait() { h.handlers.Wait() }
+
+func (r *Redactor) redactMessage(e *Message) {
+	for _, rule := range r.rules {
+		if rule.Header == "" {
+			continue
+		}
+		name := http.CanonicalHeaderKey(rule.Header)
+		e.RawHeader = redactRawHeader(e.RawHeader, rule)
+		if rule.Action == RedactDrop {
+			e.Header.Del(name)
+			continue
+		}
+		for i, v := range e.Header[name] {
+			e.Header[name][i] = rule.Action.apply(v)
+		}
+	}
+
+	if len(e.Body) == 0 {
+		return
+	}
+
+	body := r.redactBody(e.Body, e.Header.Get("Content-Type"))
+	if !bytes.Equal(body, e.Body) {
+		e.Body = body
+		if e.Header.Get("Content-Length") != "" {
+			e.Header.Set("Content-Length", strconv.Itoa(len(body)))
+			for i, h := range e.RawHeader {
+				if strings.EqualFold(h.Name, "Content-Length") {
+					e.RawHeader[i].Value = strconv.Itoa(len(body))
+				}
+			}
+		}
+	}
+}
+
+// redactRawHeader redacts the raw header fields matching the rule, the fields are copied
+// since they are shared by the handlers.
+func redactRawHeader(raw []Header, rule RedactRule) []Header {
+	redacted := make([]Header, 0, len(raw))
+	for _, h := range raw {
+		if strings.EqualFold(h.Name, rule.Header) {
+			if rule.Action == RedactDrop {
+				continue
+			}
+			h.Value = rule.Action.apply(h.Value)
+		}
+		redacted = append(redacted, h)
+	}
+	return redacted
+}
+
+func (r *Redactor) redactBody(body []byte, contentType string) []byte {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		body = []byte(r.redactParams(string(body), func(rule RedactRule) string { return rule.Form }))
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		body = r.redactJSON(body)
+	default:
+		// JSON sent as another type, eg. text/plain
+		if trimmed := bytes.TrimLeft(body, " \t\r\n"); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+			body = r.redactJSON(body)
+		}
+	}
+
+	for _, rule := range r.rules {
+		if rule.regex == nil {
+			continue
+		}
+		body = rule.regex.ReplaceAllFunc(body, func(m []byte) []byte {
+			if rule.Action == RedactDrop {
+				return nil
+			}
+			return []byte(rule.Action.apply(string(m)))
+		})
+	}
+
+	return body
+}
+
+// redactText redacts the header fields, query parameters and regular expressions in the text,
+// where the raw lines are quoted by %q if quoted.
+func (r *Redactor) redactText(text string, quoted bool) string {
+	for _, rule := range r.rules {
+		field := rule.raw
+		if quoted {
+			field = rule.quoted
+		}
+		if field != nil {
+			text = redactValues(field, text, rule.Action)
+		}
+		if rule.regex != nil {
+			text = rule.regex.ReplaceAllStringFunc(text, rule.Action.apply)
+		}
+	}
+	return text
+}
+
+// redactValues redacts the second groups of the matches of re in the text.
+func redactValues(re *regexp.Regexp, text string, action RedactAction) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(text[last:m[4]])
+		b.WriteString(action.apply(text[m[4]:m[5]]))
+		last = m[5]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func (r *Redactor) redactURI(uri string) string {
+	p := strings.Index(uri, "?")
+	if p < 0 {
+		return uri
+	}
+
+	return uri[:p+1] + r.redactParams(uri[p+1:], func(rule RedactRule) string { return rule.Query })
+}
+
+// redactParams redacts the parameters of the form of a=1&b=2 in place, keeping their orders.
+func (r *Redactor) redactParams(params string, target func(RedactRule) string) string {
+	parts := strings.Split(params, "&")
+	kept := parts[:0]
+
+next:
+	for _, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		name, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			name = kv[0]
+		}
+
+		for _, rule := range r.rules {
+			if t := target(rule); t == "" || t != name {
+				continue
+			}
+			if rule.Action == RedactDrop {
+				continue next
+			}
+			if len(kv) == 2 {
+				value, err := url.QueryUnescape(kv[1])
+				if err != nil {
+					value = kv[1]
+				}
+				part = kv[0] + "=" + url.QueryEscape(rule.Action.apply(value))
+			}
+		}
+
+		kept = append(kept, part)
+	}
+
+	return strings.Join(kept, "&")
+}
+
+func (r *Redactor) redactJSON(body []byte) []byte {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return r.redactJSONText(body)
+	}
+
+	changed := false
+	for _, rule := range r.rules {
+		if rule.JSON != "" {
+			var c bool
+			doc, c = redactJSONPath(doc, strings.Split(rule.JSON, "."), rule.Action)
+			changed = c || changed
+		}
+	}
+	if !changed {
+		return body
+	}
+
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return body
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
+
+// redactJSONText redacts the JSON body which does not decode, eg. truncated, by the last keys of the paths.
+// The whole body is redacted if a path does not end with a key, or the value of the key is an object or array.
+func (r *Redactor) redactJSONText(body []byte) []byte {
+	for _, rule := range r.rules {
+		if rule.JSON == "" {
+			continue
+		}
+		if rule.jsonKey == nil {
+			return []byte(rule.Action.apply(string(body)))
+		}
+
+		var b bytes.Buffer
+		last := 0
+		for _, m := range rule.jsonKey.FindAllSubmatchIndex(body, -1) {
+			value := string(body[m[4]:m[5]])
+			if value == "{" || value == "[" {
+				return []byte(rule.Action.apply(string(body)))
+			}
+			if rule.Action == RedactDrop {
+				b.Write(body[last:m[0]])
+			} else {
+				b.Write(body[last:m[4]])
+				if s, err := strconv.Unquote(value); err == nil {
+					value = s
+				} else {
+					value = strings.TrimPrefix(value, `"`)
+				}
+				b.WriteString(strconv.Quote(rule.Action.apply(value)))
+				b.Write(body[m[5]:m[1]])
+			}
+			last = m[1]
+		}
+		b.Write(body[last:])
+		body = b.Bytes()
+	}
+	return body
+}
+
+// redactJSONPath redacts the values of path in node, and returns the node, which is a new slice if its elements
+// are dropped, and reports whether any value is redacted.
+func redactJSONPath(node interface{}, path []string, action RedactAction) (_ interface{}, changed bool) {
+	last := len(path) == 1
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k, v := range n {
+			if path[0] != "*" && path[0] != k {
+				continue
+			}
+			if !last {
+				var c bool
+				n[k], c = redactJSONPath(v, path[1:], action)
+				changed = c || changed
+			} else if action == RedactDrop {
+				delete(n, k)
+				changed = true
+			} else {
+				n[k] = action.apply(fmt.Sprint(v))
+				changed = true
+			}
+		}
+	case []interface{}:
+		kept := n[:0]
+		for i, v := range n {
+			switch {
+			case path[0] != "*" && path[0] != strconv.Itoa(i):
+			case !last:
+				var c bool
+				v, c = redactJSONPath(v, path[1:], action)
+				changed = c || changed
+			case action == RedactDrop:
+				changed = true
+				continue
+			default:
+				v = action.apply(fmt.Sprint(v))
+				changed = true
+			}
+			kept = append(kept, v)
+		}
+		return kept, changed
+	}
+
+	return node, changed
+}
+
+func isIndex(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func (a RedactAction) apply(v string) string {
+	switch a {
+	case RedactHash:
+		h := sha256.Sum256([]byte(v))
+		return "sha256:" + hex.EncodeToString(h[:8])
+	case RedactDrop:
+		return ""
+	default:
+		rs := []rune(v)
+		keep := 0
+		if len(rs) > 8 {
+			keep = 4
+		}
+		for i := range rs[:len(rs)-keep] {
+			rs[i] = '*'
+		}
+		return string(rs)
+	}
+}
@@ -0,0 +1,102 @@
+package httpstream
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	r, err := NewRedactor(RedactConfig{Rules: []RedactRule{
+		{Header: "authorization"},
+		{Header: "Cookie", Action: RedactDrop},
+		{Query: "token", Action: RedactHash},
+		{JSON: "cards.*.number"},
+		{JSON: "password", Action: RedactDrop},
+		{JSON: "items.*.ssn", Action: RedactDrop},
+		{JSON: "tokens.*", Action: RedactDrop},
+		{Form: "pwd", Action: RedactDrop},
+		{Regex: `\d{3}-\d{4}`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := r.Redact(RequestEvent{URI: "/a?x=1&token=abc&y=2", Message: Message{
+		Header: http.Header{"Authorization": {"Bearer 0123456789"}, "Cookie": {"a=b"},
+			"Content-Type": {"application/json"}, "Content-Length": {"73"}},
+		Body: []byte(`{"cards":[{"number":"4111111111111111"}],"password":"x","phone":"555-1234"}`),
+	}}).(RequestEvent)
+
+	if req.URI != "/a?x=1&token=sha256%3Aba7816bf8f01cfea&y=2" {
+		t.Errorf("URI: %s", req.URI)
+	}
+	if v := req.Header.Get("Authorization"); v != "*************6789" {
+		t.Errorf("Authorization: %s", v)
+	}
+	if _, ok := req.Header["Cookie"]; ok {
+		t.Errorf("Cookie not dropped")
+	}
+	if b := string(req.Body); b != `{"cards":[{"number":"************1111"}],"phone":"********"}` {
+		t.Errorf("Body: %s", b)
+	}
+	if v := req.Header.Get("Content-Length"); v != "60" {
+		t.Errorf("Content-Length: %s", v)
+	}
+
+	items := r.Redact(ResponseEvent{Message: Message{Header: http.Header{"Content-Type": {"application/json"}},
+		Body: []byte(`{"items":[{"id":1,"ssn":"123-45-6789"},[{"ssn":"x"}]],"tokens":["a","b"]}`)}}).(ResponseEvent)
+	if b := string(items.Body); b != `{"items":[{"id":1},[{"ssn":"x"}]],"tokens":[]}` {
+		t.Errorf("Body: %s", b)
+	}
+
+	finding := r.Redact(FindingEvent{Detail: `bare LF in header line 2: "authorization: Bearer 0123456789\n"`}).(FindingEvent)
+	if finding.Detail != `bare LF in header line 2: "authorization: *************6789\n"` {
+		t.Errorf("Detail: %s", finding.Detail)
+	}
+
+	raw := "GET /a?token=abc HTTP/1.1\r\nCookie: a=\"b\"\r\nbad\r\n"
+	perr := r.Redact(ParseErrorEvent{Error: fmt.Sprintf("bad http header (line 1): %q", "Cookie: a=\"b\""),
+		Snippet: hex.EncodeToString([]byte(raw))}).(ParseErrorEvent)
+	snippet, _ := hex.DecodeString(perr.Snippet)
+	if perr.Error != `bad http header (line 1): "Cookie: "` ||
+		string(snippet) != "GET /a?token=sha256:ba7816bf8f01cfea HTTP/1.1\r\nCookie: \r\nbad\r\n" {
+		t.Errorf("Error: %s, Snippet: %q", perr.Error, snippet)
+	}
+
+	form := r.Redact(RequestEvent{Message: Message{Header: http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body: []byte("user=a&pwd=b")}}).(RequestEvent)
+	if string(form.Body) != "user=a" {
+		t.Errorf("Form: %s", form.Body)
+	}
+
+	if _, err := NewRedactor(RedactConfig{Rules: []RedactRule{{Header: "a", Query: "b"}}}); err == nil {
+		t.Errorf("rule with two targets should be rejected")
+	}
+}
+
+func TestRedactTruncatedJSON(t *testing.T) {
+	r, err := NewRedactor(RedactConfig{Rules: []RedactRule{
+		{JSON: "user.password", Action: RedactDrop},
+		{JSON: "token"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// truncated in the middle of the token, and sent as text/plain
+	body := `{"user": {"name":"a","password":"secret","id":1}, "token": "0123456789abc`
+	req := r.Redact(RequestEvent{Message: Message{Header: http.Header{"Content-Type": {"text/plain"}},
+		Body: []byte(body)}}).(RequestEvent)
+	if b := string(req.Body); b != `{"user": {"name":"a","id":1}, "token": "*********9abc"` {
+		t.Errorf("Body: %s", b)
+	}
+
+	r, _ = NewRedactor(RedactConfig{Rules: []RedactRule{{JSON: "tokens.*", Action: RedactDrop}}})
+	rsp := r.Redact(ResponseEvent{Message: Message{Header: http.Header{"Content-Type": {"application/json"}},
+		Body: []byte(`{"tokens":["a","b`)}}).(ResponseEvent)
+	if len(rsp.Body) != 0 {
+		t.Errorf("Body: %s", rsp.Body)
+	}
+}
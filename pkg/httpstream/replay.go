@@ -35,11 +35,11 @@ func NewEventReplay(addr string, method string) *EventReplay {
 }
 
 // PushEvent implements the function of interface EventHandler.
-func (p *EventReplay) PushEvent(e interface{}) {
+func (p *EventReplay) PushEvent(e Event) {
 	switch v := e.(type) {
 	case RequestEvent:
 		p.replay(v)
-	case ResponseEvent:
+	case ResponseEvent, ConnectionEvent, ParseErrorEvent, FindingEvent:
 		// bypass
 	default:
 		log.Printf("Unknown event: %v", e)
@@ -62,13 +62,19 @@ func (p *EventReplay) replay(v RequestEvent) {
 		return
 	}
 
+	if v.BodyTruncated {
+		log.Printf("W! Replay ignored, %s %s body truncated from %d bytes", v.Method, v.URI, v.BodyOriginalSize)
+		return
+	}
+
 	u := Fulfil(fmt.Sprintf("%s%s", p.Addr, v.URI))
 
-	v.Header.Add(XHttpCapRelay, "true")
+	header := v.Header.Clone() // shared by the other handlers
+	header.Add(XHttpCapRelay, "true")
 	for _, n := range []string{"User-Agent", "Host", "Connection", "Transfer-Encoding", "Content-Length"} {
-		v.Header.Del(n)
+		header.Del(n)
 	}
-	r, err := rest.Rest{Method: v.Method, Addr: u, Headers: ConvertHeaders(v.Header), Body: v.Body}.Do()
+	r, err := rest.Rest{Method: v.Method, Addr: u, Headers: ConvertHeaders(header), Body: v.Body}.Do()
 	if err != nil {
 		log.Printf("E! Replay %s %s error:%v", v.Method, u, err)
 	} else {
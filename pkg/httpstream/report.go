@@ -0,0 +1,390 @@
+package httpstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	reportTop       = 10   // the number of the largest and slowest transactions in Report
+	maxReportRoutes = 1000 // the routes beyond are counted as otherRoute
+	maxRouteSamples = 1000 // the latencies sampled per route for the percentiles
+	otherRoute      = "(other)"
+)
+
+// Report is the traffic summary of a run, latencies are in milliseconds.
+type Report struct {
+	Generated      time.Time          `json:"generated"`
+	Start          time.Time          `json:"start"`
+	End            time.Time          `json:"end"`
+	Requests       int                `json:"requests"`
+	Responses      int                `json:"responses"`
+	Methods        map[string]int     `json:"methods"`
+	Hosts          map[string]int     `json:"hosts"`
+	Statuses       map[string]int     `json:"statuses"`
+	Routes         []*RouteStats      `json:"routes"`
+	LargestBodies  []ReportEntry      `json:"largestBodies"`
+	Slowest        []ReportEntry      `json:"slowest"`
+	ParseErrors    map[ParseStage]int `json:"parseErrors"`
+	DroppedStreams map[string]int     `json:"droppedStreams"` // keyed by the reason
+}
+
+// RouteStats is the statistics of the requests of a normalized route.
+type RouteStats struct {
+	Method    string  `json:"method"`
+	Host      string  `json:"host"`
+	Route     string  `json:"route"`
+	Count     int     `json:"count"`
+	Responses int     `json:"responses"` // the responses with latencies
+	P50       float64 `json:"p50"`
+	P90       float64 `json:"p90"`
+	P99       float64 `json:"p99"`
+	Max       float64 `json:"max"`
+
+	samples []float64 // uniform samples of the latencies
+}
+
+// ReportEntry is an HTTP transaction listed in Report.
+type ReportEntry struct {
+	Time         time.Time `json:"time"`
+	Stream       uint      `json:"stream"`
+	ID           int       `json:"id"`
+	Method       string    `json:"method"`
+	Host         string    `json:"host"`
+	URI          string    `json:"uri"`
+	Status       string    `json:"status"`
+	RequestSize  int       `json:"requestSize"`
+	ResponseSize int       `json:"responseSize"`
+	Latency      float64   `json:"latency"`
+}
+
+type routeKey struct{ method, host, route string }
+
+type reportPending struct {
+	entry ReportEntry
+	route *RouteStats
+}
+
+// EventReport summarises the events into Report, which is printed as text tables
+// and written as JSON when the capture ends.
+type EventReport struct {
+	filename string
+	out      io.Writer
+	report   Report
+	routes   map[routeKey]*RouteStats
+	pending  *pairer // of reportPending
+}
+
+// NewEventReport creates EventReport, which prints the text tables to out,
+// and writes the JSON to filename, empty for none.
+func NewEventReport(filename string, out io.Writer) *EventReport {
+	r := &EventReport{
+		filename: filename,
+		out:      out,
+		report: Report{
+			Methods:        make(map[string]int),
+			Hosts:          make(map[string]int),
+			Statuses:       make(map[string]int),
+			ParseErrors:    make(map[ParseStage]int),
+			DroppedStreams: make(map[string]int),
+		},
+		routes: make(map[routeKey]*RouteStats),
+	}
+	// list the requests without responses
+	r.pending = newPairer(maxPending, func(p interface{}) { r.addEntry(p.(reportPending).entry) })
+	return r
+}
+
+// PushEvent implements the function of interface EventHandler.
+func (r *EventReport) PushEvent(e Event) {
+	switch v := e.(type) {
+	case RequestEvent:
+		r.addRequest(v)
+	case ResponseEvent:
+		r.addResponse(v)
+	case ParseErrorEvent:
+		if v.Stage == StageStream {
+			r.report.DroppedStreams[v.Error]++
+		} else {
+			r.report.ParseErrors[v.Stage]++
+		}
+	default:
+		// bypass
+	}
+}
+
+func (r *EventReport) span(t time.Time) {
+	if r.report.Start.IsZero() || t.Before(r.report.Start) {
+		r.report.Start = t
+	}
+	if t.After(r.report.End) {
+		r.report.End = t
+	}
+}
+
+func (r *EventReport) addRequest(v RequestEvent) {
+	r.span(v.Start)
+	r.report.Requests++
+	r.report.Methods[v.Method]++
+
+	host := v.Header.Get("Host")
+	if host == "" {
+		host = v.ServerName
+	}
+	if host == "" {
+		host = v.ServerAddr
+	}
+	r.report.Hosts[host]++
+
+	key := routeKey{method: v.Method, host: host, route: v.Route}
+	if key.route == "" {
+		key.route = normalizeRoute(v.URI)
+	}
+	route, ok := r.routes[key]
+	if !ok {
+		if len(r.routes) >= maxReportRoutes {
+			key.route = otherRoute
+		}
+		if route, ok = r.routes[key]; !ok {
+			route = &RouteStats{Method: key.method, Host: key.host, Route: key.route}
+			r.routes[key] = route
+		}
+	}
+	route.Count++
+
+	r.pending.add(v.Message, reportPending{
+		entry: ReportEntry{Time: v.Start, Stream: v.StreamSeq, ID: v.ID, Method: v.Method, Host: host, URI: v.URI,
+			RequestSize: v.BodySize()},
+		route: route,
+	})
+}
+
+func (r *EventReport) addResponse(v ResponseEvent) {
+	r.span(v.End)
+	r.report.Responses++
+	r.report.Statuses[v.Code]++
+
+	value, ok := r.pending.take(v.Message)
+	if !ok {
+		return
+	}
+
+	p := value.(reportPending)
+	p.entry.Status = v.Code
+	p.entry.ResponseSize = v.BodySize()
+	if d := v.Timing.Total(); d > 0 {
+		p.entry.Latency = milliseconds(d)
+		p.route.observe(p.entry.Latency)
+	}
+	r.addEntry(p.entry)
+}
+
+// observe counts the response of the latency, and samples the latency.
+func (s *RouteStats) observe(latency float64) {
+	s.Responses++
+	if latency > s.Max {
+		s.Max = latency
+	}
+	if len(s.samples) < maxRouteSamples {
+		s.samples = append(s.samples, latency)
+		return
+	}
+	// reservoir sampling, so that every latency is kept by the same chance.
+	if i := rand.Intn(s.Responses); i < maxRouteSamples {
+		s.samples[i] = latency
+	}
+}
+
+func (r *EventReport) addEntry(e ReportEntry) {
+	r.report.LargestBodies = addTop(r.report.LargestBodies, e, func(e *ReportEntry) float64 {
+		if e.RequestSize > e.ResponseSize {
+			return float64(e.RequestSize)
+		}
+		return float64(e.ResponseSize)
+	})
+	if e.Latency > 0 {
+		r.report.Slowest = addTop(r.report.Slowest, e, func(e *ReportEntry) float64 { return e.Latency })
+	}
+}
+
+// addTop adds e to top sorted by key descending, keeping at most reportTop entries.
+func addTop(top []ReportEntry, e ReportEntry, key func(*ReportEntry) float64) []ReportEntry {
+	k := key(&e)
+	i := sort.Search(len(top), func(i int) bool {
+		if ki := key(&top[i]); ki != k {
+			return ki < k
+		}
+		return top[i].Time.After(e.Time)
+	})
+	if i >= reportTop {
+		return top
+	}
+
+	top = append(top, ReportEntry{})
+	copy(top[i+1:], top[i:])
+	top[i] = e
+	if len(top) > reportTop {
+		top = top[:reportTop]
+	}
+	return top
+}
+
+// percentile returns the nearest-rank percentile p of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// Report returns the summary of the events pushed so far.
+func (r *EventReport) Report() Report {
+	r.pending.flush()
+
+	report := r.report
+	report.Generated = time.Now()
+	report.Routes = make([]*RouteStats, 0, len(r.routes))
+	for _, route := range r.routes {
+		sort.Float64s(route.samples)
+		route.P50 = percentile(route.samples, 50)
+		route.P90 = percentile(route.samples, 90)
+		route.P99 = percentile(route.samples, 99)
+		report.Routes = append(report.Routes, route)
+	}
+	sort.Slice(report.Routes, func(i, j int) bool {
+		a, b := report.Routes[i], report.Routes[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return routeKey{a.Method, a.Host, a.Route}.less(routeKey{b.Method, b.Host, b.Route})
+	})
+	return report
+}
+
+func (k routeKey) less(o routeKey) bool {
+	if k.host != o.host {
+		return k.host < o.host
+	}
+	if k.route != o.route {
+		return k.route < o.route
+	}
+	return k.method < o.method
+}
+
+// Wait implements the function of interface EventHandler.
+func (r *EventReport) Wait() {
+	report := r.Report()
+	if r.out != nil {
+		if err := report.WriteText(r.out); err != nil {
+			log.Printf("E! Write report, error: %v", err)
+		}
+	}
+	if r.filename == "" {
+		return
+	}
+
+	f, err := os.Create(r.filename)
+	if err != nil {
+		log.Printf("E! Cannot create report %s, error: %v", r.filename, err)
+		return
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(report); err != nil {
+		log.Printf("E! Write report %s, error: %v", r.filename, err)
+	}
+}
+
+// WriteText writes the report as text tables.
+func (r Report) WriteText(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Traffic report, %d requests, %d responses", r.Requests, r.Responses)
+	if !r.Start.IsZero() {
+		fmt.Fprintf(w, ", %s - %s", r.Start.Format(layout), r.End.Format(layout))
+	}
+	fmt.Fprint(w, "\n")
+
+	writeCounts(w, "METHOD", r.Methods)
+	writeCounts(w, "HOST", r.Hosts)
+	writeCounts(w, "STATUS", r.Statuses)
+
+	if len(r.Routes) > 0 {
+		fmt.Fprintln(w, "\nMETHOD\tHOST\tROUTE\tCOUNT\tP50(ms)\tP90(ms)\tP99(ms)\tMAX(ms)")
+		for _, s := range r.Routes {
+			latencies := "-\t-\t-\t-"
+			if s.Responses > 0 {
+				latencies = fmt.Sprintf("%.3f\t%.3f\t%.3f\t%.3f", s.P50, s.P90, s.P99, s.Max)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", s.Method, s.Host, s.Route, s.Count, latencies)
+		}
+	}
+
+	writeEntries(w, "LARGEST BODIES", r.LargestBodies)
+	writeEntries(w, "SLOWEST", r.Slowest)
+
+	parseErrors := make(map[string]int, len(r.ParseErrors))
+	for stage, n := range r.ParseErrors {
+		parseErrors[string(stage)] = n
+	}
+	writeCounts(w, "PARSE ERROR", parseErrors)
+	writeCounts(w, "DROPPED STREAM", r.DroppedStreams)
+
+	return w.Flush()
+}
+
+// writeCounts writes the counts sorted by count descending.
+func writeCounts(w io.Writer, name string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	fmt.Fprintf(w, "\n%s\tCOUNT\n", name)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%d\n", k, counts[k])
+	}
+}
+
+func writeEntries(w io.Writer, name string, entries []ReportEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\n%s\tSTREAM\tMETHOD\tHOST\tURI\tSTATUS\tREQUEST SIZE\tRESPONSE SIZE\tLATENCY(ms)\n", name)
+	for _, e := range entries {
+		latency := ""
+		if e.Latency > 0 {
+			latency = strconv.FormatFloat(e.Latency, 'f', 3, 64)
+		}
+		fmt.Fprintf(w, "%s\t#%d/%d\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", e.Time.Format(layout), e.Stream, e.ID,
+			e.Method, e.Host, e.URI, e.Status, e.RequestSize, e.ResponseSize, latency)
+	}
+}
@@ -0,0 +1,65 @@
+package httpstream
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventReport(t *testing.T) {
+	var out bytes.Buffer
+	r := NewEventReport("", &out)
+
+	start := time.Date(2021, 5, 19, 0, 0, 0, 0, time.UTC)
+	for i := 1; i <= 10; i++ {
+		begin := start.Add(time.Duration(i) * time.Second)
+		m := Message{StreamSeq: 1, ID: i, ServerAddr: "10.0.0.1:80", Header: http.Header{"Host": {"api"}},
+			Timing: Timing{RequestStart: begin, ResponseEnd: begin.Add(time.Duration(i) * time.Millisecond)}}
+		r.PushEvent(RequestEvent{Method: "GET", URI: "/users/" + strings.Repeat("1", i), Message: m})
+		if i <= 9 {
+			code := "200"
+			if i == 9 {
+				code, m.Body = "500", make([]byte, 100)
+			}
+			r.PushEvent(ResponseEvent{Code: code, Message: m})
+		}
+	}
+	r.PushEvent(ParseErrorEvent{Stage: StageHeader})
+	r.PushEvent(ParseErrorEvent{Stage: StageStream, Error: "dropped, lost segments"})
+
+	report := r.Report()
+	if report.Requests != 10 || report.Responses != 9 || report.Statuses["500"] != 1 || report.Hosts["api"] != 10 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if len(report.Routes) != 1 {
+		t.Fatalf("routes: %+v", report.Routes)
+	}
+	if s := report.Routes[0]; s.Route != "/users/{id}" || s.Count != 10 || s.P50 != 5 || s.P90 != 9 || s.Max != 9 {
+		t.Errorf("unexpected route: %+v", s)
+	}
+	if e := report.LargestBodies[0]; e.ID != 9 || e.ResponseSize != 100 {
+		t.Errorf("largest: %+v", e)
+	}
+	if len(report.Slowest) != 9 || report.Slowest[0].ID != 9 {
+		t.Errorf("slowest: %+v", report.Slowest)
+	}
+	if report.ParseErrors[StageHeader] != 1 || report.DroppedStreams["dropped, lost segments"] != 1 {
+		t.Errorf("parse errors: %v, dropped: %v", report.ParseErrors, report.DroppedStreams)
+	}
+
+	if err := report.WriteText(&out); err != nil || !strings.Contains(out.String(), "/users/{id}") {
+		t.Errorf("text: %s, error: %v", out.String(), err)
+	}
+}
+
+func TestRouteSamples(t *testing.T) {
+	var s RouteStats
+	for i := 1; i <= 5*maxRouteSamples; i++ {
+		s.observe(float64(i))
+	}
+	if len(s.samples) != maxRouteSamples || s.Responses != 5*maxRouteSamples || s.Max != 5*maxRouteSamples {
+		t.Errorf("samples %d, responses %d, max %v", len(s.samples), s.Responses, s.Max)
+	}
+}
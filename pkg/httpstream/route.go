@@ -0,0 +1,244 @@
+package httpstream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	routeNumber = regexp.MustCompile(`^\d+$`)
+	routeUUID   = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	routeHex    = regexp.MustCompile(`^[0-9a-fA-F]{8,}$`)
+	routeHash   = regexp.MustCompile(`^[0-9A-Za-z_\-=]{16,}$`)
+	routeDigit  = regexp.MustCompile(`\d`)
+	routeLetter = regexp.MustCompile(`[A-Za-z]`)
+)
+
+// Router normalizes the request URIs into routes, eg. /users/42/orders?page=1 to /users/{id}/orders.
+// The URIs are matched against the patterns first, or their variable segments are replaced by placeholders.
+type Router struct {
+	patterns []routePattern
+}
+
+// routePattern is a route like /users/{id}, whose {name} segment matches any segment.
+type routePattern struct {
+	route    string
+	segments []string
+	literals int
+}
+
+// NewRouter creates Router with the patterns, eg. /users/{id}, empty for the automatic normalization only.
+func NewRouter(patterns ...string) *Router {
+	r := &Router{}
+	for _, p := range patterns {
+		r.Add(p)
+	}
+	return r
+}
+
+// Add adds the pattern, the more literal segments a pattern has, the higher priority it has,
+// eg. /users/me is matched before /users/{id}.
+func (r *Router) Add(pattern string) {
+	pattern = "/" + strings.Trim(pattern, "/")
+	for _, p := range r.patterns {
+		if p.route == pattern {
+			return
+		}
+	}
+
+	p := routePattern{route: pattern, segments: strings.Split(strings.TrimSuffix(pattern, "/"), "/")}
+	for _, s := range p.segments {
+		if !isRouteParam(s) {
+			p.literals++
+		}
+	}
+	r.patterns = append(r.patterns, p)
+	sort.SliceStable(r.patterns, func(i, j int) bool { return r.patterns[i].literals > r.patterns[j].literals })
+}
+
+// Patterns returns the patterns in the order of matching.
+func (r *Router) Patterns() []string {
+	patterns := make([]string, len(r.patterns))
+	for i, p := range r.patterns {
+		patterns[i] = p.route
+	}
+	return patterns
+}
+
+func isRouteParam(s string) bool { return strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") }
+
+// Route returns the route of the request URI, a nil Router only normalizes the variable segments.
+func (r *Router) Route(uri string) string {
+	p := routePath(uri)
+	if r != nil && len(r.patterns) > 0 {
+		segments := strings.Split(strings.TrimSuffix(p, "/"), "/")
+		for _, pattern := range r.patterns {
+			if pattern.match(segments) {
+				return pattern.route
+			}
+		}
+	}
+	return normalizeRoute(p)
+}
+
+func (p routePattern) match(segments []string) bool {
+	if len(segments) != len(p.segments) {
+		return false
+	}
+	for i, s := range p.segments {
+		if s != segments[i] && !isRouteParam(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// routePath returns the path of the request URI, without the query and fragment.
+func routePath(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Host != "" {
+		uri = u.EscapedPath() // absolute-form of proxy requests
+	}
+	if p := strings.IndexAny(uri, "?#"); p >= 0 {
+		uri = uri[:p]
+	}
+	if uri == "" {
+		return "/"
+	}
+	return uri
+}
+
+// normalizeRoute replaces the variable segments of the path of uri with placeholders,
+// the numeric segments with {id}, UUIDs with {uuid}, hex strings with {hex}, and other hashes or tokens with {hash}.
+func normalizeRoute(uri string) string {
+	segments := strings.Split(routePath(uri), "/")
+	for i, s := range segments {
+		switch {
+		case s == "":
+		case routeNumber.MatchString(s):
+			segments[i] = "{id}"
+		case routeUUID.MatchString(s):
+			segments[i] = "{uuid}"
+		case routeHex.MatchString(s) && routeDigit.MatchString(s):
+			segments[i] = "{hex}"
+		case routeHash.MatchString(s) && routeDigit.MatchString(s) && routeLetter.MatchString(s):
+			segments[i] = "{hash}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// openAPISpec is the part of OpenAPI 3 and Swagger 2 documents to know the routes.
+type openAPISpec struct {
+	BasePath string                     `json:"basePath"` // Swagger 2
+	Servers  []struct{ URL string }     `json:"servers"`  // OpenAPI 3
+	Paths    map[string]json.RawMessage `json:"paths"`
+}
+
+// LoadOpenAPI reads the routes of the paths of the OpenAPI 3 or Swagger 2 document in JSON or YAML,
+// prefixed by the basePath, or the path of the first server.
+func LoadOpenAPI(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var spec openAPISpec
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, fmt.Errorf("parse OpenAPI %s, error: %w", filename, err)
+		}
+	} else {
+		spec = parseOpenAPIYaml(data)
+	}
+	if len(spec.Paths) == 0 {
+		return nil, fmt.Errorf("no paths found in OpenAPI %s", filename)
+	}
+
+	base := spec.BasePath
+	if base == "" && len(spec.Servers) > 0 {
+		if u, err := url.Parse(spec.Servers[0].URL); err == nil {
+			base = u.Path
+		}
+	}
+
+	routes := make([]string, 0, len(spec.Paths))
+	for p := range spec.Paths {
+		routes = append(routes, path.Join("/", base, p))
+	}
+	sort.Strings(routes)
+	return routes, nil
+}
+
+// parseOpenAPIYaml reads the top level basePath, the first servers url, and the keys of paths of the YAML document,
+// which is good enough for the routes without a YAML parser.
+func parseOpenAPIYaml(data []byte) (spec openAPISpec) {
+	spec.Paths = make(map[string]json.RawMessage)
+	section, childIndent := "", -1
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		indent := len(line) - len(trimmed)
+		if indent == 0 {
+			key, value := yamlKeyValue(trimmed)
+			section, childIndent = key, -1
+			if key == "basePath" {
+				spec.BasePath = value
+			}
+			continue
+		}
+
+		switch section {
+		case "paths":
+			if childIndent < 0 {
+				childIndent = indent
+			}
+			if key, _ := yamlKeyValue(trimmed); indent == childIndent && strings.HasPrefix(key, "/") {
+				spec.Paths[key] = nil
+			}
+		case "servers":
+			item := strings.TrimPrefix(trimmed, "- ")
+			if key, value := yamlKeyValue(item); key == "url" && len(spec.Servers) == 0 {
+				spec.Servers = append(spec.Servers, struct{ URL string }{URL: value})
+			}
+		}
+	}
+	return spec
+}
+
+// yamlKeyValue splits the YAML line key: value, and unquotes them.
+func yamlKeyValue(line string) (key, value string) {
+	unquote := func(s string) string {
+		s = strings.TrimSpace(s)
+		if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+			return s[1 : len(s)-1]
+		}
+		return s
+	}
+
+	if line != "" && (line[0] == '"' || line[0] == '\'') {
+		if end := strings.IndexByte(line[1:], line[0]); end >= 0 {
+			key, line = line[1:end+1], line[end+2:]
+			return key, unquote(strings.TrimPrefix(strings.TrimSpace(line), ":"))
+		}
+	}
+
+	p := strings.Index(line, ":")
+	if p < 0 {
+		return unquote(line), ""
+	}
+	return unquote(line[:p]), unquote(line[p+1:])
+}
@@ -0,0 +1,62 @@
+package httpstream
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizeRoute(t *testing.T) {
+	cases := map[string]string{
+		"":                        "/",
+		"/":                       "/",
+		"/users/42/orders?page=1": "/users/{id}/orders",
+		"/o/9b2f0c1e-6a1d-4c1e-8f3a-2b6c7d8e9f00": "/o/{uuid}",
+		"/blob/0123456789abcdef0123":              "/blob/{hex}",
+		"http://a.com/users/7#top":                "/users/{id}",
+		"/v1/users":                               "/v1/users",
+	}
+	for uri, want := range cases {
+		if got := normalizeRoute(uri); got != want {
+			t.Errorf("normalizeRoute(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	r := NewRouter("/users/{id}", "/users/me", "/files/{name}/")
+	cases := map[string]string{
+		"/users/42?x=1":             "/users/{id}",
+		"/users/me":                 "/users/me",
+		"/users/abc":                "/users/{id}",
+		"/files/a.txt/":             "/files/{name}",
+		"/users/42/orders/9f8e7d6c": "/users/{id}/orders/{hex}",
+		"/t/AbCdEf0123456789xyz":    "/t/{hash}",
+		"/about":                    "/about",
+	}
+	for uri, want := range cases {
+		if got := r.Route(uri); got != want {
+			t.Errorf("Route(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestLoadOpenAPI(t *testing.T) {
+	dir := t.TempDir()
+	specs := map[string]string{
+		"a.yaml": "openapi: 3.0.0\nservers:\n  - url: https://api.example.com/v1\npaths:\n" +
+			"  /users/{userId}:\n    get:\n      parameters: []\n  '/users/{userId}/orders':\n    post: {}\n" +
+			"components:\n  schemas: {}\n",
+		"b.json": `{"swagger": "2.0", "basePath": "/v1", "paths": {"/users/{userId}": {}, "/users/{userId}/orders": {}}}`,
+	}
+	for name, spec := range specs {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(spec), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		routes, err := LoadOpenAPI(filename)
+		if err != nil || len(routes) != 2 || routes[0] != "/v1/users/{userId}" || routes[1] != "/v1/users/{userId}/orders" {
+			t.Errorf("%s: routes %v, error: %v", name, routes, err)
+		}
+	}
+}
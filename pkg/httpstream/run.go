@@ -3,6 +3,8 @@ package httpstream
 import (
 	"log"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -11,48 +13,344 @@ import (
 	"github.com/google/gopacket/tcpassembly"
 )
 
-func Run(ps *gopacket.PacketSource, outputPcap string, ech chan<- interface{}, snapLen int, onlyRequests bool, onlyMethod string) {
-	pcapWriter, writerCloser, err := createPcapWriter(outputPcap, snapLen)
+// PacketSource is the source of packets, eg. *gopacket.PacketSource, whose channel is closed at the end.
+type PacketSource interface {
+	Packets() chan gopacket.Packet
+}
+
+// Run turns the packets of the source into events, ech is closed at the end.
+func Run(ps PacketSource, ech chan<- Event, opt Options) {
+	p, err := NewPipeline(ech, opt)
 	if err != nil {
 		panic(err)
 	}
 
-	defer writerCloser()
+	stats := p.Feed(ps)
+	log.Println("Parse complete, packet count: ", stats.Packets)
+	p.Close()
+}
+
+// FeedStats is the statistics of a packet source fed to Pipeline.
+type FeedStats struct {
+	Packets     int
+	Requests    int
+	Responses   int
+	Connections int
+	ParseErrors int
+	Dropped     int // streams dropped by the reassembly, not counted in ParseErrors
+	Findings    int
+	Elapsed     time.Duration
+}
+
+// Pipeline turns the packets of one or more sources into events.
+type Pipeline struct {
+	factories []*Factory // a factory a shard
+	ech       chan<- Event
+	offline   bool
+	// maxPages and maxStreamPages are the pages of out-of-order segments buffered by an assembler and a stream.
+	maxPages, maxStreamPages int
+	pcapWriter               pcapWriterFn
+	closeWriter              func()
+}
+
+// NewPipeline creates Pipeline, which sends the events to ech.
+func NewPipeline(ech chan<- Event, opt Options) (*Pipeline, error) {
+	pcapWriter, closeWriter, err := createPcapWriter(opt.OutputPcap, opt.SnapLen)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := opt.Shards
+	if shards < 1 {
+		shards = 1
+	}
+
+	p := &Pipeline{
+		factories:      newShardFactories(ech, opt, shards),
+		ech:            ech,
+		offline:        opt.Offline,
+		maxPages:       memoryPages(opt.MaxMemory, shards),
+		maxStreamPages: memoryPages(opt.MaxStreamMemory, 1),
+		pcapWriter:     pcapWriter,
+		closeWriter:    closeWriter,
+	}
+	registerPipeline(p, true)
+	return p, nil
+}
+
+// Feed assembles all the packets of the source, and returns when the events of the source are all sent.
+func (p *Pipeline) Feed(ps PacketSource) (stats FeedStats) {
+	start := time.Now()
+
+	// the events of the source are counted on the way to ech.
+	ch := make(chan Event, cap(p.ech))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range ch {
+			stats.count(e)
+			p.ech <- e
+		}
+	}()
+
+	var wg sync.WaitGroup
+	shards := make([]*shard, len(p.factories))
+	for i, f := range p.factories {
+		f.reset(ch)
+		shards[i] = newShard(f, p.maxPages, p.maxStreamPages)
+		wg.Add(1)
+		go func(s *shard) {
+			defer wg.Done()
+			s.run()
+		}(shards[i])
+	}
+
+	packets := p.loop(shards, ps)
+	for _, s := range shards {
+		close(s.packets)
+	}
+	wg.Wait()
+	for _, f := range p.factories {
+		f.Wait()
+	}
+
+	close(ch)
+	<-done
+
+	stats.Packets = packets
+	stats.Elapsed = time.Since(start)
+	return stats
+}
 
-	factory := NewFactory(ech, onlyRequests, onlyMethod)
-	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(factory))
-	count := loop(assembler, ps, pcapWriter)
-	assembler.FlushAll()
-	log.Println("Read pcap writer complete")
-	factory.Wait()
-	log.Println("Parse complete, packet count: ", count)
+// Close closes the pipeline and the event channel.
+func (p *Pipeline) Close() {
+	registerPipeline(p, false)
+	p.closeWriter()
+	close(p.ech)
+}
 
-	close(ech)
+// Add adds the statistics of another source.
+func (s *FeedStats) Add(o FeedStats) {
+	s.Packets += o.Packets
+	s.Requests += o.Requests
+	s.Responses += o.Responses
+	s.Connections += o.Connections
+	s.ParseErrors += o.ParseErrors
+	s.Dropped += o.Dropped
+	s.Findings += o.Findings
+	s.Elapsed += o.Elapsed
+}
+
+func (s *FeedStats) count(e Event) {
+	switch e.Kind() {
+	case KindRequest:
+		s.Requests++
+	case KindResponse:
+		s.Responses++
+	case KindConnection:
+		if e.(ConnectionEvent).State != ConnOpen {
+			s.Connections++
+		}
+	case KindParseError:
+		if e.(ParseErrorEvent).Stage == StageStream {
+			s.Dropped++
+		} else {
+			s.ParseErrors++
+		}
+	case KindFinding:
+		s.Findings++
+	}
 }
 
-func loop(assembler *tcpassembly.Assembler, ps *gopacket.PacketSource, pcapWriter pcapWriterFn) int {
+const (
+	flushInterval = 5 * time.Second  // how often the idle streams are flushed
+	streamTimeout = 10 * time.Second // how long a stream is idle before it is flushed
+)
+
+// loop dispatches the TCP packets of the source to the shards by the flows, and returns the count of them.
+func (p *Pipeline) loop(shards []*shard, ps PacketSource) int {
 	count := 0
-	ticker := time.NewTicker(5 * time.Second)
+	seqs := newFlowSeqs(p.factories[0].seq)
+	ticker := time.NewTicker(flushInterval)
 	defer ticker.Stop()
 
+	var lastFlush time.Time
 	for {
 		select {
-		case p := <-ps.Packets():
-			if p == nil { // A nil packet indicates the end of a pcap writer.
+		case pkt := <-ps.Packets():
+			if pkt == nil { // A nil packet indicates the end of a pcap writer.
 				return count
 			}
 
-			n, t := p.NetworkLayer(), p.TransportLayer()
+			n, t := pkt.NetworkLayer(), pkt.TransportLayer()
 			if n == nil || t == nil || t.LayerType() != layers.LayerTypeTCP {
 				continue
 			}
 
-			_ = pcapWriter(p.Metadata().CaptureInfo, p.Data())
-			assembler.AssembleWithTimestamp(n.NetworkFlow(), t.(*layers.TCP), p.Metadata().Timestamp)
+			seen := pkt.Metadata().Timestamp
+			_ = p.pcapWriter(pkt.Metadata().CaptureInfo, pkt.Data())
+			tcp := t.(*layers.TCP)
+			s := shards[0]
+			if len(shards) > 1 {
+				s = shards[flowHash(n.NetworkFlow(), tcp.TransportFlow())%uint64(len(shards))]
+			}
+			seq, newSeq := seqs.next(streamKey{net: n.NetworkFlow(), tcp: tcp.TransportFlow()}, tcp, seen)
+			s.packets <- shardPacket{net: n.NetworkFlow(), tcp: tcp, seen: seen, seq: seq, newSeq: newSeq}
+			atomic.AddUint64(&processedPackets, 1)
 			count++
+
+			// offline packets are flushed by the time of packets, instead of the wall clock.
+			if p.offline && seen.Sub(lastFlush) >= flushInterval {
+				if !lastFlush.IsZero() {
+					flushShards(shards, seen.Add(-streamTimeout))
+					seqs.expire(seen.Add(-streamTimeout))
+				}
+				lastFlush = seen
+			}
 		case <-ticker.C:
-			assembler.FlushOlderThan(time.Now().Add(time.Second * -10))
+			if !p.offline {
+				flushShards(shards, time.Now().Add(-streamTimeout))
+				seqs.expire(time.Now().Add(-streamTimeout))
+			}
+		}
+	}
+}
+
+// flowHash hashes the flow of a packet, the same for both directions, so that a connection is in one shard.
+func flowHash(netFlow, tcpFlow gopacket.Flow) uint64 {
+	return netFlow.FastHash()*31 + tcpFlow.FastHash()
+}
+
+// flowSeqs numbers the connections in the order the dispatcher sees them, the same for any number of shards.
+// It follows the directions opened and closed by the assemblers, and numbers a connection when a stream of it
+// would create a pair in Factory.New, which takes the number passed with the packet.
+type flowSeqs struct {
+	seq   *uint64                // the next sequence number, shared with the factories
+	flows map[streamKey]*flowSeq // by both directions
+}
+
+// flowSeq is the number of a connection and its directions, the first seen first.
+type flowSeq struct {
+	seq    uint
+	paired bool // the other direction has joined the pair of seq
+	keys   [2]streamKey
+	open   [2]bool
+	last   [2]time.Time
+}
+
+func newFlowSeqs(seq *uint64) *flowSeqs {
+	return &flowSeqs{seq: seq, flows: make(map[streamKey]*flowSeq)}
+}
+
+// next returns the number of the connection of the packet of key, and whether it is new for the packet.
+func (s *flowSeqs) next(key streamKey, tcp *layers.TCP, seen time.Time) (seq uint, newSeq bool) {
+	// the assemblers create the streams of SYN or payload only
+	creates := tcp.SYN || len(tcp.Payload) > 0
+	f, ok := s.flows[key]
+	if !ok {
+		if !creates {
+			return 0, false
+		}
+		f = &flowSeq{keys: [2]streamKey{key, {net: key.net.Reverse(), tcp: key.tcp.Reverse()}}}
+		s.flows[f.keys[0]], s.flows[f.keys[1]] = f, f
+	}
+
+	d := 0
+	if key != f.keys[0] {
+		d = 1
+	}
+	if !f.open[d] && creates {
+		f.open[d] = true
+		if f.open[1-d] && !f.paired {
+			f.paired = true
+		} else {
+			f.seq, f.paired, newSeq = uint(atomic.AddUint64(s.seq, 1)-1), false, true
+		}
+	}
+	f.last[d] = seen
+	if tcp.FIN || tcp.RST {
+		f.open[d] = false
+		s.closed(f)
+	}
+	return f.seq, newSeq
+}
+
+// expire closes the directions idle since before, as the assemblers flush them.
+func (s *flowSeqs) expire(before time.Time) {
+	for key, f := range s.flows {
+		if key != f.keys[0] {
+			continue
+		}
+		for d := range f.open {
+			if f.last[d].Before(before) {
+				f.open[d] = false
+			}
+		}
+		s.closed(f)
+	}
+}
+
+// closed forgets the connection if both directions are closed.
+func (s *flowSeqs) closed(f *flowSeq) {
+	if !f.open[0] && !f.open[1] {
+		delete(s.flows, f.keys[0])
+		delete(s.flows, f.keys[1])
+	}
+}
+
+// shardQueue is the packets queued to a shard.
+const shardQueue = 1000
+
+// shard assembles the TCP packets of its flows by its own assembler and factory in a goroutine.
+type shard struct {
+	factory   *Factory
+	assembler *tcpassembly.Assembler
+	packets   chan shardPacket
+}
+
+// shardPacket is a TCP packet to assemble, or a flush of the streams idle since flush when tcp is nil,
+// which is queued with the packets to keep the order of them. seq is the number of the connection by the dispatcher,
+// newSeq if the packet starts a new pair of streams.
+type shardPacket struct {
+	net    gopacket.Flow
+	tcp    *layers.TCP
+	seen   time.Time
+	flush  time.Time
+	seq    uint
+	newSeq bool
+}
+
+// newShard creates a shard, whose assembler buffers at most the pages of out-of-order segments, in total and
+// of a stream, 0 for unlimited, and skips the missing segments when it is over them.
+func newShard(f *Factory, maxPages, maxStreamPages int) *shard {
+	a := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(f))
+	a.MaxBufferedPagesTotal, a.MaxBufferedPagesPerConnection = maxPages, maxStreamPages
+	return &shard{factory: f, assembler: a, packets: make(chan shardPacket, shardQueue)}
+}
+
+// run assembles the packets until the channel is closed, and then flushes all the streams.
+func (s *shard) run() {
+	for pkt := range s.packets {
+		if pkt.tcp == nil {
+			s.assembler.FlushOlderThan(pkt.flush)
+			continue
 		}
+		s.factory.LearnSNI(pkt.net, pkt.tcp)
+		tracked := s.factory.Track(pkt.net, pkt.tcp, pkt.seen)
+		s.factory.dispatched, s.factory.dispatchedSeq = pkt.newSeq, pkt.seq
+		s.assembler.AssembleWithTimestamp(pkt.net, pkt.tcp, pkt.seen)
+		if !tracked {
+			s.factory.Track(pkt.net, pkt.tcp, pkt.seen)
+		}
+	}
+
+	s.factory.markClosing()
+	s.assembler.FlushAll()
+}
+
+func flushShards(shards []*shard, olderThan time.Time) {
+	for _, s := range shards {
+		s.packets <- shardPacket{flush: olderThan}
 	}
 }
 
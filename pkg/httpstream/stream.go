@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -24,11 +27,22 @@ func (k *streamKey) String() string {
 	return fmt.Sprintf("{%v:%v} -> {%v:%v}", k.net.Src(), k.tcp.Src(), k.net.Dst(), k.tcp.Dst())
 }
 
+func (k streamKey) src() string { return k.net.Src().String() + ":" + k.tcp.Src().String() }
+func (k streamKey) dst() string { return k.net.Dst().String() + ":" + k.tcp.Dst().String() }
+
 type httpStream struct {
 	reader *Reader
-	bytes  uint64
+	bytes  uint64 // accessed atomically
 	key    streamKey
 	bad    bool
+
+	// dropped tells why the rest of the stream is dropped, at the time droppedAt, empty if not.
+	dropped   string
+	droppedAt time.Time
+
+	bodies      *bodyLimits // nil for unlimited
+	detect      bool        // detect protocol ambiguities
+	ambiguities []ambiguity
 }
 
 func newHTTPStream(key streamKey) *httpStream {
@@ -37,6 +51,10 @@ func newHTTPStream(key streamKey) *httpStream {
 
 // Reassembled is called by tcpassembly.
 func (s *httpStream) Reassembled(rs []tcpassembly.Reassembly) {
+	for _, r := range rs {
+		atomic.AddUint64(&s.bytes, uint64(len(r.Bytes)))
+	}
+
 	if s.bad {
 		return
 	}
@@ -45,7 +63,11 @@ func (s *httpStream) Reassembled(rs []tcpassembly.Reassembly) {
 
 	for _, r := range rs {
 		if r.Skip != 0 {
-			s.bad = true
+			if r.Skip < 0 {
+				s.drop("missing the start of stream", r.Seen)
+			} else {
+				s.drop("lost segments", r.Seen)
+			}
 			return
 		}
 
@@ -53,26 +75,36 @@ func (s *httpStream) Reassembled(rs []tcpassembly.Reassembly) {
 			continue
 		}
 
-		s.bytes += uint64(len(r.Bytes))
 		ticker.Reset(time.Second)
 
+		s.reader.mem.alloc(len(r.Bytes))
 		select {
 		case <-s.reader.stopCh:
+			s.reader.mem.free(len(r.Bytes))
 			s.bad = true
 			return
 		case s.reader.src <- NewDataBlock(r.Bytes, r.Seen):
 		case <-ticker.C:
 			// Sometimes pcap only captured HTTP response with no request!
 			// Let's wait few seconds to avoid dead lock.
-			s.bad = true
+			s.reader.mem.free(len(r.Bytes))
+			s.drop("stalled parsing", r.Seen)
 			return
 		}
 	}
 }
 
+// drop drops the rest of the stream, the reason is reported as a ParseErrorEvent of StageStream.
+func (s *httpStream) drop(reason string, seen time.Time) {
+	s.bad = true
+	s.dropped = reason
+	s.droppedAt = seen
+}
+
 // ReassemblyComplete is called by tcpassembly.
 func (s *httpStream) ReassemblyComplete() {
 	close(s.reader.src)
+	s.reader.mem.done()
 }
 
 var (
@@ -95,6 +127,10 @@ func (s *httpStream) parseFirstLine(initDir Direction) (dir Direction, p1, p2, p
 	}
 
 	line := string(b)
+	if s.detect {
+		s.inspectLine(StageFirstLine, b)
+	}
+
 	switch initDir {
 	case DirectionUnknown:
 		if r := httpResponseFirstLine.FindStringSubmatch(line); len(r) == 4 {
@@ -112,54 +148,79 @@ func (s *httpStream) parseFirstLine(initDir Direction) (dir Direction, p1, p2, p
 			return DirectionResponse, r[1], r[2], r[3], nil
 		}
 	}
-	return DirectionUnknown, "", "", "", fmt.Errorf("bad HTTP first line: %s", line)
+	return DirectionUnknown, "", "", "", newParseError(StageFirstLine, b, "bad HTTP first line: %q", line)
 }
 
-func (s *httpStream) parseHeader() (header http.Header, err error) {
+// parseHeader parses the header, raw keeps the fields in the order and case of the wire.
+func (s *httpStream) parseHeader() (header http.Header, raw []Header, err error) {
 	d, err := s.reader.ReadUntil([]byte("\r\n\r\n"))
 	if err != nil {
-		return nil, fmt.Errorf("read headers error: %w", err)
+		return nil, nil, fmt.Errorf("read headers error: %w", err)
+	}
+
+	if s.detect {
+		s.inspectHeader(d)
 	}
 
 	header = make(http.Header)
 	data := string(d[:len(d)-4])
+	var last string
 	for i, line := range strings.Split(data, "\r\n") {
+		if last != "" && line != "" && (line[0] == ' ' || line[0] == '\t') {
+			// obsolete line folding, replace it with a SP as RFC 7230 3.2.4.
+			v := header[last]
+			v[len(v)-1] += " " + strings.Trim(line, " \t")
+			raw[len(raw)-1].Value = v[len(v)-1]
+			continue
+		}
+
 		p := strings.Index(line, ":")
 		if p == -1 {
-			return nil, fmt.Errorf("bad http header (line %d): %s", i, data)
+			return nil, nil, newParseError(StageHeader, d, "bad http header (line %d): %q", i, line)
 		}
 
-		header.Add(line[:p], strings.Trim(line[p+1:], " "))
+		last = http.CanonicalHeaderKey(line[:p])
+		value := strings.Trim(line[p+1:], " ")
+		header.Add(last, value)
+		raw = append(raw, Header{Name: line[:p], Value: value})
 	}
 
-	return header, nil
+	return header, raw, nil
 }
 
-func (s *httpStream) parseChunked() (body []byte, err error) {
+// parseChunked parses the chunked body by r, and returns the size of it.
+func (s *httpStream) parseChunked(r *bodyReader) (body []byte, size int, err error) {
 	var buf []byte
 	for {
 		if buf, err = s.reader.ReadUntil([]byte("\r\n")); err != nil {
-			return nil, fmt.Errorf("read chuncked content, error: %w", err)
+			return nil, 0, fmt.Errorf("read chuncked content, error: %w", err)
 		}
 		l := string(buf)
-		l = strings.Trim(l[:len(l)-2], " ")
+		l = l[:len(l)-2]
+		if p := strings.Index(l, ";"); p >= 0 {
+			if s.detect {
+				s.inspectChunkExt(l[p:])
+			}
+			l = l[:p]
+		}
+		l = strings.Trim(l, " ")
 		blockSize, err := strconv.ParseInt(l, 16, 32)
 		if err != nil {
-			return nil, fmt.Errorf("bad chunked block length %s, error: %w", l, err)
+			return body, 0, newParseError(StageChunked, buf, "bad chunked block length %q, error: %w", l, err)
 		}
 
 		if blockSize > 0 {
-			if buf, err = s.reader.Next(int(blockSize)); err != nil {
-				return nil, fmt.Errorf("read chuncked content, error: %w", err)
+			size += int(blockSize)
+			if body, err = r.read(body, int(blockSize)); err != nil {
+				return body, 0, fmt.Errorf("read chuncked content, error: %w", err)
 			}
-			body = append(body, buf...)
 		}
 
 		if buf, err = s.reader.Next(2); err != nil {
-			return nil, fmt.Errorf("read chuncked content, error: %w", err)
+			return body, 0, fmt.Errorf("read chuncked content, error: %w", err)
 		}
 		if CRLF := string(buf); CRLF != "\r\n" {
-			return nil, fmt.Errorf("bad chunked block data")
+			return body, 0, newParseError(StageChunked, buf, "bad chunked block data")
 		}
 
 		if blockSize == 0 {
@@ -167,7 +228,7 @@ func (s *httpStream) parseChunked() (body []byte, err error) {
 		}
 	}
 
-	return body, nil
+	return body, size, nil
 }
 
 func parseContentInfo(hs http.Header) (contentLen int, contentEncoding, contentType string, chunked bool, err error) {
@@ -176,10 +237,10 @@ func parseContentInfo(hs http.Header) (contentLen int, contentEncoding, contentT
 		case "content-length":
 			if contentLen, err = strconv.Atoi(value); err != nil {
 				return contentLen, contentEncoding, contentType, chunked,
-					fmt.Errorf("content-Length: %s, error: %w", value, err)
+					newParseError(StageContentInfo, []byte(value), "content-Length: %s, error: %w", value, err)
 			}
 		case "transfer-encoding":
-			chunked = value == "chunked"
+			chunked = isChunked(hs.Values(name))
 		case "content-encoding":
 			contentEncoding = value
 		case "content-type":
@@ -190,37 +251,88 @@ func parseContentInfo(hs http.Header) (contentLen int, contentEncoding, contentT
 	return contentLen, contentEncoding, contentType, chunked, nil
 }
 
-func (s *httpStream) parseBody(method string, header http.Header, isRequest bool) (body []byte, e error) {
+// isChunked tells whether chunked is the final transfer coding, RFC 7230 3.3.3.
+func isChunked(values []string) bool {
+	codings := strings.Split(strings.Join(values, ","), ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// parseBody parses the body, which is truncated to the limit of the direction and the memory budget of the stream.
+func (s *httpStream) parseBody(method string, header http.Header, isRequest bool) (body []byte, info bodyInfo, e error) {
 	cLength, cEncoding, _, chunked, err := parseContentInfo(header)
+	if s.detect {
+		s.inspectContentInfo(header)
+	}
 	if err != nil {
-		return nil, err
+		return nil, info, err
 	}
 
 	if cLength == 0 && !chunked || !isRequest && method == "HEAD" {
-		return nil, nil
+		return nil, info, nil
 	}
 
+	// the raw body is accounted in the memory of the stream while it is parsed.
+	memLimit, limit := s.reader.mem.limit(), s.bodies.limit(isRequest)
+	r := &bodyReader{reader: s.reader, max: memLimit, dir: s.bodies.spillDir()}
+	if limit > 0 && (memLimit <= 0 || limit < memLimit) {
+		r.max = limit
+	}
 	if chunked {
-		body, err = s.parseChunked()
+		body, info.size, err = s.parseChunked(r)
 	} else {
-		body, err = s.reader.Next(cLength)
+		body, err = r.read(nil, cLength)
+		info.size = cLength
 	}
+	info.sha256 = r.close(err == nil)
+	defer s.reader.freeBody(body)
 	if err != nil {
-		return nil, err
+		return nil, bodyInfo{}, err
+	}
+
+	if info.truncated = len(body) < info.size; info.truncated {
+		if r.max == memLimit {
+			atomic.AddUint64(&truncatedBodies, 1)
+		} else {
+			atomic.AddUint64(&limitedBodies, 1)
+		}
 	}
 
+	var dr io.ReadCloser
 	switch cEncoding {
 	case "gzip":
-		r, _ := gzip.NewReader(bytes.NewBuffer(body))
-		data, err := ioutil.ReadAll(r)
-		_ = r.Close()
-		return data, err
+		dr, err = gzip.NewReader(bytes.NewBuffer(body))
 	case "deflate":
-		r, _ := zlib.NewReader(bytes.NewBuffer(body))
-		data, err := ioutil.ReadAll(r)
-		_ = r.Close()
-		return data, err
+		dr, err = zlib.NewReader(bytes.NewBuffer(body))
+	default:
+		return body, info, nil
+	}
+	if err != nil {
+		if info.truncated { // the truncated body may be undecodable
+			return body, info, nil
+		}
+		return nil, bodyInfo{}, newParseError(StageBody, body, "%s content, error: %w", cEncoding, err)
 	}
 
-	return body, nil
+	// the decoded body is truncated to the same limit, against the compression bombs.
+	var decoded io.Reader = dr
+	if r.max > 0 {
+		decoded = io.LimitReader(dr, int64(r.max)+1)
+	}
+	data, err := ioutil.ReadAll(decoded)
+	_ = dr.Close()
+	if err != nil && !(info.truncated && errors.Is(err, io.ErrUnexpectedEOF)) {
+		return nil, bodyInfo{}, newParseError(StageBody, body, "%s content, error: %w", cEncoding, err)
+	}
+	if r.max > 0 && len(data) > r.max {
+		data = data[:r.max]
+		if !info.truncated {
+			info.truncated = true
+			if r.max == memLimit {
+				atomic.AddUint64(&truncatedBodies, 1)
+			} else {
+				atomic.AddUint64(&limitedBodies, 1)
+			}
+		}
+	}
+	return data, info, nil
 }
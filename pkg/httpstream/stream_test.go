@@ -2,27 +2,31 @@ package httpstream
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/google/gopacket/tcpassembly"
 )
 
 func TestNgnet(t *testing.T) {
-	eventChan := make(chan interface{}, 1024)
-	f := NewFactory(eventChan, false, "")
+	eventChan := make(chan Event, 1024)
+	f := NewFactory(eventChan, Options{})
 	assembler := tcpassembly.NewAssembler(tcpassembly.NewStreamPool(f))
 	packetCount := 0
 	fmt.Println("Run")
 
-	handle, err := pcap.OpenOffline("testdata/dump.pcap")
+	ps, err := NewPacketSource("testdata/dump.pcap", "", 0)
 	if err != nil {
 		panic(err)
 	}
 
-	ps := gopacket.NewPacketSource(handle, handle.LinkType())
 	for p := range ps.Packets() {
 		n, t := p.NetworkLayer(), p.TransportLayer()
 		if n == nil || t == nil || t.LayerType() != layers.LayerTypeTCP {
@@ -36,3 +40,288 @@ func TestNgnet(t *testing.T) {
 	f.Wait()
 	fmt.Println("p:", packetCount, "http:", len(eventChan))
 }
+
+func TestConnectionEvents(t *testing.T) {
+	ps, err := NewPacketSource("testdata/dump.pcap", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventChan := make(chan Event, 1024)
+	Run(ps, eventChan, Options{ConnEvents: true})
+
+	states := make(map[ConnState]int)
+	transactions := 0
+	for e := range eventChan {
+		if c, ok := e.(ConnectionEvent); ok {
+			states[c.State]++
+			transactions += c.Transactions
+		}
+	}
+
+	if states[ConnOpen] == 0 || states[ConnUnfinished] != states[ConnOpen] || transactions == 0 {
+		t.Fatalf("unexpected connection events: %v, transactions: %d", states, transactions)
+	}
+}
+
+// writePcap writes the TCP packets between client and server, sent by the client if toServer, to a pcap file.
+func writePcap(t *testing.T, filename string, client, server string, packets []*layers.TCP, toServer []bool) {
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2021, 5, 19, 22, 35, 41, 0, time.UTC)
+	for i, tcp := range packets {
+		src, dst := client, server
+		if !toServer[i] {
+			src, dst = server, client
+		}
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+			SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+		_ = tcp.SetNetworkLayerForChecksum(ip)
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			eth, ip, tcp, gopacket.Payload(tcp.Payload)); err != nil {
+			t.Fatal(err)
+		}
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * time.Millisecond),
+			CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+		if err := w.WritePacket(ci, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnectionStates(t *testing.T) {
+	const client, server = "10.0.0.1", "10.0.0.2"
+	packets := []*layers.TCP{
+		// refused
+		{SrcPort: 5000, DstPort: 80, SYN: true, Seq: 100},
+		{SrcPort: 80, DstPort: 5000, RST: true, ACK: true, Ack: 101},
+		// closed, the last FIN is the last packet of the stream
+		{SrcPort: 5001, DstPort: 80, SYN: true, Seq: 200},
+		{SrcPort: 80, DstPort: 5001, SYN: true, ACK: true, Seq: 900, Ack: 201},
+		{SrcPort: 5001, DstPort: 80, ACK: true, Seq: 201, Ack: 901},
+		{SrcPort: 5001, DstPort: 80, FIN: true, ACK: true, Seq: 201, Ack: 901},
+		{SrcPort: 80, DstPort: 5001, FIN: true, ACK: true, Seq: 901, Ack: 202},
+	}
+	filename := filepath.Join(t.TempDir(), "states.pcap")
+	writePcap(t, filename, client, server, packets, []bool{true, false, true, false, true, true, false})
+
+	ps, err := NewPacketSource(filename, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventChan := make(chan Event, 1024)
+	Run(ps, eventChan, Options{Offline: true, ConnEvents: true})
+
+	states := make(map[string]ConnState)
+	for e := range eventChan {
+		if c, ok := e.(ConnectionEvent); ok && c.State != ConnOpen {
+			states[c.ClientAddr] = c.State
+		}
+	}
+	if states[client+":5000"] != ConnRefused || states[client+":5001"] != ConnClosed {
+		t.Errorf("connection states: %v", states)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	ps, err := NewPacketSource("testdata/dump.pcap", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventChan := make(chan Event, 1024)
+	Run(ps, eventChan, Options{})
+
+	handshakes, responses := 0, 0
+	for e := range eventChan {
+		switch v := e.(type) {
+		case RequestEvent:
+			if v.ID == 1 && v.Timing.Handshake > 0 {
+				handshakes++
+			}
+			if v.Start.After(v.End) {
+				t.Fatalf("request %d/%d ends before start: %s", v.StreamSeq, v.ID, v.Timing)
+			}
+		case ResponseEvent:
+			if v.Timing.Wait() < 0 || v.Timing.Receive() < 0 || v.Timing.Total() <= 0 {
+				t.Fatalf("bad timing of response %d/%d: %s", v.StreamSeq, v.ID, v.Timing)
+			}
+			responses++
+		}
+	}
+
+	if handshakes == 0 || responses == 0 {
+		t.Fatalf("handshakes: %d, responses: %d", handshakes, responses)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	p := newPair(0, make(chan Event), false, nil, nil, nil)
+	wait := func(expected int) time.Duration {
+		start := time.Now()
+		if id := p.requestID(); id != expected {
+			t.Errorf("request ID %d, expected %d", id, expected)
+		}
+		return time.Since(start)
+	}
+
+	if d := wait(0); d < pairTimeout {
+		t.Errorf("the first unpaired response waited %s", d)
+	}
+	if d := wait(0); d >= pairTimeout {
+		t.Errorf("the next unpaired response waited %s", d)
+	}
+	p.idChan <- 1
+	wait(1)
+	if d := wait(0); d < pairTimeout { // paired again, the late request is waited
+		t.Errorf("the response after a paired one waited %s", d)
+	}
+}
+
+// parseStream runs a pair on a single stream fed with data, and returns the events emitted.
+func parseStream(data string, detect bool) (events []Event) {
+	eventChan := make(chan Event, 16)
+	p := newPair(0, eventChan, false, nil, nil, nil)
+	s := newHTTPStream(streamKey{})
+	s.detect = detect
+	s.reader.src <- NewDataBlock([]byte(data), time.Now())
+	close(s.reader.src)
+
+	p.run(s, func(string) bool { return true })
+	close(eventChan)
+	for e := range eventChan {
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestParseErrorEvent(t *testing.T) {
+	events := parseStream("POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", false)
+	if len(events) != 1 {
+		t.Fatalf("events: %v", events)
+	}
+
+	e, ok := events[0].(ParseErrorEvent)
+	if !ok || e.Stage != StageChunked || e.Snippet != "7a7a0d0a" {
+		t.Fatalf("unexpected event: %+v", events[0])
+	}
+}
+
+func TestAmbiguityFindings(t *testing.T) {
+	cases := map[string]string{
+		RuleCLTEConflict:    "POST / HTTP/1.1\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		RuleDuplicateCL:     "POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab",
+		RuleObfuscatedTE:    "POST / HTTP/1.1\r\nTransfer-Encoding: Chunked\r\n\r\n0\r\n\r\n",
+		RuleObsFold:         "GET / HTTP/1.1\r\nX-A: 1\r\n 2\r\n\r\n",
+		RuleBareLF:          "GET / HTTP/1.1\r\nX-A: 1\nX-B: 2\r\n\r\n",
+		RuleInvalidChunkExt: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1;a=\"b\r\nx\r\n0\r\n\r\n",
+	}
+
+	for rule, data := range cases {
+		var rules []string
+		for _, e := range parseStream(data, true) {
+			if f, ok := e.(FindingEvent); ok {
+				rules = append(rules, f.Rule)
+			}
+		}
+		if len(rules) != 1 || rules[0] != rule {
+			t.Errorf("%s: got findings %v", rule, rules)
+		}
+	}
+
+	for _, e := range parseStream("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n1;a=b\r\nx\r\n0\r\n\r\n", true) {
+		if _, ok := e.(FindingEvent); ok {
+			t.Errorf("unexpected finding: %+v", e)
+		}
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	eventChan := make(chan Event, 1024)
+	p, err := NewPipeline(eventChan, Options{Offline: true, ConnEvents: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var total FeedStats
+	for i := 0; i < 2; i++ {
+		ps, err := NewPacketSource("testdata/dump.pcap", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := p.Feed(ps)
+		if s.Packets == 0 || s.Requests == 0 || s.Connections == 0 {
+			t.Errorf("stats of feed %d: %+v", i, s)
+		}
+		total.Add(s)
+	}
+	p.Close()
+
+	requests := 0
+	for e := range eventChan {
+		if e.Kind() == KindRequest {
+			requests++
+		}
+	}
+	if requests != total.Requests {
+		t.Errorf("requests %d, stats: %+v", requests, total)
+	}
+}
+
+func TestShards(t *testing.T) {
+	var stats []FeedStats
+	var conns []map[uint]string // the connections by their streams
+	for _, shards := range []int{1, 4} {
+		seqs := make(map[uint]string)
+		conns = append(conns, seqs)
+		eventChan := make(chan Event, 1024)
+		p, err := NewPipeline(eventChan, Options{Offline: true, ConnEvents: true, Shards: shards})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps, err := NewPacketSource("testdata/dump.pcap", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for e := range eventChan {
+				if c, ok := e.(ConnectionEvent); ok && c.State == ConnOpen {
+					if _, ok := seqs[c.StreamSeq]; ok {
+						t.Errorf("duplicate stream %d", c.StreamSeq)
+					}
+					seqs[c.StreamSeq] = c.ClientAddr + " " + c.ServerAddr
+				}
+			}
+		}()
+		s := p.Feed(ps)
+		p.Close()
+		<-done
+
+		s.Elapsed = 0
+		stats = append(stats, s)
+	}
+
+	if stats[0] != stats[1] || stats[0].Requests == 0 {
+		t.Errorf("stats of 1 shard: %+v, 4 shards: %+v", stats[0], stats[1])
+	}
+	if len(conns[1]) != stats[1].Connections {
+		t.Errorf("streams %d, connections %d", len(conns[1]), stats[1].Connections)
+	}
+	if !reflect.DeepEqual(conns[0], conns[1]) {
+		t.Errorf("streams of 1 shard: %v, 4 shards: %v", conns[0], conns[1])
+	}
+}
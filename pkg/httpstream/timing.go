@@ -0,0 +1,57 @@
+package httpstream
+
+import (
+	"strings"
+	"time"
+)
+
+// Timing is the timing breakdown of an HTTP transaction, the times are captured from the wire.
+type Timing struct {
+	Handshake     time.Duration // TCP handshake of the connection, only set for its first request
+	RequestStart  time.Time     // first byte of request
+	RequestEnd    time.Time     // last byte of request
+	ResponseStart time.Time     // first byte of response
+	ResponseEnd   time.Time     // last byte of response
+}
+
+// Send is the time spent on sending the request.
+func (t Timing) Send() time.Duration { return span(t.RequestStart, t.RequestEnd) }
+
+// Wait is the time waiting for the first byte of response after the request sent (TTFB).
+func (t Timing) Wait() time.Duration { return span(t.RequestEnd, t.ResponseStart) }
+
+// Receive is the time spent on receiving the response.
+func (t Timing) Receive() time.Duration { return span(t.ResponseStart, t.ResponseEnd) }
+
+// Total is the time from the first byte of request to the last byte of response.
+func (t Timing) Total() time.Duration { return span(t.RequestStart, t.ResponseEnd) }
+
+func (t Timing) String() string {
+	var parts []string
+	if t.Handshake > 0 {
+		parts = append(parts, "handshake:"+t.Handshake.String())
+	}
+	if !t.RequestStart.IsZero() {
+		parts = append(parts, "send:"+t.Send().String())
+	}
+	if !t.ResponseStart.IsZero() {
+		if !t.RequestStart.IsZero() {
+			parts = append(parts, "wait:"+t.Wait().String())
+		}
+		parts = append(parts, "receive:"+t.Receive().String())
+		if !t.RequestStart.IsZero() {
+			parts = append(parts, "total:"+t.Total().String())
+		}
+	}
+
+	return "(" + strings.Join(parts, " ") + ")"
+}
+
+// span returns the duration from start to end, 0 if any of them is unknown.
+func span(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+
+	return end.Sub(start)
+}
@@ -2,20 +2,29 @@ package main
 
 import (
 	"embed"
+	"encoding/json"
+	"fmt"
 	"io/fs"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 
+	"github.com/ga0/netgraph/pkg/httpstream"
 	"golang.org/x/net/websocket"
 )
 
-// NewNGServer creates HttpcapServer.
-func NewNGServer(addr string, saveEvent bool) *HttpcapServer {
+// NewNGServer creates HttpcapServer, which serves the metrics at /metrics,
+// the dependency graph at /graph.json and /graph.dot, and the bodies spilled to bodyDir at /body/<sha256>.
+func NewNGServer(addr string, saveEvent bool, metrics *httpstream.EventMetrics, graph *httpstream.EventGraph,
+	bodyDir string) *HttpcapServer {
 	s := &HttpcapServer{
 		addr:            addr,
 		connectedClient: make(map[*websocket.Conn]*WsClient),
 		saveEvent:       saveEvent,
+		metrics:         metrics,
+		graph:           graph,
+		bodyDir:         bodyDir,
 	}
 	s.serve()
 
@@ -29,6 +38,11 @@ var assetsFS embed.FS
 func (s *HttpcapServer) serve() {
 	assets, _ := fs.Sub(assetsFS, "assets")
 	http.Handle("/data", websocket.Handler(s.websocketHandler))
+	http.HandleFunc("/stats", s.statsHandler)
+	http.Handle("/metrics", s.metrics)
+	http.Handle("/graph.json", s.graph)
+	http.Handle("/graph.dot", s.graph)
+	http.HandleFunc("/body/", s.bodyHandler)
 	http.Handle("/", http.FileServer(http.FS(assets)))
 	s.wg.Add(1)
 	go s.listenAndServe()
@@ -41,8 +55,11 @@ type HttpcapServer struct {
 	connectedClient      map[*websocket.Conn]*WsClient
 	connectedClientMutex sync.Mutex
 
-	eventBuffer []interface{}
+	eventBuffer []httpstream.Event
 	saveEvent   bool
+	metrics     *httpstream.EventMetrics
+	graph       *httpstream.EventGraph
+	bodyDir     string
 	wg          sync.WaitGroup
 }
 
@@ -64,7 +81,7 @@ func (s *HttpcapServer) websocketHandler(ws *websocket.Conn) {
 }
 
 // PushEvent dispatches the event received from ngnet to all clients connected with websocket.
-func (s *HttpcapServer) PushEvent(e interface{}) {
+func (s *HttpcapServer) PushEvent(e httpstream.Event) {
 	if s.saveEvent {
 		s.eventBuffer = append(s.eventBuffer, e)
 	}
@@ -75,6 +92,27 @@ func (s *HttpcapServer) PushEvent(e interface{}) {
 	s.connectedClientMutex.Unlock()
 }
 
+// statsHandler responds the statistics of the output queues.
+func (s *HttpcapServer) statsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(httpstream.AllQueueStats()); err != nil {
+		log.Printf("E! write stats, error: %v", err)
+	}
+}
+
+// bodyHandler responds the spilled body of the SHA-256 in the path as a download.
+func (s *HttpcapServer) bodyHandler(w http.ResponseWriter, r *http.Request) {
+	sha := strings.TrimPrefix(r.URL.Path, "/body/")
+	name := httpstream.BodyFile(s.bodyDir, sha)
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", sha))
+	http.ServeFile(w, r, name)
+}
+
 // Wait waits for serving
 func (s *HttpcapServer) Wait() { s.wg.Wait() }
 
@@ -1,7 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"log"
+
+	"github.com/ga0/netgraph/pkg/httpstream"
 	"golang.org/x/net/websocket"
 )
 
@@ -10,13 +12,13 @@ func NewWsClient(ws *websocket.Conn, server *HttpcapServer) *WsClient {
 	c := new(WsClient)
 	c.server = server
 	c.ws = ws
-	c.eventChan = make(chan interface{}, 16)
+	c.eventChan = make(chan httpstream.Event, 16)
 	return c
 }
 
 // WsClient is the websocket client
 type WsClient struct {
-	eventChan chan interface{}
+	eventChan chan httpstream.Event
 	server    *HttpcapServer
 	ws        *websocket.Conn
 }
@@ -36,9 +38,12 @@ func (c *WsClient) recvAndProcessCommand() {
 
 func (c *WsClient) transmitEvents() {
 	for ev := range c.eventChan {
-		if jso, err := json.Marshal(ev); err == nil {
-			websocket.Message.Send(c.ws, string(jso))
+		jso, err := httpstream.MarshalEvent(ev)
+		if err != nil {
+			log.Printf("E! %v", err)
+			continue
 		}
+		websocket.Message.Send(c.ws, string(jso))
 	}
 }
 